@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alo-distributed-memcached/pkg"
+	"github.com/alo-distributed-memcached/pkg/eviction"
+	"github.com/alo-distributed-memcached/pkg/membership"
 )
 
 var db = map[string]string{
@@ -15,31 +25,153 @@ var db = map[string]string{
 	"Sam":  "567",
 }
 
-func createGroup() *pkg.Group {
+func createGroup(opts ...pkg.GroupOption) *pkg.Group {
 	return pkg.NewGroup("score", 2<<10, pkg.GetterFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[SlowDB] search key", key)
 			if v, ok := db[key]; ok{
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
+			return nil, fmt.Errorf("%s: %w", key, pkg.ErrNotFound)
 		},
-	))
+	), opts...)
+}
+
+// peerOptions set how the HTTP peers talk to each other.
+type peerOptions struct {
+	h2c        bool
+	tls        pkg.PeerTLSConfig // mutual TLS when CertFile is set
+	hmacSecret string
+	maxBody    int64 // bytes of the body of a peer request
+	handoff    int   // hottest entries handed to their new owners on SIGTERM
 }
 
-func startCacheServer(addr string, addrs []string, alo *pkg.Group) {
+func startCacheServer(addr string, addrs []string, alo *pkg.Group, admin func(pkg.PeerManager) *membership.Memberlist, opts peerOptions) *pkg.Node {
 	peers := pkg.NewHTTPPool(addr)
+	var handler http.Handler = peers
+	if opts.h2c {
+		cfg := pkg.DefaultHTTPClientConfig
+		cfg.H2C = true
+		peers.SetHTTPClient(pkg.NewHTTPClient(cfg))
+		handler = pkg.H2CHandler(peers)
+	}
+	if opts.tls.CertFile != "" {
+		if err := peers.SetTLS(opts.tls); err != nil {
+			log.Fatal(err)
+		}
+	}
+	peers.SetMaxBodyBytes(opts.maxBody)
+	if opts.hmacSecret != "" {
+		peers.SetHMACSecret([]byte(opts.hmacSecret), 30*time.Second)
+	}
 	peers.SetPeers(addrs...)
 	alo.RegisterPeerPicker(peers)
+	server := &http.Server{
+		Addr:      addr[strings.Index(addr, "://")+3:],
+		Handler:   handler,
+		TLSConfig: peers.ServerTLSConfig(),
+	}
+	node := pkg.NewNode(peers, server, alo)
+	node.SetHandoff(opts.handoff)
+	// serve before joining, the peers hand their entries off right away
+	if err := node.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if list := admin(peers); list != nil {
+		node.SetMembership(list)
+	}
 	log.Println("alo distributed cahche is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	return node
+}
+
+func startGRPCCacheServer(addr string, addrs []string, alo *pkg.Group, admin func(pkg.PeerManager) *membership.Memberlist, handoff int) *pkg.Node {
+	peers := pkg.NewGRPCPool(addr)
+	peers.SetPeers(addrs...)
+	alo.RegisterPeerPicker(peers)
+	node := pkg.NewGRPCNode(peers, addr, alo)
+	node.SetHandoff(handoff)
+	// serve before joining, the peers hand their entries off right away
+	if err := node.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if list := admin(peers); list != nil {
+		node.SetMembership(list)
+	}
+	log.Println("alo distributed cahche is running at", addr, "over gRPC")
+	return node
+}
+
+// shutdownOnSignal drains and stops the node on SIGTERM or interrupt, in at
+// most drainTimeout.
+func shutdownOnSignal(node *pkg.Node, drainTimeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	log.Println("draining before shutdown")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func startAdminServer(adminAddr string, token string, peers pkg.PeerManager, view pkg.MembershipView) {
+	admin := pkg.NewAdminHandler(peers, token)
+	if view != nil {
+		admin.SetMembership(view)
+	}
+	log.Println("admin server is running at", adminAddr)
+	log.Fatal(http.ListenAndServe(adminAddr, admin))
+}
+
+func startMemcacheServer(memcacheAddr string, alo *pkg.Group) {
+	lis, err := net.Listen("tcp", memcacheAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("memcache server is running at", memcacheAddr)
+	log.Fatal(pkg.NewMemcacheServer(alo).Serve(lis))
+}
+
+func startRESPServer(respAddr string, alo *pkg.Group) {
+	lis, err := net.Listen("tcp", respAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("redis server is running at", respAddr)
+	log.Fatal(pkg.NewRESPServer(alo).Serve(lis))
+}
+
+// startGossip runs the membership protocol on gossipAddr and keeps the ring in sync with the live members.
+// The datagrams are signed with secret, unless it is empty.
+func startGossip(self string, gossipAddr string, seeds []string, peers pkg.PeerManager, secret string) *membership.Memberlist {
+	transport, err := membership.NewSignedUDPTransport(gossipAddr, []byte(secret))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if secret == "" {
+		log.Println("gossip is not authenticated, set ALO_HMAC_SECRET or keep", gossipAddr, "reachable by the nodes only")
+	}
+	list := membership.New(membership.Config{
+		Name:     self,
+		Addr:     gossipAddr,
+		OnChange: pkg.SyncPeersOnJoin(peers),
+	}, transport)
+	list.Start()
+	list.Join(seeds...)
+	log.Println("gossip is running at", gossipAddr)
+	return list
 }
 
 func startAPIServer(apiAddr string, alo *pkg.Group){
 	http.Handle("/api", http.HandlerFunc(
 		func (w http.ResponseWriter, r *http.Request)  {
 			key := r.URL.Query().Get("key")
-			view, err := alo.Get(key)
+			view, err := alo.GetContext(r.Context(), key)
+			if errors.Is(err, pkg.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -48,16 +180,60 @@ func startAPIServer(apiAddr string, alo *pkg.Group){
 			w.Write(view.ByteSlice())
 		},
 	))
+	http.Handle("/metrics", pkg.MetricsHandler())
 	log.Println("fontend server is running at", apiAddr)
 	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
 }
 
+// trimScheme returns addr without its http:// or https:// prefix.
+func trimScheme(addr string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+}
+
 func main() {
 	var port int
 	var api bool
+	var transport string
+	var adminAddr, adminToken string
+	var gossipAddr, join string
+	var replicas int
+	var hot bool
+	var memcacheAddr, respAddr string
+	var evictionPolicy string
+	var negativeTTL time.Duration
+	var peerRetries int
+	var hedgePercentile float64
+	var peerOpts peerOptions
+	var drainTimeout time.Duration
+	var rebalanceRate int64
 	flag.IntVar(&port, "port", 8001, "Geecache server port")
 	flag.BoolVar(&api, "api", false, "Start a api server?")
+	flag.StringVar(&transport, "transport", "http", "Peer transport: http or grpc")
+	flag.StringVar(&adminAddr, "admin", "", "Address of the admin server managing cluster membership, e.g. localhost:7001")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin server")
+	flag.StringVar(&gossipAddr, "gossip", "", "UDP address of the gossip membership protocol, e.g. localhost:7946; signed with ALO_HMAC_SECRET, anyone reaching it can change the membership otherwise")
+	flag.StringVar(&join, "join", "", "Comma separated gossip addresses of the nodes to join")
+	flag.IntVar(&replicas, "replicas", 1, "Number of nodes holding each key")
+	flag.BoolVar(&hot, "hot", false, "Keep popular keys of other nodes in a hot cache?")
+	flag.StringVar(&memcacheAddr, "memcache", "", "Address of the memcached protocol server, e.g. localhost:11211")
+	flag.StringVar(&respAddr, "resp", "", "Address of the redis protocol server, e.g. localhost:6379")
+	flag.StringVar(&evictionPolicy, "eviction", "lru", "Eviction policy: lru, lfu, arc or tinylfu")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 10*time.Second, "How long missing keys are remembered, 0 disables it")
+	flag.IntVar(&peerRetries, "peer-retries", 0, "Retries of a peer get which failed to reach the peer")
+	flag.Float64Var(&hedgePercentile, "hedge", 0, "Percentile of the peer latency after which a get is hedged, e.g. 0.95, 0 disables it")
+	flag.BoolVar(&peerOpts.h2c, "h2c", false, "Talk HTTP/2 without TLS to the peers, every node must set it")
+	flag.StringVar(&peerOpts.tls.CertFile, "tls-cert", "", "Certificate of the node, enables mutual TLS between the peers of the http transport")
+	flag.StringVar(&peerOpts.tls.KeyFile, "tls-key", "", "Key of the certificate of the node")
+	flag.StringVar(&peerOpts.tls.CAFile, "tls-ca", "", "CA signing the certificates of the peers")
+	flag.Int64Var(&peerOpts.maxBody, "max-peer-body", pkg.DefaultMaxBodyBytes, "Largest body of a request of another node, larger ones are answered 413")
+	flag.IntVar(&peerOpts.handoff, "handoff", 0, "Hottest entries handed to their new owners on SIGTERM, 0 drops them")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long a node drains on SIGTERM before it exits")
+	flag.Int64Var(&rebalanceRate, "rebalance-rate", 8<<20, "Bytes per second of cached values sent to the nodes joining the ring, 0 disables it")
 	flag.Parse()
+	if transport == "grpc" && peerOpts.tls.CertFile != "" {
+		// the gRPC pool serves and dials in plaintext
+		log.Fatal("-tls-cert is not supported with -transport=grpc")
+	}
 
 	apiAddr := "http://localhost:9999"
 	addrMap := map[int]string{
@@ -71,9 +247,75 @@ func main() {
 		addrs = append(addrs, v)
 	}
 
-	alo := createGroup()
+	opts := []pkg.GroupOption{pkg.WithReplicas(replicas)}
+	if hot {
+		opts = append(opts, pkg.WithHotCache(1.0/8, 0.1))
+	}
+	policy, err := eviction.ByName(evictionPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, pkg.WithEvictionPolicy(policy), pkg.WithNegativeCache(negativeTTL, 64<<10))
+	if peerRetries > 0 {
+		opts = append(opts, pkg.WithPeerRetries(peerRetries, 10*time.Millisecond))
+	}
+	if rebalanceRate > 0 {
+		opts = append(opts, pkg.WithRebalance(rebalanceRate))
+	}
+	if hedgePercentile > 0 {
+		opts = append(opts, pkg.WithHedging(hedgePercentile, 5*time.Millisecond))
+	}
+	alo := createGroup(opts...)
 	if api {
 		go startAPIServer(apiAddr, alo)
 	}
-	startCacheServer(addrMap[port], []string(addrs), alo)
+	if memcacheAddr != "" {
+		go startMemcacheServer(memcacheAddr, alo)
+	}
+	if respAddr != "" {
+		go startRESPServer(respAddr, alo)
+	}
+	// read from the environment to keep it out of the process list
+	peerOpts.hmacSecret = os.Getenv("ALO_HMAC_SECRET")
+
+	self := fmt.Sprintf("http://localhost:%d", port)
+	if peerOpts.tls.CertFile != "" {
+		self = strings.Replace(self, "http://", "https://", 1)
+		for i := range addrs {
+			addrs[i] = strings.Replace(addrs[i], "http://", "https://", 1)
+		}
+	}
+	if transport == "grpc" {
+		// gRPC peers are addressed by host:port only
+		self = trimScheme(self)
+		for i := range addrs {
+			addrs[i] = trimScheme(addrs[i])
+		}
+	}
+	admin := func(peers pkg.PeerManager) *membership.Memberlist {
+		var list *membership.Memberlist
+		var view pkg.MembershipView
+		if gossipAddr != "" {
+			var seeds []string
+			if join != "" {
+				seeds = strings.Split(join, ",")
+			}
+			list = startGossip(self, gossipAddr, seeds, peers, peerOpts.hmacSecret)
+			view = list
+		}
+		if adminAddr != "" {
+			go startAdminServer(adminAddr, adminToken, peers, view)
+		}
+		return list
+	}
+	var node *pkg.Node
+	switch transport {
+	case "http":
+		node = startCacheServer(self, []string(addrs), alo, admin, peerOpts)
+	case "grpc":
+		node = startGRPCCacheServer(self, addrs, alo, admin, peerOpts.handoff)
+	default:
+		log.Fatalf("unknown transport %q", transport)
+	}
+	shutdownOnSignal(node, drainTimeout)
 }
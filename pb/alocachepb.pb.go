@@ -5,15 +5,15 @@
 // source: alocachepb.proto
 
 package pb
+
 import (
-	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/runtime/protoimpl"
-	"reflect"
-	"sync"
-	"unsafe"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
 )
 
-
 const (
 	// Verify that this generated code is sufficiently up-to-date.
 	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
@@ -21,10 +21,70 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// ErrorCode tells why a node could not serve a request.
+type ErrorCode int32
+
+const (
+	ErrorCode_OK            ErrorCode = 0
+	ErrorCode_NOT_FOUND     ErrorCode = 1 // the getter of the owner reported the key missing
+	ErrorCode_GROUP_UNKNOWN ErrorCode = 2 // the node has no such group
+	ErrorCode_OVERLOADED    ErrorCode = 3 // the node or its backing store sheds load
+	ErrorCode_TIMEOUT       ErrorCode = 4 // the deadline of the request passed
+	ErrorCode_INTERNAL      ErrorCode = 5 // any other failure, e.g. of the getter
+)
+
+// Enum value maps for ErrorCode.
+var (
+	ErrorCode_name = map[int32]string{
+		0: "OK",
+		1: "NOT_FOUND",
+		2: "GROUP_UNKNOWN",
+		3: "OVERLOADED",
+		4: "TIMEOUT",
+		5: "INTERNAL",
+	}
+	ErrorCode_value = map[string]int32{
+		"OK":            0,
+		"NOT_FOUND":     1,
+		"GROUP_UNKNOWN": 2,
+		"OVERLOADED":    3,
+		"TIMEOUT":       4,
+		"INTERNAL":      5,
+	}
+)
+
+func (x ErrorCode) Enum() *ErrorCode {
+	p := new(ErrorCode)
+	*p = x
+	return p
+}
+
+func (x ErrorCode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ErrorCode) Descriptor() protoreflect.EnumDescriptor {
+	return file_alocachepb_proto_enumTypes[0].Descriptor()
+}
+
+func (ErrorCode) Type() protoreflect.EnumType {
+	return &file_alocachepb_proto_enumTypes[0]
+}
+
+func (x ErrorCode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ErrorCode.Descriptor instead.
+func (ErrorCode) EnumDescriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{0}
+}
+
 type Request struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
 	Key           string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Replica       bool                   `protobuf:"varint,3,opt,name=replica,proto3" json:"replica,omitempty"` // act on the receiving node only, set by the owner updating its replicas
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -73,9 +133,21 @@ func (x *Request) GetKey() string {
 	return ""
 }
 
+func (x *Request) GetReplica() bool {
+	if x != nil {
+		return x.Replica
+	}
+	return false
+}
+
 type Response struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	TtlMs         int64                  `protobuf:"varint,2,opt,name=ttl_ms,json=ttlMs,proto3" json:"ttl_ms,omitempty"`            // remaining time to live in milliseconds, 0 means no expiration; for NOT_FOUND how long to remember it
+	Stale         bool                   `protobuf:"varint,4,opt,name=stale,proto3" json:"stale,omitempty"`                         // the value is past its expiration, served by the owner while it is refreshed
+	Code          ErrorCode              `protobuf:"varint,5,opt,name=code,proto3,enum=alocachepb.ErrorCode" json:"code,omitempty"` // OK unless the request failed, value is then empty
+	Error         string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`                          // message of the failure
+	Flags         uint32                 `protobuf:"varint,7,opt,name=flags,proto3" json:"flags,omitempty"`                         // opaque flags stored with the value by memcached clients
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -117,20 +189,526 @@ func (x *Response) GetValue() []byte {
 	return nil
 }
 
+func (x *Response) GetTtlMs() int64 {
+	if x != nil {
+		return x.TtlMs
+	}
+	return 0
+}
+
+func (x *Response) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+func (x *Response) GetCode() ErrorCode {
+	if x != nil {
+		return x.Code
+	}
+	return ErrorCode_OK
+}
+
+func (x *Response) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Response) GetFlags() uint32 {
+	if x != nil {
+		return x.Flags
+	}
+	return 0
+}
+
+type SetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Key           string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	TtlMs         int64                  `protobuf:"varint,4,opt,name=ttl_ms,json=ttlMs,proto3" json:"ttl_ms,omitempty"` // 0 means the owner's default TTL, -1 no expiration
+	Replica       bool                   `protobuf:"varint,5,opt,name=replica,proto3" json:"replica,omitempty"`          // store on the receiving node only, set by the owner updating its replicas
+	Flags         uint32                 `protobuf:"varint,6,opt,name=flags,proto3" json:"flags,omitempty"`              // opaque flags stored with the value by memcached clients
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetRequest) Reset() {
+	*x = SetRequest{}
+	mi := &file_alocachepb_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetRequest) ProtoMessage() {}
+
+func (x *SetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetRequest.ProtoReflect.Descriptor instead.
+func (*SetRequest) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SetRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *SetRequest) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *SetRequest) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *SetRequest) GetTtlMs() int64 {
+	if x != nil {
+		return x.TtlMs
+	}
+	return 0
+}
+
+func (x *SetRequest) GetReplica() bool {
+	if x != nil {
+		return x.Replica
+	}
+	return false
+}
+
+func (x *SetRequest) GetFlags() uint32 {
+	if x != nil {
+		return x.Flags
+	}
+	return 0
+}
+
+type SetResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetResponse) Reset() {
+	*x = SetResponse{}
+	mi := &file_alocachepb_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetResponse) ProtoMessage() {}
+
+func (x *SetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetResponse.ProtoReflect.Descriptor instead.
+func (*SetResponse) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{3}
+}
+
+type DeleteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Deleted       bool                   `protobuf:"varint,1,opt,name=deleted,proto3" json:"deleted,omitempty"` // whether the key was cached by the owner
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteResponse) Reset() {
+	*x = DeleteResponse{}
+	mi := &file_alocachepb_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteResponse) ProtoMessage() {}
+
+func (x *DeleteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteResponse.ProtoReflect.Descriptor instead.
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *DeleteResponse) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+type BatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Keys          []string               `protobuf:"bytes,2,rep,name=keys,proto3" json:"keys,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchRequest) Reset() {
+	*x = BatchRequest{}
+	mi := &file_alocachepb_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchRequest) ProtoMessage() {}
+
+func (x *BatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchRequest.ProtoReflect.Descriptor instead.
+func (*BatchRequest) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *BatchRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *BatchRequest) GetKeys() []string {
+	if x != nil {
+		return x.Keys
+	}
+	return nil
+}
+
+type BatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        map[string]*Response   `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // keys the owner failed to load are left out
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchResponse) Reset() {
+	*x = BatchResponse{}
+	mi := &file_alocachepb_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchResponse) ProtoMessage() {}
+
+func (x *BatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchResponse.ProtoReflect.Descriptor instead.
+func (*BatchResponse) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *BatchResponse) GetValues() map[string]*Response {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type Entry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	TtlMs         int64                  `protobuf:"varint,3,opt,name=ttl_ms,json=ttlMs,proto3" json:"ttl_ms,omitempty"` // remaining time to live in milliseconds, 0 means no expiration
+	Flags         uint32                 `protobuf:"varint,4,opt,name=flags,proto3" json:"flags,omitempty"`              // opaque flags stored with the value by memcached clients
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Entry) Reset() {
+	*x = Entry{}
+	mi := &file_alocachepb_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Entry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Entry) ProtoMessage() {}
+
+func (x *Entry) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Entry.ProtoReflect.Descriptor instead.
+func (*Entry) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Entry) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Entry) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *Entry) GetTtlMs() int64 {
+	if x != nil {
+		return x.TtlMs
+	}
+	return 0
+}
+
+func (x *Entry) GetFlags() uint32 {
+	if x != nil {
+		return x.Flags
+	}
+	return 0
+}
+
+type HandoffRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Entries       []*Entry               `protobuf:"bytes,2,rep,name=entries,proto3" json:"entries,omitempty"` // values of keys the receiving node now owns
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HandoffRequest) Reset() {
+	*x = HandoffRequest{}
+	mi := &file_alocachepb_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HandoffRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HandoffRequest) ProtoMessage() {}
+
+func (x *HandoffRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HandoffRequest.ProtoReflect.Descriptor instead.
+func (*HandoffRequest) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *HandoffRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *HandoffRequest) GetEntries() []*Entry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+type HandoffResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stored        int64                  `protobuf:"varint,1,opt,name=stored,proto3" json:"stored,omitempty"` // entries the receiving node did not have yet
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HandoffResponse) Reset() {
+	*x = HandoffResponse{}
+	mi := &file_alocachepb_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HandoffResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HandoffResponse) ProtoMessage() {}
+
+func (x *HandoffResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_alocachepb_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HandoffResponse.ProtoReflect.Descriptor instead.
+func (*HandoffResponse) Descriptor() ([]byte, []int) {
+	return file_alocachepb_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *HandoffResponse) GetStored() int64 {
+	if x != nil {
+		return x.Stored
+	}
+	return 0
+}
+
 var File_alocachepb_proto protoreflect.FileDescriptor
 
 const file_alocachepb_proto_rawDesc = "" +
 	"\n" +
 	"\x10alocachepb.proto\x12\n" +
-	"alocachepb\"1\n" +
+	"alocachepb\"K\n" +
 	"\aRequest\x12\x14\n" +
 	"\x05group\x18\x01 \x01(\tR\x05group\x12\x10\n" +
-	"\x03key\x18\x02 \x01(\tR\x03key\" \n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x18\n" +
+	"\areplica\x18\x03 \x01(\bR\areplica\"\xaa\x01\n" +
 	"\bResponse\x12\x14\n" +
-	"\x05value\x18\x01 \x01(\fR\x05value2>\n" +
+	"\x05value\x18\x01 \x01(\fR\x05value\x12\x15\n" +
+	"\x06ttl_ms\x18\x02 \x01(\x03R\x05ttlMs\x12\x14\n" +
+	"\x05stale\x18\x04 \x01(\bR\x05stale\x12)\n" +
+	"\x04code\x18\x05 \x01(\x0e2\x15.alocachepb.ErrorCodeR\x04code\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\x12\x14\n" +
+	"\x05flags\x18\a \x01(\rR\x05flagsJ\x04\b\x03\x10\x04\"\x91\x01\n" +
+	"\n" +
+	"SetRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\x12\x15\n" +
+	"\x06ttl_ms\x18\x04 \x01(\x03R\x05ttlMs\x12\x18\n" +
+	"\areplica\x18\x05 \x01(\bR\areplica\x12\x14\n" +
+	"\x05flags\x18\x06 \x01(\rR\x05flags\"\r\n" +
+	"\vSetResponse\"*\n" +
+	"\x0eDeleteResponse\x12\x18\n" +
+	"\adeleted\x18\x01 \x01(\bR\adeleted\"8\n" +
+	"\fBatchRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x12\n" +
+	"\x04keys\x18\x02 \x03(\tR\x04keys\"\x9f\x01\n" +
+	"\rBatchResponse\x12=\n" +
+	"\x06values\x18\x01 \x03(\v2%.alocachepb.BatchResponse.ValuesEntryR\x06values\x1aO\n" +
+	"\vValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12*\n" +
+	"\x05value\x18\x02 \x01(\v2\x14.alocachepb.ResponseR\x05value:\x028\x01\"\\\n" +
+	"\x05Entry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\x12\x15\n" +
+	"\x06ttl_ms\x18\x03 \x01(\x03R\x05ttlMs\x12\x14\n" +
+	"\x05flags\x18\x04 \x01(\rR\x05flags\"S\n" +
+	"\x0eHandoffRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12+\n" +
+	"\aentries\x18\x02 \x03(\v2\x11.alocachepb.EntryR\aentries\")\n" +
+	"\x0fHandoffResponse\x12\x16\n" +
+	"\x06stored\x18\x01 \x01(\x03R\x06stored*`\n" +
+	"\tErrorCode\x12\x06\n" +
+	"\x02OK\x10\x00\x12\r\n" +
+	"\tNOT_FOUND\x10\x01\x12\x11\n" +
+	"\rGROUP_UNKNOWN\x10\x02\x12\x0e\n" +
+	"\n" +
+	"OVERLOADED\x10\x03\x12\v\n" +
+	"\aTIMEOUT\x10\x04\x12\f\n" +
+	"\bINTERNAL\x10\x052\xb6\x02\n" +
 	"\n" +
 	"GroupCache\x120\n" +
-	"\x03Get\x12\x13.alocachepb.Request\x1a\x14.alocachepb.ResponseB!Z\x1falo-distributed-memcached/pb;pbb\x06proto3"
+	"\x03Get\x12\x13.alocachepb.Request\x1a\x14.alocachepb.Response\x126\n" +
+	"\x03Set\x12\x16.alocachepb.SetRequest\x1a\x17.alocachepb.SetResponse\x129\n" +
+	"\x06Delete\x12\x13.alocachepb.Request\x1a\x1a.alocachepb.DeleteResponse\x12?\n" +
+	"\bGetMulti\x12\x18.alocachepb.BatchRequest\x1a\x19.alocachepb.BatchResponse\x12B\n" +
+	"\aHandoff\x12\x1a.alocachepb.HandoffRequest\x1a\x1b.alocachepb.HandoffResponseB,Z*github.com/alo-distributed-memcached/pb;pbb\x06proto3"
 
 var (
 	file_alocachepb_proto_rawDescOnce sync.Once
@@ -144,19 +722,42 @@ func file_alocachepb_proto_rawDescGZIP() []byte {
 	return file_alocachepb_proto_rawDescData
 }
 
-var file_alocachepb_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_alocachepb_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_alocachepb_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_alocachepb_proto_goTypes = []any{
-	(*Request)(nil),  // 0: alocachepb.Request
-	(*Response)(nil), // 1: alocachepb.Response
+	(ErrorCode)(0),          // 0: alocachepb.ErrorCode
+	(*Request)(nil),         // 1: alocachepb.Request
+	(*Response)(nil),        // 2: alocachepb.Response
+	(*SetRequest)(nil),      // 3: alocachepb.SetRequest
+	(*SetResponse)(nil),     // 4: alocachepb.SetResponse
+	(*DeleteResponse)(nil),  // 5: alocachepb.DeleteResponse
+	(*BatchRequest)(nil),    // 6: alocachepb.BatchRequest
+	(*BatchResponse)(nil),   // 7: alocachepb.BatchResponse
+	(*Entry)(nil),           // 8: alocachepb.Entry
+	(*HandoffRequest)(nil),  // 9: alocachepb.HandoffRequest
+	(*HandoffResponse)(nil), // 10: alocachepb.HandoffResponse
+	nil,                     // 11: alocachepb.BatchResponse.ValuesEntry
 }
 var file_alocachepb_proto_depIdxs = []int32{
-	0, // 0: alocachepb.GroupCache.Get:input_type -> alocachepb.Request
-	1, // 1: alocachepb.GroupCache.Get:output_type -> alocachepb.Response
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0,  // 0: alocachepb.Response.code:type_name -> alocachepb.ErrorCode
+	11, // 1: alocachepb.BatchResponse.values:type_name -> alocachepb.BatchResponse.ValuesEntry
+	8,  // 2: alocachepb.HandoffRequest.entries:type_name -> alocachepb.Entry
+	2,  // 3: alocachepb.BatchResponse.ValuesEntry.value:type_name -> alocachepb.Response
+	1,  // 4: alocachepb.GroupCache.Get:input_type -> alocachepb.Request
+	3,  // 5: alocachepb.GroupCache.Set:input_type -> alocachepb.SetRequest
+	1,  // 6: alocachepb.GroupCache.Delete:input_type -> alocachepb.Request
+	6,  // 7: alocachepb.GroupCache.GetMulti:input_type -> alocachepb.BatchRequest
+	9,  // 8: alocachepb.GroupCache.Handoff:input_type -> alocachepb.HandoffRequest
+	2,  // 9: alocachepb.GroupCache.Get:output_type -> alocachepb.Response
+	4,  // 10: alocachepb.GroupCache.Set:output_type -> alocachepb.SetResponse
+	5,  // 11: alocachepb.GroupCache.Delete:output_type -> alocachepb.DeleteResponse
+	7,  // 12: alocachepb.GroupCache.GetMulti:output_type -> alocachepb.BatchResponse
+	10, // 13: alocachepb.GroupCache.Handoff:output_type -> alocachepb.HandoffResponse
+	9,  // [9:14] is the sub-list for method output_type
+	4,  // [4:9] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_alocachepb_proto_init() }
@@ -169,13 +770,14 @@ func file_alocachepb_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_alocachepb_proto_rawDesc), len(file_alocachepb_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   2,
+			NumEnums:      1,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_alocachepb_proto_goTypes,
 		DependencyIndexes: file_alocachepb_proto_depIdxs,
+		EnumInfos:         file_alocachepb_proto_enumTypes,
 		MessageInfos:      file_alocachepb_proto_msgTypes,
 	}.Build()
 	File_alocachepb_proto = out.File
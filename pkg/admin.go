@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/alo-distributed-memcached/pkg/membership"
+)
+
+const defaultAdminPath = "/alo-admin/"
+
+/*
+AdminHandler serves the operations endpoints of a node under /alo-admin/.
+Every request must carry "Authorization: Bearer <token>".
+
+	GET    /alo-admin/peers                list the peers of the ring
+	POST   /alo-admin/peers?peer=<addr>    add a peer to the ring
+	DELETE /alo-admin/peers?peer=<addr>    remove a peer from the ring
+	GET    /alo-admin/members              the gossip view of the cluster
+	GET    /alo-admin/breakers             the circuit breaker state of every peer
+*/
+type AdminHandler struct {
+	token      string
+	basePath   string
+	peers      PeerManager
+	membership MembershipView
+}
+
+// MembershipView is implemented by membership.Memberlist.
+type MembershipView interface {
+	Members() []membership.Member
+}
+
+// NewAdminHandler returns the admin endpoints of peers, an empty token
+// rejects every request.
+func NewAdminHandler(peers PeerManager, token string) *AdminHandler {
+	return &AdminHandler{
+		token:    token,
+		basePath: defaultAdminPath,
+		peers:    peers,
+	}
+}
+
+// SetMembership exposes the gossip view of the cluster on /alo-admin/members.
+func (a *AdminHandler) SetMembership(view MembershipView) {
+	a.membership = view
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, a.basePath) {
+	case "peers":
+		a.servePeers(w, r)
+	case "members":
+		if a.membership == nil || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, a.membership.Members())
+	case "breakers":
+		reporter, ok := a.peers.(BreakerReporter)
+		if !ok || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, reporter.Breakers())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *AdminHandler) servePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		peer := r.URL.Query().Get("peer")
+		if peer == "" {
+			http.Error(w, "peer is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			a.peers.AddPeer(peer)
+		} else {
+			a.peers.RemovePeer(peer)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, a.peers.Peers())
+}
+
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
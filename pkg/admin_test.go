@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alo-distributed-memcached/pkg/membership"
+)
+
+func adminRequest(t *testing.T, method, url, token string) (int, []string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var peers []string
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&peers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, peers
+}
+
+func TestAdminHandlerPeers(t *testing.T) {
+	pool := NewHTTPPool("http://node-a")
+	pool.SetPeers("http://node-a", "http://node-b")
+	server := httptest.NewServer(NewAdminHandler(pool, "secret"))
+	defer server.Close()
+	url := server.URL + defaultAdminPath + "peers"
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := adminRequest(t, http.MethodPost, url+"?peer=http://evil", token); code != http.StatusUnauthorized {
+			t.Fatalf("token %q: status %d, want 401", token, code)
+		}
+	}
+
+	code, peers := adminRequest(t, http.MethodPost, url+"?peer=http://node-c", "secret")
+	if expect := []string{"http://node-a", "http://node-b", "http://node-c"}; code != http.StatusOK || !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("after add: %d %v, want %v", code, peers, expect)
+	}
+
+	code, peers = adminRequest(t, http.MethodDelete, url+"?peer=http://node-b", "secret")
+	if expect := []string{"http://node-a", "http://node-c"}; code != http.StatusOK || !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("after remove: %d %v, want %v", code, peers, expect)
+	}
+
+	if code, _ := adminRequest(t, http.MethodPost, url, "secret"); code != http.StatusBadRequest {
+		t.Fatalf("missing peer: status %d, want 400", code)
+	}
+}
+
+func TestHTTPPoolAddRemovePeer(t *testing.T) {
+	pool := NewHTTPPool("http://node-a")
+	pool.SetPeers("http://node-a", "http://node-b")
+
+	owner := func(key string) string {
+		if peer, ok := pool.PickPeer(key); ok {
+			return peer.(*HTTPGetter).baseURL
+		}
+		return "self"
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = owner(key)
+	}
+
+	pool.AddPeer("http://node-c")
+	moved := 0
+	for key, was := range before {
+		now := owner(key)
+		if now != was {
+			if now != "http://node-c"+defaultBasePath {
+				t.Fatalf("%s moved from %s to %s", key, was, now)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("no key moved to the new peer")
+	}
+
+	pool.RemovePeer("http://node-c")
+	for key, was := range before {
+		if now := owner(key); now != was {
+			t.Fatalf("%s owned by %s after removal, want %s", key, now, was)
+		}
+	}
+}
+
+func TestMembershipFeedsRing(t *testing.T) {
+	network := membership.NewNetwork(0.05, 1)
+	names := []string{"http://node-a", "http://node-b", "http://node-c"}
+	pools := make([]*HTTPPool, len(names))
+	lists := make([]*membership.Memberlist, len(names))
+	for i, name := range names {
+		pool := NewHTTPPool(name)
+		pool.SetPeers(name)
+		pools[i] = pool
+		lists[i] = membership.New(membership.Config{
+			Name:             name,
+			Addr:             name[len("http://"):],
+			ProbeInterval:    20 * time.Millisecond,
+			SuspicionTimeout: 150 * time.Millisecond,
+			OnChange:         func(alive []string) { SyncPeers(pool, alive) },
+		}, network.Transport(name[len("http://"):]))
+		lists[i].Start()
+		t.Cleanup(lists[i].Stop)
+		lists[i].Join("node-a")
+	}
+
+	waitPeers := func(pool *HTTPPool, expect []string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(pool.Peers(), expect) {
+			if time.Now().After(deadline) {
+				t.Fatalf("peers = %v, want %v", pool.Peers(), expect)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitPeers(pools[0], names)
+
+	network.SetDown("node-c", true)
+	waitPeers(pools[0], names[:2])
+	waitPeers(pools[1], names[:2])
+
+	admin := NewAdminHandler(pools[0], "secret")
+	admin.SetMembership(lists[0])
+	req := httptest.NewRequest(http.MethodGet, defaultAdminPath+"members", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+
+	var members []membership.Member
+	if err := json.NewDecoder(rec.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 || members[2].Name != "http://node-c" || members[2].State != membership.StateDead {
+		t.Fatalf("members = %+v", members)
+	}
+}
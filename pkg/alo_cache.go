@@ -1,11 +1,16 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alo-distributed-memcached/pb"
+	"github.com/alo-distributed-memcached/pkg/eviction"
 	singleflight "github.com/alo-distributed-memcached/pkg/single_flight"
 )
 
@@ -19,14 +24,211 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 	return f(key)
 }
 
+// TTLGetter is an optional interface of Getter, the getter returns
+// how long the value may be cached along with the value itself.
+// A ttl <= 0 falls back to the group's default TTL.
+type TTLGetter interface {
+	GetWithTTL(key string) ([]byte, time.Duration, error)
+}
+
+type TTLGetterFunc func(key string) ([]byte, time.Duration, error)
+
+func (f TTLGetterFunc) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	return f(key)
+}
+
+func (f TTLGetterFunc) Get(key string) ([]byte, error) {
+	b, _, err := f(key)
+	return b, err
+}
+
+// ContextGetter is an optional interface of Getter, the getter receives the
+// context of the Get so it can give up once the caller does.
+// It is preferred over TTLGetter and Getter when implemented.
+type ContextGetter interface {
+	GetContext(ctx context.Context, key string) ([]byte, error)
+}
+
+type ContextGetterFunc func(ctx context.Context, key string) ([]byte, error)
+
+func (f ContextGetterFunc) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+func (f ContextGetterFunc) Get(key string) ([]byte, error) {
+	return f(context.Background(), key)
+}
+
+const defaultSweepInterval = time.Minute
+
 type Group struct {
 	name      string
 	getter    Getter
 	mainCache ConcurrentCache
+	// hotCache holds values owned by other nodes which were popular enough to
+	// be kept here too, saving the round trip to the owner.
+	hotCache ConcurrentCache
+	// negCache holds the keys the getter reported missing, see WithNegativeCache.
+	negCache    ConcurrentCache
+	negativeTTL time.Duration // 0 means misses are not cached
+
+	refreshAhead   time.Duration // hits closer to expiration start a refresh
+	refreshTimeout time.Duration // bounds a background refresh
+	refreshing     sync.Map      // keys refreshed in background
 	// HTTPPool implement PeerPicker interface. When the data is not in current node, current node will use HTTPPool.PickPeer()
 	// to get the **HTTPGetter** of other node (not the other node) that has the data.
 	peerPicker PeerPicker
 	loader     *singleflight.CallsGroup
+	inflight   loadTracker // loads and refreshes running, see waitLoads
+
+	defaultTTL    time.Duration // 0 means values loaded locally never expire
+	sweepInterval time.Duration
+	sweepOnce     sync.Once
+	replicas      int // number of nodes holding each key, the primary included
+
+	hotCacheProbability float64 // chance of keeping a value fetched from a peer in hotCache
+
+	peerRetries     int // retries of a peer get which failed to reach the peer
+	retryBackoff    time.Duration
+	hedgePercentile float64
+	hedgeMinDelay   time.Duration
+	peerLatency     *latencyTracker // latencies of the peer gets, nil without hedging
+
+	rebalanceRate  int64         // bytes per second sent to the peers joining the ring
+	rebalanceQueue chan struct{} // nil without WithRebalance
+	rebalanceOnce  sync.Once
+
+	// batcher coalesces the misses of a BatchGetter or BatchTTLGetter, nil for other getters
+	batcher     *loadBatcher
+	batchWindow time.Duration
+	batchSize   int
+
+	// Stats are statistics on the group.
+	Stats Stats
+}
+
+// Stats count what the group did since it was created, they are exported
+// by metrics.go. Loads counts the misses which went through the
+// singleflight: Gets - CacheHits - NegativeHits, less the keys of a GetMulti
+// batched to their owner. Refreshes run outside of Gets, their fetches only
+// show in the peer and local counters.
+type Stats struct {
+	Gets          AtomicInt // keys asked by Get, GetMulti and the other nodes
+	CacheHits     AtomicInt // gets served by the main or the hot cache
+	HotCacheHits  AtomicInt // the part of CacheHits served by the hot cache
+	Loads         AtomicInt // misses loaded one key at a time, see above
+	LoadsDeduped  AtomicInt // loads which fetched the key, Loads - LoadsDeduped waited on a fetch in flight
+	PeerLoads     AtomicInt // keys a peer answered with a value, or with not found to a single get
+	PeerErrors    AtomicInt // failed requests to peers, a failed batch counts once
+	LocalLoads    AtomicInt // values loaded by the getter of this node
+	LocalLoadErrs AtomicInt // failures of the getter of this node, not found included
+	NegativeHits  AtomicInt // requests answered not found by the negative cache
+	StaleHits     AtomicInt // hits served past expiration, within the stale grace
+	Refreshes     AtomicInt // background refreshes started by hits
+	PeerRetries   AtomicInt // peer gets sent again after failing to reach the peer
+	HedgesFired   AtomicInt // second requests sent for slow peer gets
+	HedgesWon     AtomicInt // hedges which answered first
+	HandedOff     AtomicInt // entries sent to the peers now owning their keys
+}
+
+// CacheType selects one of the caches of a group in CacheStats.
+type CacheType int
+
+const (
+	// MainCache holds the values loaded by the getter of this node or stored
+	// on it, mostly of the keys it owns.
+	MainCache CacheType = iota + 1
+	// HotCache holds copies of popular values owned by other nodes, see
+	// WithHotCache.
+	HotCache
+	// NegativeCache remembers the keys the getter reported missing, see
+	// WithNegativeCache.
+	NegativeCache
+)
+
+// CacheStats returns the size and the counters of one cache of the group.
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.Stats()
+	case HotCache:
+		return g.hotCache.Stats()
+	case NegativeCache:
+		return g.negCache.Stats()
+	default:
+		return CacheStats{}
+	}
+}
+
+// AtomicInt is an int64 to be accessed atomically.
+type AtomicInt int64
+
+// Add atomically adds n to i.
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i.
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+// GroupOption configures optional behaviours of a Group in NewGroup.
+type GroupOption func(*Group)
+
+// WithTTL sets the default time to live of values loaded by the group's getter.
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.defaultTTL = ttl
+	}
+}
+
+// WithHotCache keeps values fetched from other nodes in a hot cache, each one
+// with the given probability. The hot cache takes ratio of the group's
+// cacheBytes, the main cache keeps the rest.
+func WithHotCache(ratio float64, probability float64) GroupOption {
+	return func(g *Group) {
+		hotBytes := int64(float64(g.mainCache.cacheSize) * ratio)
+		g.hotCache.cacheSize = hotBytes
+		g.mainCache.cacheSize -= hotBytes
+		g.hotCacheProbability = probability
+	}
+}
+
+// WithSweepInterval sets how often expired entries are purged in background.
+func WithSweepInterval(interval time.Duration) GroupOption {
+	return func(g *Group) {
+		g.sweepInterval = interval
+	}
+}
+
+// WithEvictionPolicy sets the policy deciding which entries the main and hot
+// caches drop when full, LRU by default. See the eviction package.
+func WithEvictionPolicy(policy eviction.Factory) GroupOption {
+	return func(g *Group) {
+		g.mainCache.newPolicy = policy
+		g.hotCache.newPolicy = policy
+	}
+}
+
+// WithCacheShards splits the main and hot caches into n shards, rounded up to
+// a power of two, each with its own lock and 1/n of the budget. By default a
+// shard per CPU is used, fewer when a shard would keep less than 1MB.
+func WithCacheShards(n int) GroupOption {
+	return func(g *Group) {
+		g.mainCache.shardCount = n
+		g.hotCache.shardCount = n
+	}
+}
+
+// WithReadBuffer lets cache hits share a read lock: up to size accesses per
+// shard are queued and applied to the eviction policy in batches. Policies
+// which do not implement eviction.Peeker ignore it.
+func WithReadBuffer(size int) GroupOption {
+	return func(g *Group) {
+		g.mainCache.readBuffer = size
+		g.hotCache.readBuffer = size
+	}
 }
 
 var (
@@ -34,20 +236,39 @@ var (
 	globeGroups = make(map[string]*Group)
 )
 
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
+func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
 	mu.Lock()
 	defer mu.Unlock()
 
+	g := newGroup(name, cacheBytes, getter, opts...)
+	globeGroups[name] = g
+	return g
+}
+
+// newGroup creates a group without registering it in globeGroups.
+func newGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
 	g := &Group{
-		name:      name,
-		getter:    getter,
-		mainCache: ConcurrentCache{cacheSize: cacheBytes},
-		loader:    &singleflight.CallsGroup{},
+		name:           name,
+		getter:         getter,
+		mainCache:      ConcurrentCache{cacheSize: cacheBytes},
+		loader:         &singleflight.CallsGroup{},
+		sweepInterval:  defaultSweepInterval,
+		batchWindow:    defaultBatchWindow,
+		batchSize:      defaultBatchSize,
+		refreshTimeout: defaultRefreshTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	switch batch := g.getter.(type) {
+	case BatchTTLGetter:
+		g.batcher = newLoadBatcher(batch, g.batchWindow, g.batchSize)
+	case BatchGetter:
+		g.batcher = newLoadBatcher(batchTTLGetter{batch}, g.batchWindow, g.batchSize)
 	}
-	globeGroups[name] = g
 	return g
 }
 
@@ -59,16 +280,96 @@ func GetGroup(name string) *Group {
 }
 
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+// GetContext is Get bounded by ctx, its deadline and cancellation are passed
+// on to the peers and to the Getter.
+func (g *Group) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
 
-	if v, ok := g.mainCache.Get(key); ok {
-		log.Println("Cache hit")
+	g.Stats.Gets.Add(1)
+	if v, ok := g.lookupCache(key); ok {
+		g.Stats.CacheHits.Add(1)
 		return v, nil
 	}
+	if err := g.lookupNegative(key); err != nil {
+		return ByteView{}, err
+	}
 
-	return g.load(key)
+	return g.load(ctx, key)
+}
+
+// NoExpiration is the ttl of a value which never expires, whatever the
+// default TTL of the group.
+const NoExpiration = -time.Millisecond
+
+// Set stores the value on the node owning the key, with the group's default TTL.
+func (g *Group) Set(key string, value []byte) error {
+	return g.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL stores the value on the node owning the key.
+// A ttl <= 0 falls back to the owner's default TTL, except NoExpiration.
+func (g *Group) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return g.setWithContext(context.Background(), key, value, ttl)
+}
+
+func (g *Group) setWithContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return g.setWithFlags(ctx, key, value, 0, ttl)
+}
+
+// setWithFlags stores the value with the flags of a memcached client.
+func (g *Group) setWithFlags(ctx context.Context, key string, value []byte, flags uint32, ttl time.Duration) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	if replicas := g.pickReplicas(key); replicas != nil {
+		return g.setToReplicas(ctx, key, value, flags, ttl, replicas)
+	}
+
+	if peer, ok := g.pickPeer(key); ok {
+		// a copy loaded while the owner was unreachable must not outlive the write
+		g.removeLocally(key)
+		return g.setToPeer(ctx, peer, key, value, flags, ttl, false)
+	}
+
+	g.setLocally(key, value, flags, ttl)
+	return nil
+}
+
+// Delete removes the key from the node owning it,
+// and reports whether the owner had it cached.
+func (g *Group) Delete(key string) (bool, error) {
+	return g.deleteWithContext(context.Background(), key)
+}
+
+func (g *Group) deleteWithContext(ctx context.Context, key string) (bool, error) {
+	if key == "" {
+		return false, fmt.Errorf("key is required")
+	}
+
+	if replicas := g.pickReplicas(key); replicas != nil {
+		return g.deleteFromReplicas(ctx, key, replicas)
+	}
+
+	if peer, ok := g.pickPeer(key); ok {
+		g.removeLocally(key)
+		return g.deleteFromPeer(ctx, peer, key, false)
+	}
+
+	return g.removeLocally(key), nil
+}
+
+// Invalidate drops the cached value of the key on the owning node and on the
+// current node, so the next Get reloads it through the Getter.
+// It is Delete for callers which only care that no stale copy is left.
+func (g *Group) Invalidate(key string) error {
+	_, err := g.Delete(key)
+	return err
 }
 
 func (g *Group) RegisterPeerPicker(peerPicker PeerPicker) {
@@ -76,20 +377,20 @@ func (g *Group) RegisterPeerPicker(peerPicker PeerPicker) {
 		panic("RegisterPeerPick() called more than once")
 	}
 	g.peerPicker = peerPicker
+	if watcher, ok := peerPicker.(RingWatcher); ok && g.rebalanceQueue != nil {
+		watcher.WatchRing(g.scheduleRebalance)
+	}
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
+func (g *Group) load(ctx context.Context, key string) (value ByteView, err error) {
 	// Use singleflight to prevent cache breakdown. Pass in anonymous function
 	// The anonymous function will be executed once, and other concurrent requests will wait and reuse the result.
-	view, err := g.loader.Do(key, func() (interface{}, error) {
-		if g.peerPicker != nil {
-			if peer, ok := g.peerPicker.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
-					return value, nil
-				}
-			}
-		}
-		return g.getLocally(key)
+	// Each caller waits no longer than its own ctx, the load runs under the ctx of the first caller.
+	g.Stats.Loads.Add(1)
+	view, err := g.loader.DoContext(ctx, key, func() (interface{}, error) {
+		g.Stats.LoadsDeduped.Add(1)
+		defer g.inflight.done(g.inflight.start())
+		return g.fetch(ctx, key)
 	})
 
 	if err == nil {
@@ -99,32 +400,197 @@ func (g *Group) load(key string) (value ByteView, err error) {
 	return
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+// fetch loads the key from the nodes holding it, or through the getter.
+func (g *Group) fetch(ctx context.Context, key string) (ByteView, error) {
+	if replicas := g.pickReplicas(key); replicas != nil {
+		return g.loadFromReplicas(ctx, key, replicas)
+	}
+	if peer, ok := g.pickPeer(key); ok {
+		fromPeer := func(ctx context.Context) (ByteView, error) {
+			value, err := g.getFromPeerWithRetries(ctx, peer, key)
+			if err == nil {
+				g.maybePopulateHotCache(key, value)
+			}
+			return value, err
+		}
+		locally := func(ctx context.Context) (ByteView, error) {
+			return g.getLocally(ctx, key)
+		}
+		value, hedged, err := g.hedgedGet(ctx, fromPeer, locally)
+		if err == nil || hedged {
+			// the getter already ran as the hedge
+			return value, err
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, do not go on with the getter
+			return ByteView{}, ctx.Err()
+		}
+		if !fallbackOnPeerError(err) {
+			// e.g. not found, the owner is authoritative
+			return ByteView{}, err
+		}
+	}
+	return g.getLocally(ctx, key)
+}
+
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, ok := g.mainCache.Get(key); ok {
+		g.maybeRefresh(key, v, false)
+		return v, true
+	}
+	if v, ok := g.hotCache.Get(key); ok {
+		g.Stats.HotCacheHits.Add(1)
+		g.maybeRefresh(key, v, true)
+		return v, true
+	}
+	return ByteView{}, false
+}
+
+// removeLocally drops the key from both caches of the current node.
+func (g *Group) removeLocally(key string) bool {
+	inMain := g.mainCache.Remove(key)
+	inHot := g.hotCache.Remove(key)
+	if g.negativeTTL > 0 {
+		g.negCache.Remove(key)
+	}
+	return inMain || inHot
+}
+
+func (g *Group) maybePopulateHotCache(key string, val ByteView) {
+	if g.hotCache.cacheSize <= 0 || rand.Float64() >= g.hotCacheProbability {
+		return
+	}
+	if !val.Expire().IsZero() {
+		g.sweepOnce.Do(g.startSweeper)
+	}
+	g.hotCache.Add(key, val)
+}
+
+func (g *Group) pickPeer(key string) (PeerGetter, bool) {
+	if g.peerPicker == nil {
+		return nil, false
+	}
+	return g.peerPicker.PickPeer(key)
+}
+
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
 	req := &pb.Request{
 		Group: g.name,
 		Key:   key,
 	}
 	res := &pb.Response{}
-	err := peer.GetDataFromPeer(req, res)
+	start := time.Now()
+	err := peer.GetDataFromPeer(ctx, req, res)
+	if err == nil {
+		if g.peerLatency != nil {
+			g.peerLatency.observe(time.Since(start))
+		}
+		err = responseError(res)
+	}
+	if errors.Is(err, ErrNotFound) {
+		g.Stats.PeerLoads.Add(1)
+		return ByteView{}, g.notFoundFromPeer(key, err)
+	}
 	if err != nil {
+		g.Stats.PeerErrors.Add(1)
 		return ByteView{}, err
 	}
+	g.Stats.PeerLoads.Add(1)
 
-	return ByteView{b: res.Value}, nil
+	return viewFromResponse(res), nil
 
 }
 
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key)
+func (g *Group) setToPeer(ctx context.Context, peer PeerGetter, key string, value []byte, flags uint32, ttl time.Duration, replica bool) error {
+	req := &pb.SetRequest{
+		Group:   g.name,
+		Key:     key,
+		Value:   value,
+		TtlMs:   ttl.Milliseconds(),
+		Replica: replica,
+		Flags:   flags,
+	}
+	return peer.SetDataToPeer(ctx, req, &pb.SetResponse{})
+}
+
+func (g *Group) deleteFromPeer(ctx context.Context, peer PeerGetter, key string, replica bool) (bool, error) {
+	req := &pb.Request{
+		Group:   g.name,
+		Key:     key,
+		Replica: replica,
+	}
+	res := &pb.DeleteResponse{}
+	if err := peer.DeleteDataFromPeer(ctx, req, res); err != nil {
+		return false, err
+	}
+	return res.GetDeleted(), nil
+}
+
+func (g *Group) setLocally(key string, value []byte, flags uint32, ttl time.Duration) ByteView {
+	if ttl <= 0 && ttl != NoExpiration {
+		ttl = g.defaultTTL
+	}
+	val := ByteView{b: cloneBytes(value), f: flags}
+	if ttl > 0 {
+		val.e = time.Now().Add(ttl)
+	}
+	g.populateCache(key, val)
+	return val
+}
+
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	var (
+		bytes []byte
+		ttl   time.Duration
+		err   error
+	)
+	switch getter := g.getter.(type) {
+	case BatchTTLGetter, BatchGetter:
+		bytes, ttl, err = g.batcher.get(ctx, key)
+	case ContextGetter:
+		bytes, err = getter.GetContext(ctx, key)
+	case TTLGetter:
+		bytes, ttl, err = getter.GetWithTTL(key)
+	default:
+		bytes, err = g.getter.Get(key)
+	}
 	if err != nil {
+		g.Stats.LocalLoadErrs.Add(1)
+		if errors.Is(err, ErrNotFound) {
+			return ByteView{}, g.populateNegative(key, err, time.Time{})
+		}
 		return ByteView{}, err
 	}
-	val := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, val)
+	g.Stats.LocalLoads.Add(1)
 
-	return val, nil
+	return g.setLocally(key, bytes, 0, ttl), nil
 }
 
 func (g *Group) populateCache(key string, val ByteView) {
+	if !val.Expire().IsZero() {
+		g.sweepOnce.Do(g.startSweeper)
+	}
+	if g.negativeTTL > 0 {
+		g.negCache.Remove(key)
+	}
 	g.mainCache.Add(key, val)
 }
+
+// startSweeper purges expired entries periodically, so that values which are
+// never read again do not hold cache space until they are evicted by size.
+func (g *Group) startSweeper() {
+	if g.sweepInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(g.sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			g.mainCache.RemoveExpired()
+			g.hotCache.RemoveExpired()
+			if g.negativeTTL > 0 {
+				g.negCache.RemoveExpired()
+			}
+		}
+	}()
+}
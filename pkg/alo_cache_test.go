@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+	"github.com/alo-distributed-memcached/pkg/eviction"
+)
+
+func TestGroupDefaultTTL(t *testing.T) {
+	loads := 0
+	g := newGroup("ttl", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithTTL(50*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("Tom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loaded %d times before expiration, want 1", loads)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := g.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 {
+		t.Fatalf("loaded %d times after expiration, want 2", loads)
+	}
+}
+
+func TestGroupGetterTTL(t *testing.T) {
+	g := newGroup("getter-ttl", 2<<10, TTLGetterFunc(func(key string) ([]byte, time.Duration, error) {
+		if key == "short" {
+			return []byte(key), 50 * time.Millisecond, nil
+		}
+		return []byte(key), 0, nil
+	}), WithTTL(time.Hour), WithSweepInterval(10*time.Millisecond))
+
+	short, _ := g.Get("short")
+	long, _ := g.Get("long")
+	if ttl := time.Until(short.Expire()); ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("getter ttl not applied, remaining %v", ttl)
+	}
+	if ttl := time.Until(long.Expire()); ttl < 59*time.Minute {
+		t.Fatalf("default ttl not applied, remaining %v", ttl)
+	}
+
+	// the sweeper purges "short" without anyone reading it
+	time.Sleep(100 * time.Millisecond)
+	if n := g.mainCache.Stats().Items; n != 1 {
+		t.Fatalf("%d entries cached after sweep, want 1", n)
+	}
+}
+
+func TestPeerPropagatesRemainingTTL(t *testing.T) {
+	view := ByteView{b: []byte("v"), e: time.Now().Add(time.Second)}
+
+	res := viewToResponse(view)
+	if res.GetTtlMs() <= 0 || res.GetTtlMs() > 1000 {
+		t.Fatalf("ttl_ms = %d, want remaining ttl of the owner", res.GetTtlMs())
+	}
+
+	got := viewFromResponse(res)
+	if got.Expire().After(view.Expire()) {
+		t.Fatalf("fetched copy expires at %v, after the owner's copy %v", got.Expire(), view.Expire())
+	}
+	if viewFromResponse(&pb.Response{Value: []byte("v")}).Expire() != (time.Time{}) {
+		t.Fatalf("value without ttl should never expire")
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	nodes := startHTTPNodes(t, "hot", 2, WithHotCache(0.25, 1))
+	reader := nodes[0]
+	if reader.group.mainCache.cacheSize+reader.group.hotCache.cacheSize != 2<<10 || reader.group.hotCache.cacheSize != 512 {
+		t.Fatalf("budget split main=%d hot=%d", reader.group.mainCache.cacheSize, reader.group.hotCache.cacheSize)
+	}
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if _, ok := reader.group.peerPicker.PickPeer(fmt.Sprintf("key-%d", i)); ok {
+			key = fmt.Sprintf("key-%d", i)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if view, err := reader.group.Get(key); err != nil || view.String() != "value-"+key {
+			t.Fatalf("Get(%q) = %q, %v", key, view.String(), err)
+		}
+	}
+	if hits := reader.group.Stats.HotCacheHits.Get(); hits != 4 {
+		t.Fatalf("hot cache served %d hits, want 4", hits)
+	}
+	if gets := nodes[1].group.Stats.Gets.Get(); gets != 1 {
+		t.Fatalf("owner served %d gets, want 1", gets)
+	}
+	if reader.cached(key) {
+		t.Fatalf("peer value must not be kept in the main cache")
+	}
+
+	// a write through the reader drops its hot copy
+	if err := reader.group.Set(key, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if view, _ := reader.group.Get(key); view.String() != "new" {
+		t.Fatalf("Get(%q) after Set = %q", key, view.String())
+	}
+}
+
+func TestGroupEvictionPolicy(t *testing.T) {
+	g := newGroup("eviction", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithHotCache(0.25, 1), WithEvictionPolicy(func(maxBytes int64) eviction.Policy {
+		return eviction.NewLFU(maxBytes)
+	}))
+
+	if _, err := g.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	g.hotCache.Add("Jack", ByteView{b: []byte("589")})
+	if _, ok := g.mainCache.shards[0].cache.(*eviction.LFU); !ok {
+		t.Fatalf("main cache uses %T, want *eviction.LFU", g.mainCache.shards[0].cache)
+	}
+	if _, ok := g.hotCache.shards[0].cache.(*eviction.LFU); !ok {
+		t.Fatalf("hot cache uses %T, want *eviction.LFU", g.hotCache.shards[0].cache)
+	}
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	timestampHeader = "X-Alo-Timestamp" // unix milliseconds of a signed request
+	nonceHeader     = "X-Alo-Nonce"
+	signatureHeader = "X-Alo-Signature"
+)
+
+// PeerTLSConfig holds the PEM files of the mutual TLS between nodes.
+type PeerTLSConfig struct {
+	CertFile string // certificate of the node, presented as server and as client
+	KeyFile  string
+	CAFile   string // CA the certificates of the peers must be signed by
+}
+
+// SetTLS requires mutual TLS between nodes, the peers are then addressed as
+// https://host:port. The pool presents its certificate to the peers it
+// calls, and serves only peers whose certificate is signed by the CA and
+// names the host of one of its peers. Serve with ServerTLSConfig.
+// It must be called after SetHTTPClient, on a client whose Transport is an
+// *http.Transport.
+func (h *HTTPPool) SetTLS(cfg PeerTLSConfig) error {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return fmt.Errorf("loading CA: %w", err)
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", cfg.CAFile)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	transport, ok := h.client.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("cannot set TLS on a %T transport", h.client.Transport)
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	transport.ForceAttemptHTTP2 = true
+	client := *h.client
+	client.Transport = transport
+	h.setClient(&client)
+
+	h.serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the server of the pool,
+// nil without SetTLS.
+func (h *HTTPPool) ServerTLSConfig() *tls.Config {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.serverTLS
+}
+
+// knownPeer reports whether the verified client certificate of r names the
+// host of a peer.
+func (h *HTTPPool) knownPeer(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for peer := range h.httpGetter {
+		if peer == h.self {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err == nil && leaf.VerifyHostname(u.Hostname()) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHMACSecret signs the requests to the peers with the secret shared by
+// every node, and serves only requests signed with it. A signature covers
+// the method, the URL, the body, a timestamp and a nonce: requests older than
+// maxSkew and nonces seen already are rejected, so a captured request cannot
+// be replayed. It must be called after SetHTTPClient and SetTLS.
+func (h *HTTPPool) SetHMACSecret(secret []byte, maxSkew time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.signer = &requestSigner{secret: secret, maxSkew: maxSkew, seen: make(map[string]time.Time)}
+	next := h.client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client := *h.client
+	client.Transport = &signingTransport{next: next, signer: h.signer}
+	h.setClient(&client)
+}
+
+// setClient replaces the client of every getter, the pool's lock is held.
+func (h *HTTPPool) setClient(client *http.Client) {
+	h.client = client
+	for peer := range h.httpGetter {
+		h.httpGetter[peer] = h.newGetter(peer)
+	}
+}
+
+// authenticate checks a request of another node, it writes the error and
+// returns false when the request must not be served.
+func (h *HTTPPool) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	h.mu.Lock()
+	serverTLS, signer := h.serverTLS, h.signer
+	h.mu.Unlock()
+
+	if serverTLS != nil && !h.knownPeer(r) {
+		http.Error(w, "certificate of an unknown peer", http.StatusForbidden)
+		return false
+	}
+	if signer != nil {
+		if err := signer.verify(r); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeBodyError(w, err)
+				return false
+			}
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
+
+// writeBodyError answers a request whose body could not be read, 413 when
+// it is over the limit of SetMaxBodyBytes.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// requestSigner signs and verifies requests with a shared secret.
+type requestSigner struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time // nonces of the recent requests
+	pruned time.Time
+}
+
+func (s *requestSigner) signature(r *http.Request, body []byte, timestamp, nonce string) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), timestamp, nonce, digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *requestSigner) sign(r *http.Request) error {
+	body, err := bufferBody(r)
+	if err != nil {
+		return err
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(nonceHeader, hex.EncodeToString(nonce[:]))
+	r.Header.Set(signatureHeader, s.signature(r, body, timestamp, r.Header.Get(nonceHeader)))
+	return nil
+}
+
+var errBadSignature = errors.New("bad request signature")
+
+func (s *requestSigner) verify(r *http.Request) error {
+	timestamp, nonce := r.Header.Get(timestampHeader), r.Header.Get(nonceHeader)
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return errBadSignature
+	}
+	sent := time.UnixMilli(ms)
+	if skew := time.Since(sent); skew > s.maxSkew || skew < -s.maxSkew {
+		return fmt.Errorf("request signed %v ago, outside of the allowed skew", skew.Round(time.Millisecond))
+	}
+	body, err := bufferBody(r)
+	if err != nil {
+		return err
+	}
+	expected := s.signature(r, body, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(signatureHeader))) {
+		return errBadSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, replayed := s.seen[nonce]; replayed {
+		return errors.New("replayed request")
+	}
+	now := time.Now()
+	if now.Sub(s.pruned) > s.maxSkew {
+		// a nonce older than twice the skew fails the timestamp check anyway
+		for n, at := range s.seen {
+			if now.Sub(at) > 2*s.maxSkew {
+				delete(s.seen, n)
+			}
+		}
+		s.pruned = now
+	}
+	s.seen[nonce] = now
+	return nil
+}
+
+// bufferBody returns the body of r and leaves r.Body readable again.
+func bufferBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// signingTransport signs the requests sent by next.
+type signingTransport struct {
+	next   http.RoundTripper
+	signer *requestSigner
+}
+
+func (t *signingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	r = r.Clone(r.Context())
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	if err := t.signer.sign(r); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(r)
+}
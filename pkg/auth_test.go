@@ -0,0 +1,296 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of the test nodes.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "alo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.file = ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, kind string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns the TLS config of a node whose certificate names the hosts.
+func (ca *testCA) issue(t *testing.T, name string, hosts ...string) PeerTLSConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PeerTLSConfig{
+		CertFile: ca.write(t, name+".pem", "CERTIFICATE", der),
+		KeyFile:  ca.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:   ca.file,
+	}
+}
+
+// startSecureNodes starts count nodes addressed with scheme, whose pools are
+// set up by secure, over TLS when it sets the server TLS config.
+func startSecureNodes(t *testing.T, groupName string, count int, scheme string, secure func(i int, pool *HTTPPool)) ([]*testNode, []*HTTPPool) {
+	t.Helper()
+	nodes := make([]*testNode, count)
+	pools := make([]*HTTPPool, count)
+	lises := make([]net.Listener, count)
+	addrs := make([]string, count)
+	for i := range nodes {
+		nodes[i], lises[i] = newTestNode(t, groupName)
+		addrs[i] = scheme + nodes[i].addr
+		pools[i] = NewHTTPPool(addrs[i])
+		secure(i, pools[i])
+	}
+	for i, n := range nodes {
+		pool := pools[i]
+		pool.getGroup = n.lookup
+		pool.SetPeers(addrs...)
+		n.group.RegisterPeerPicker(pool)
+		server := &http.Server{Handler: pool, TLSConfig: pool.ServerTLSConfig()}
+		if server.TLSConfig != nil {
+			go server.ServeTLS(lises[i], "", "")
+		} else {
+			go server.Serve(lises[i])
+		}
+		n.stop = func() { server.Close() }
+		t.Cleanup(n.stop)
+	}
+	return nodes, pools
+}
+
+// testRoutesToOwner checks every node gets the keys, each loaded once by its owner.
+func testRoutesToOwner(t *testing.T, nodes []*testNode) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		for _, n := range nodes {
+			if view, err := n.group.Get(key); err != nil || view.String() != "value-"+key {
+				t.Fatalf("Get(%s) = %q, %v", key, view.String(), err)
+			}
+		}
+		loads := 0
+		for _, n := range nodes {
+			loads += n.loadCount(key)
+		}
+		if loads != 1 {
+			t.Fatalf("%s loaded %d times, want once by its owner", key, loads)
+		}
+	}
+}
+
+func TestHTTPPoolMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	nodes, _ := startSecureNodes(t, "mtls", 2, "https://", func(i int, pool *HTTPPool) {
+		if err := pool.SetTLS(ca.issue(t, fmt.Sprintf("node-%d", i), "127.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	testRoutesToOwner(t, nodes)
+	url := "https://" + nodes[0].addr + defaultBasePath + "mtls/key-1"
+
+	// the CA is trusted but the client presents no certificate
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if res, err := anonymous.Get(url); err == nil {
+		res.Body.Close()
+		t.Fatalf("served a client without certificate: %s", res.Status)
+	}
+
+	// a certificate of the CA which names no peer
+	outsider := ca.issue(t, "outsider", "outsider.example")
+	cert, err := tls.LoadX509KeyPair(outsider.CertFile, outsider.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("outsider got %s, want 403", res.Status)
+	}
+
+	// plain HTTP does not reach a TLS node
+	if res, err := http.Get("http://" + nodes[0].addr + defaultBasePath + "mtls/key-1"); err == nil {
+		if res.StatusCode == http.StatusOK {
+			t.Fatalf("served a plain HTTP request")
+		}
+		res.Body.Close()
+	}
+}
+
+func TestHTTPPoolHMAC(t *testing.T) {
+	secret := []byte("shared secret")
+	nodes, pools := startSecureNodes(t, "hmac", 2, "http://", func(i int, pool *HTTPPool) {
+		pool.SetHMACSecret(secret, time.Second)
+	})
+	testRoutesToOwner(t, nodes)
+	url := "http://" + nodes[0].addr + defaultBasePath + "hmac/key-1"
+
+	if res, err := http.Get(url); err != nil {
+		t.Fatal(err)
+	} else if res.Body.Close(); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unsigned request got %s, want 401", res.Status)
+	}
+
+	send := func(req *http.Request) int {
+		t.Helper()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	signed := func(signer *requestSigner) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if err := signer.sign(req); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := signed(pools[1].signer)
+	if code := send(req); code != http.StatusOK {
+		t.Fatalf("signed request got %d", code)
+	}
+	if code := send(req); code != http.StatusUnauthorized {
+		t.Fatalf("replayed request got %d, want 401", code)
+	}
+
+	wrong := &requestSigner{secret: []byte("wrong"), seen: make(map[string]time.Time)}
+	if code := send(signed(wrong)); code != http.StatusUnauthorized {
+		t.Fatalf("request signed with another secret got %d, want 401", code)
+	}
+
+	// a request signed too long ago, its signature is otherwise valid
+	old, _ := http.NewRequest(http.MethodGet, url, nil)
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	old.Header.Set(timestampHeader, timestamp)
+	old.Header.Set(nonceHeader, "n1")
+	old.Header.Set(signatureHeader, pools[1].signer.signature(old, nil, timestamp, "n1"))
+	if code := send(old); code != http.StatusUnauthorized {
+		t.Fatalf("stale request got %d, want 401", code)
+	}
+}
+
+func TestHMACSignsBody(t *testing.T) {
+	secret := []byte("shared secret")
+	nodes, _ := startSecureNodes(t, "hmac-write", 2, "http://", func(i int, pool *HTTPPool) {
+		pool.SetHMACSecret(secret, time.Second)
+	})
+	testWritePath(t, nodes)
+}
+
+func TestHTTPPoolMaxBody(t *testing.T) {
+	nodes, pools := startSecureNodes(t, "max-body", 2, "http://", func(i int, pool *HTTPPool) {
+		pool.SetHMACSecret([]byte("shared secret"), time.Second)
+		pool.SetMaxBodyBytes(1 << 10)
+	})
+	url := "http://" + nodes[0].addr + defaultBasePath + "max-body/"
+	send := func(method, url string, body []byte, sign bool) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		if sign {
+			if err := pools[1].signer.sign(req); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			// the timestamp is set by the sender, it protects nothing
+			req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().UnixMilli(), 10))
+			req.Header.Set(nonceHeader, "n1")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	large := bytes.Repeat([]byte("x"), 2<<10)
+	if code := send(http.MethodPut, url+"k", large, false); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unsigned large PUT got %d, want 413", code)
+	}
+	if code := send(http.MethodPost, url, large, true); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("signed large POST got %d, want 413", code)
+	}
+	if code := send(http.MethodPut, url+"k", []byte("small"), true); code != http.StatusOK {
+		t.Fatalf("signed small PUT got %d", code)
+	}
+}
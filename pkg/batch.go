@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// BatchPeerGetter is implemented by peers which can fetch many keys in one request.
+type BatchPeerGetter interface {
+	GetMultiFromPeer(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error
+}
+
+// KeyErrors holds the error of each key GetMulti failed to load.
+type KeyErrors map[string]error
+
+func (e KeyErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", key, e[key])
+	}
+	return fmt.Sprintf("%d keys failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// GetMulti returns the values of keys, see GetMultiContext.
+func (g *Group) GetMulti(keys []string) (map[string]ByteView, error) {
+	return g.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext returns the values of keys. Misses are grouped by owning
+// peer and fetched with one request per peer, the peers are called in
+// parallel. Keys a peer did not return, and keys of a peer that failed, are
+// loaded one by one as Get does, unless the peer's error code rules it out. The values loaded are returned along with a
+// KeyErrors of the keys that could not be loaded.
+func (g *Group) GetMultiContext(ctx context.Context, keys []string) (map[string]ByteView, error) {
+	views := make(map[string]ByteView, len(keys))
+	errs := make(KeyErrors)
+	var mu sync.Mutex
+	done := func(key string, view ByteView, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs[key] = err
+		} else {
+			views[key] = view
+		}
+	}
+
+	// misses grouped by the peer owning them, local ones under nil
+	owners := make(map[BatchPeerGetter][]string)
+	var single []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		g.Stats.Gets.Add(1)
+		if key == "" {
+			errs[key] = fmt.Errorf("key is required")
+			continue
+		}
+		if v, ok := g.lookupCache(key); ok {
+			g.Stats.CacheHits.Add(1)
+			views[key] = v
+			continue
+		}
+		if err := g.lookupNegative(key); err != nil {
+			errs[key] = err
+			continue
+		}
+		if peer, ok := g.pickPeer(key); ok {
+			if batch, ok := peer.(BatchPeerGetter); ok {
+				owners[batch] = append(owners[batch], key)
+				continue
+			}
+		}
+		single = append(single, key)
+	}
+
+	var wg sync.WaitGroup
+	load := func(key string) {
+		defer wg.Done()
+		view, err := g.load(ctx, key)
+		done(key, view, err)
+	}
+	for _, key := range single {
+		wg.Add(1)
+		go load(key)
+	}
+	for peer, owned := range owners {
+		wg.Add(1)
+		go func(peer BatchPeerGetter, owned []string) {
+			defer wg.Done()
+			found, failed := g.getMultiFromPeer(ctx, peer, owned)
+			for _, key := range owned {
+				if view, ok := found[key]; ok {
+					g.maybePopulateHotCache(key, view)
+					done(key, view, nil)
+					continue
+				}
+				if err, ok := failed[key]; ok {
+					done(key, ByteView{}, err)
+					continue
+				}
+				// fall back for the keys the peer could not serve
+				wg.Add(1)
+				go load(key)
+			}
+		}(peer, owned)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return views, errs
+	}
+	return views, nil
+}
+
+// getMultiFromPeer fetches keys from the peer in one request, and returns the
+// values along with the errors of the keys which must not fall back to the
+// getter, see fallbackOnPeerError. It returns nothing when the request fails.
+func (g *Group) getMultiFromPeer(ctx context.Context, peer BatchPeerGetter, keys []string) (map[string]ByteView, map[string]error) {
+	req := &pb.BatchRequest{
+		Group: g.name,
+		Keys:  keys,
+	}
+	res := &pb.BatchResponse{}
+	if err := peer.GetMultiFromPeer(ctx, req, res); err != nil {
+		g.Stats.PeerErrors.Add(1)
+		return nil, nil
+	}
+
+	views := make(map[string]ByteView, len(res.GetValues()))
+	failed := make(map[string]error)
+	for key, value := range res.GetValues() {
+		err := responseError(value)
+		switch {
+		case err == nil:
+			views[key] = viewFromResponse(value)
+		case errors.Is(err, ErrNotFound):
+			failed[key] = g.notFoundFromPeer(key, err)
+		case !fallbackOnPeerError(err):
+			failed[key] = err
+		}
+	}
+	g.Stats.PeerLoads.Add(int64(len(views)))
+	return views, failed
+}
+
+// batchResponse builds the response to a batch request of another node from
+// the result of GetMultiContext, with the error of each key which failed.
+func batchResponse(views map[string]ByteView, err error) *pb.BatchResponse {
+	res := &pb.BatchResponse{Values: make(map[string]*pb.Response, len(views))}
+	for key, view := range views {
+		res.Values[key] = viewToResponse(view)
+	}
+	var errs KeyErrors
+	if errors.As(err, &errs) {
+		for key, err := range errs {
+			res.Values[key] = errorResponse(err)
+		}
+	}
+	return res
+}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchWindow = time.Millisecond
+	defaultBatchSize   = 100
+)
+
+// BatchGetter is an optional interface of Getter, the getter loads many keys
+// with one call to the backing store. Keys left out of the result are not
+// found, they fail with ErrNotFound.
+// Concurrent misses of the group are coalesced into one GetMany, see WithBatchWindow.
+// It is preferred over the other getter interfaces when implemented, but
+// BatchTTLGetter: the values of a getter implementing BatchGetter and
+// TTLGetter are cached with the default TTL, as GetMany returns none.
+type BatchGetter interface {
+	GetMany(keys []string) (map[string][]byte, error)
+}
+
+// BatchTTLGetter is the BatchGetter of getters which return how long each
+// value may be cached, it is preferred over every other getter interface.
+type BatchTTLGetter interface {
+	GetManyWithTTL(keys []string) (map[string]TTLValue, error)
+}
+
+// TTLValue is a value of a BatchTTLGetter, a TTL <= 0 falls back to the
+// group's default TTL.
+type TTLValue struct {
+	Value []byte
+	TTL   time.Duration
+}
+
+type BatchGetterFunc func(keys []string) (map[string][]byte, error)
+
+func (f BatchGetterFunc) GetMany(keys []string) (map[string][]byte, error) {
+	return f(keys)
+}
+
+func (f BatchGetterFunc) Get(key string) ([]byte, error) {
+	values, err := f([]string{key})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := values[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return value, nil
+}
+
+type BatchTTLGetterFunc func(keys []string) (map[string]TTLValue, error)
+
+func (f BatchTTLGetterFunc) GetManyWithTTL(keys []string) (map[string]TTLValue, error) {
+	return f(keys)
+}
+
+func (f BatchTTLGetterFunc) Get(key string) ([]byte, error) {
+	values, err := f([]string{key})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := values[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return value.Value, nil
+}
+
+// batchTTLGetter adapts a BatchGetter to BatchTTLGetter, its values have
+// the default TTL.
+type batchTTLGetter struct {
+	BatchGetter
+}
+
+func (b batchTTLGetter) GetManyWithTTL(keys []string) (map[string]TTLValue, error) {
+	values, err := b.GetMany(keys)
+	if err != nil {
+		return nil, err
+	}
+	withTTL := make(map[string]TTLValue, len(values))
+	for key, value := range values {
+		withTTL[key] = TTLValue{Value: value}
+	}
+	return withTTL, nil
+}
+
+// WithBatchWindow sets how long the misses of a BatchGetter group wait for
+// other misses to share their GetMany, and the most keys of a GetMany.
+// A full batch is loaded without waiting for the end of the window.
+func WithBatchWindow(window time.Duration, maxKeys int) GroupOption {
+	return func(g *Group) {
+		g.batchWindow = window
+		g.batchSize = maxKeys
+	}
+}
+
+// loadBatcher coalesces the keys requested within a window into one GetMany.
+// Group.load already deduplicates the keys with singleflight, the batcher
+// merges different keys.
+type loadBatcher struct {
+	getter  BatchTTLGetter
+	window  time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	pending map[string]*batchCall
+	timer   *time.Timer
+}
+
+type batchCall struct {
+	done  chan struct{}
+	value TTLValue
+	err   error
+}
+
+func newLoadBatcher(getter BatchTTLGetter, window time.Duration, maxKeys int) *loadBatcher {
+	if maxKeys <= 0 {
+		maxKeys = defaultBatchSize
+	}
+	return &loadBatcher{
+		getter:  getter,
+		window:  window,
+		maxKeys: maxKeys,
+		pending: make(map[string]*batchCall),
+	}
+}
+
+// get adds the key to the pending batch and waits for its value and TTL, or
+// for ctx.
+func (b *loadBatcher) get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	b.mu.Lock()
+	c, ok := b.pending[key]
+	if !ok {
+		c = &batchCall{done: make(chan struct{})}
+		b.pending[key] = c
+	}
+	switch {
+	case len(b.pending) >= b.maxKeys || b.window <= 0:
+		go b.run(b.take())
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value.Value, c.value.TTL, c.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func (b *loadBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.run(batch)
+}
+
+// take returns the pending batch and starts a new one, b.mu is held.
+func (b *loadBatcher) take() map[string]*batchCall {
+	batch := b.pending
+	b.pending = make(map[string]*batchCall)
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+func (b *loadBatcher) run(batch map[string]*batchCall) {
+	if len(batch) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(batch))
+	for key := range batch {
+		keys = append(keys, key)
+	}
+
+	values, err := b.getter.GetManyWithTTL(keys)
+	for key, c := range batch {
+		if err != nil {
+			c.err = err
+		} else if value, ok := values[key]; ok {
+			c.value = value
+		} else {
+			c.err = fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		close(c.done)
+	}
+}
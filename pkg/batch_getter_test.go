@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingBatchGetter records the keys of every GetMany.
+type countingBatchGetter struct {
+	mu    sync.Mutex
+	calls [][]string
+	err   error
+}
+
+func (b *countingBatchGetter) getter() BatchGetterFunc {
+	return func(keys []string) (map[string][]byte, error) {
+		b.mu.Lock()
+		b.calls = append(b.calls, keys)
+		b.mu.Unlock()
+		if b.err != nil {
+			return nil, b.err
+		}
+		values := make(map[string][]byte)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, "missing") {
+				values[key] = []byte("value-" + key)
+			}
+		}
+		return values, nil
+	}
+}
+
+func (b *countingBatchGetter) keys() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, call := range b.calls {
+		n += len(call)
+	}
+	return n
+}
+
+func TestBatchGetterCoalescesMisses(t *testing.T) {
+	backend := &countingBatchGetter{}
+	g := newGroup("batch-getter", 64<<10, backend.getter(), WithBatchWindow(20*time.Millisecond, 100))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		// every key is requested twice, singleflight keeps one of them
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				if view, err := g.Get(key); err != nil || view.String() != "value-"+key {
+					t.Errorf("Get(%q) = %q, %v", key, view.String(), err)
+				}
+			}(fmt.Sprintf("key-%d", i))
+		}
+	}
+	wg.Wait()
+
+	if len(backend.calls) > 2 || backend.keys() != 50 {
+		t.Fatalf("%d GetMany calls for %d keys, want the 50 keys in at most 2 calls", len(backend.calls), backend.keys())
+	}
+	if _, err := g.Get("missing"); err == nil {
+		t.Fatalf("key left out by GetMany was found")
+	}
+}
+
+func TestBatchGetterWithGetMulti(t *testing.T) {
+	backend := &countingBatchGetter{}
+	g := newGroup("batch-getter-multi", 64<<10, backend.getter(), WithBatchWindow(20*time.Millisecond, 30))
+
+	keys := []string{"missing-1"}
+	for i := 0; i < 59; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+	views, err := g.GetMulti(keys)
+	var errs KeyErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || len(views) != 59 {
+		t.Fatalf("GetMulti = %d values, %v", len(views), err)
+	}
+	// a full batch is loaded at once
+	if len(backend.calls) != 2 || len(backend.calls[0]) != 30 || len(backend.calls[1]) != 30 {
+		t.Fatalf("GetMany calls = %d, want 2 of 30 keys", len(backend.calls))
+	}
+
+	backend.err = errors.New("database is down")
+	if _, err := g.Get("other"); err == nil || !strings.Contains(err.Error(), "database is down") {
+		t.Fatalf("Get error = %v, want the GetMany error", err)
+	}
+}
+
+// batchAndTTLGetter implements both BatchGetter and TTLGetter.
+type batchAndTTLGetter struct {
+	BatchGetterFunc
+}
+
+func (batchAndTTLGetter) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	return []byte("value-" + key), time.Second, nil
+}
+
+func TestBatchTTLGetter(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	getter := BatchTTLGetterFunc(func(keys []string) (map[string]TTLValue, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		values := make(map[string]TTLValue)
+		for _, key := range keys {
+			values[key] = TTLValue{Value: []byte("value-" + key), TTL: time.Minute}
+		}
+		values["default"] = TTLValue{Value: []byte("value-default")}
+		return values, nil
+	})
+	g := newGroup("batch-ttl-getter", 64<<10, getter, WithTTL(time.Hour), WithBatchWindow(20*time.Millisecond, 30))
+
+	views, err := g.GetMulti([]string{"a", "b", "default"})
+	if err != nil || len(views) != 3 || calls != 1 {
+		t.Fatalf("GetMulti = %d values, %v in %d calls", len(views), err, calls)
+	}
+	for key, want := range map[string]time.Duration{"a": time.Minute, "default": time.Hour} {
+		if left := time.Until(views[key].Expire()); left <= want-time.Second || left > want {
+			t.Fatalf("%s expires in %v, want %v", key, left, want)
+		}
+	}
+
+	// GetMany is preferred and returns no TTL, the default TTL applies
+	g = newGroup("batch-and-ttl-getter", 64<<10, batchAndTTLGetter{(&countingBatchGetter{}).getter()}, WithTTL(time.Hour))
+	view, err := g.Get("k")
+	if err != nil || time.Until(view.Expire()) <= time.Minute {
+		t.Fatalf("Get = %v expiring at %v, want the default TTL of the group", err, view.Expire())
+	}
+}
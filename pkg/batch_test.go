@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// batchPeer serves the keys of owner in process and counts the requests.
+type batchPeer struct {
+	owner      *Group
+	mu         sync.Mutex
+	gets       []string // keys of the single gets
+	batches    int
+	failBatch  bool
+	dropPrefix string // keys left out of batch responses
+}
+
+func (p *batchPeer) GetDataFromPeer(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	p.mu.Lock()
+	p.gets = append(p.gets, in.GetKey())
+	p.mu.Unlock()
+	view, err := p.owner.GetContext(ctx, in.GetKey())
+	if err != nil {
+		return err
+	}
+	out.Value = view.ByteSlice()
+	return nil
+}
+
+func (p *batchPeer) SetDataToPeer(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	return errors.New("not implemented")
+}
+
+func (p *batchPeer) DeleteDataFromPeer(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	return errors.New("not implemented")
+}
+
+func (p *batchPeer) GetMultiFromPeer(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	p.mu.Lock()
+	p.batches++
+	p.mu.Unlock()
+	if p.failBatch {
+		return errors.New("batch failed")
+	}
+	views, _ := p.owner.GetMultiContext(ctx, in.GetKeys())
+	for key := range views {
+		if p.dropPrefix != "" && strings.HasPrefix(key, p.dropPrefix) {
+			delete(views, key)
+		}
+	}
+	out.Values = batchResponse(views, nil).Values
+	return nil
+}
+
+// batchPicker owns a key on peers[hash % (len(peers)+1)], the last slot is the current node.
+type batchPicker []*batchPeer
+
+func (p batchPicker) PickPeer(key string) (PeerGetter, bool) {
+	i := int(crc32.ChecksumIEEE([]byte(key))) % (len(p) + 1)
+	if i == len(p) {
+		return nil, false
+	}
+	return p[i], true
+}
+
+func newBatchGroup(name string, loads map[string]int, mu *sync.Mutex) *Group {
+	return newGroup(name, 64<<10, GetterFunc(func(key string) ([]byte, error) {
+		mu.Lock()
+		loads[key]++
+		mu.Unlock()
+		if strings.HasPrefix(key, "missing") {
+			return nil, fmt.Errorf("%s not exist", key)
+		}
+		return []byte("value-" + key), nil
+	}))
+}
+
+func TestGetMultiBatchesPerPeer(t *testing.T) {
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	peers := batchPicker{
+		{owner: newBatchGroup("batch-a", loads, &mu)},
+		{owner: newBatchGroup("batch-b", loads, &mu), dropPrefix: "key-1"},
+		{owner: newBatchGroup("batch-c", loads, &mu), failBatch: true},
+	}
+	g := newBatchGroup("batch", loads, &mu)
+	g.RegisterPeerPicker(peers)
+
+	keys := []string{"missing-1", "key-0"}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+	views, err := g.GetMulti(keys)
+
+	var errs KeyErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs["missing-1"] == nil {
+		t.Fatalf("GetMulti error = %v, want missing-1 only", err)
+	}
+	if len(views) != 200 {
+		t.Fatalf("GetMulti returned %d values, want 200", len(views))
+	}
+	for key, view := range views {
+		if view.String() != "value-"+key {
+			t.Fatalf("%s = %q", key, view.String())
+		}
+	}
+
+	for i, p := range peers {
+		if p.batches != 1 {
+			t.Fatalf("peer %d received %d batches, want 1", i, p.batches)
+		}
+	}
+	// only the keys peer a failed to load fall back to Get
+	for _, key := range peers[0].gets {
+		if !strings.HasPrefix(key, "missing") {
+			t.Fatalf("healthy peer received a single get of %s", key)
+		}
+	}
+	// the keys left out by peer b and every key of peer c fall back to Get
+	if len(peers[1].gets) == 0 || len(peers[2].gets) == 0 {
+		t.Fatalf("single gets b=%v c=%v, want fallbacks on both", peers[1].gets, peers[2].gets)
+	}
+	for key, n := range loads {
+		if n != 1 && !strings.HasPrefix(key, "missing") {
+			t.Fatalf("%s loaded %d times", key, n)
+		}
+	}
+
+	// a second call is served by the caches
+	if _, err := g.GetMulti(keys[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if peers[0].batches != 2 {
+		t.Fatalf("peer a received %d batches, want 2", peers[0].batches)
+	}
+}
+
+func testGetMulti(t *testing.T, nodes []*testNode) {
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	views, err := nodes[0].group.GetMulti(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if views[key].String() != "value-"+key {
+			t.Fatalf("%s = %q", key, views[key].String())
+		}
+		loaded := 0
+		for _, n := range nodes {
+			loaded += n.loadCount(key)
+		}
+		if loaded != 1 {
+			t.Fatalf("key %q loaded %d times, want exactly once on its owner", key, loaded)
+		}
+	}
+	if peerLoads := nodes[0].group.Stats.PeerLoads.Get(); peerLoads == 0 || peerLoads == 100 {
+		t.Fatalf("%d keys fetched from peers", peerLoads)
+	}
+}
+
+func TestHTTPGetMulti(t *testing.T) {
+	testGetMulti(t, startHTTPNodes(t, "http-batch", 3))
+}
+
+func TestGRPCGetMulti(t *testing.T) {
+	testGetMulti(t, startGRPCNodes(t, "grpc-batch", 3))
+}
@@ -0,0 +1,315 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// ErrPeerUnavailable is returned without calling a peer whose circuit breaker
+// is open. Like other transport failures, the key falls back to the getter.
+var ErrPeerUnavailable = errors.New("peer unavailable: circuit breaker open")
+
+// errPeerRejected is wrapped by the errors of the requests a peer refused to
+// authenticate, 401 or 403. They tell the nodes disagree on their
+// credentials, not that the peer is unhealthy.
+var errPeerRejected = errors.New("peer rejected the credentials of the node")
+
+// BreakerState is the state of the circuit breaker of a peer.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every request at once until OpenTimeout elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets one probe through, its outcome closes or opens the breaker again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BreakerConfig sets when the circuit breaker of a peer opens.
+// A zero threshold disables its rule, a zero config disables the breakers.
+type BreakerConfig struct {
+	// ConsecutiveFailures opens the breaker after that many failures in a row.
+	ConsecutiveFailures int
+	// ErrorRate opens the breaker when the share of failed requests in the
+	// current Window reaches it, once MinRequests were sent.
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is how long an open breaker fails requests before a probe.
+	OpenTimeout time.Duration
+}
+
+// DefaultBreakerConfig is the configuration of the breakers of new pools.
+var DefaultBreakerConfig = BreakerConfig{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	OpenTimeout:         5 * time.Second,
+}
+
+func (c BreakerConfig) enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.ErrorRate > 0
+}
+
+// BreakerStatus is the state of the breaker of a peer, as served by the admin endpoint.
+type BreakerStatus struct {
+	Peer                string       `json:"peer"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Requests            int          `json:"requests"`
+	Failures            int          `json:"failures"`
+	OpenedAt            time.Time    `json:"opened_at,omitempty"`
+}
+
+// BreakerReporter is implemented by pools tracking the health of their peers.
+type BreakerReporter interface {
+	Breakers() []BreakerStatus
+}
+
+/*
+circuitBreaker tracks the health of one peer. It is closed while the peer
+answers, opens when ConsecutiveFailures or ErrorRate is reached, and after
+OpenTimeout lets a single probe through: its success closes the breaker, its
+failure opens it for another OpenTimeout.
+*/
+type circuitBreaker struct {
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	requests    int // in the current window
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, windowStart: time.Now()}
+}
+
+// available reports whether a request would be let through, without taking
+// the probe of a half-open breaker. PickPeer uses it to skip open peers.
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.cfg.OpenTimeout
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// allow reports whether a request may be sent, every allowed request must be
+// followed by a call to done.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// done records the outcome of a request allowed by allow.
+func (b *circuitBreaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.reset()
+		}
+		return
+	}
+	if b.state == BreakerOpen {
+		// a request sent before the breaker opened
+		return
+	}
+
+	if now := time.Now(); b.cfg.Window > 0 && now.Sub(b.windowStart) >= b.cfg.Window {
+		b.requests, b.failures, b.windowStart = 0, 0, now
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures {
+		b.open()
+	} else if b.cfg.ErrorRate > 0 && b.requests >= b.cfg.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.cfg.ErrorRate {
+		b.open()
+	}
+}
+
+// release ends a request allowed by allow without recording its outcome.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *circuitBreaker) reset() {
+	b.state = BreakerClosed
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.windowStart = time.Now()
+	b.openedAt = time.Time{}
+}
+
+func (b *circuitBreaker) status(peer string) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerStatus{
+		Peer:                peer,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutive,
+		Requests:            b.requests,
+		Failures:            b.failures,
+		OpenedAt:            b.openedAt,
+	}
+}
+
+// call sends a request through the breaker, a nil breaker lets everything through.
+func (b *circuitBreaker) call(ctx context.Context, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	if !b.allow() {
+		return ErrPeerUnavailable
+	}
+	err := fn()
+	if ctx.Err() != nil {
+		// a request the caller gave up on says nothing about the peer
+		b.release()
+		return err
+	}
+	if errors.Is(err, errPeerRejected) {
+		// a misconfiguration, opening the breaker would hide it
+		log.Printf("[Breaker] not counted as a failure: %v", err)
+		b.release()
+		return err
+	}
+	b.done(peerFailed(err))
+	return err
+}
+
+// peerFailed reports whether err tells the peer is unhealthy: it could not be
+// reached, timed out or sheds load. Missing keys, unknown groups and failures
+// of the peer's getter are answers of a healthy peer.
+func peerFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pe *PeerError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	switch pe.Code {
+	case pb.ErrorCode_OVERLOADED, pb.ErrorCode_TIMEOUT:
+		return true
+	}
+	return false
+}
+
+// peerBreakers holds the breakers of the peers of a pool, guarded by the pool's lock.
+type peerBreakers struct {
+	self     string
+	cfg      BreakerConfig
+	breakers map[string]*circuitBreaker
+}
+
+// get returns the breaker of the peer, created on first use, nil for the
+// current node or when disabled. The breaker of a peer survives SetPeers so
+// its health is not forgotten.
+func (p *peerBreakers) get(peer string) *circuitBreaker {
+	if peer == p.self || !p.cfg.enabled() {
+		return nil
+	}
+	if p.breakers == nil {
+		p.breakers = make(map[string]*circuitBreaker)
+	}
+	b, ok := p.breakers[peer]
+	if !ok {
+		b = newCircuitBreaker(p.cfg)
+		p.breakers[peer] = b
+	}
+	return b
+}
+
+// keep drops the breakers of the peers which left.
+func (p *peerBreakers) keep(peers map[string]bool) {
+	for peer := range p.breakers {
+		if !peers[peer] {
+			delete(p.breakers, peer)
+		}
+	}
+}
+
+func (p *peerBreakers) remove(peer string) {
+	delete(p.breakers, peer)
+}
+
+func (p *peerBreakers) statuses() []BreakerStatus {
+	statuses := make([]BreakerStatus, 0, len(p.breakers))
+	for peer, b := range p.breakers {
+		statuses = append(statuses, b.status(peer))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Peer < statuses[j].Peer })
+	return statuses
+}
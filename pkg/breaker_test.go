@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 3, OpenTimeout: 30 * time.Millisecond})
+	fail := func() {
+		if !b.allow() {
+			t.Fatalf("request rejected in state %s", b.status("").State)
+		}
+		b.done(true)
+	}
+
+	fail()
+	fail()
+	b.allow()
+	b.done(false) // a success resets the consecutive failures
+	fail()
+	fail()
+	if state := b.status("").State; state != BreakerClosed {
+		t.Fatalf("state %s after 2 failures in a row, want closed", state)
+	}
+	fail()
+	if state := b.status("").State; state != BreakerOpen || b.allow() || b.available() {
+		t.Fatalf("state %s after 3 failures in a row, want open and rejecting", state)
+	}
+
+	// after the timeout a single probe goes through, its failure opens the breaker again
+	time.Sleep(40 * time.Millisecond)
+	if !b.available() || !b.allow() {
+		t.Fatalf("no probe let through after the open timeout")
+	}
+	if b.available() || b.allow() {
+		t.Fatalf("second request let through while probing")
+	}
+	b.done(true)
+	if state := b.status("").State; state != BreakerOpen {
+		t.Fatalf("state %s after a failed probe, want open", state)
+	}
+
+	// a successful probe closes it
+	time.Sleep(40 * time.Millisecond)
+	b.allow()
+	b.done(false)
+	if state := b.status("").State; state != BreakerClosed || !b.allow() {
+		t.Fatalf("state %s after a successful probe, want closed", state)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ErrorRate: 0.5, MinRequests: 10, Window: time.Minute, OpenTimeout: time.Minute})
+	for i := 0; i < 9; i++ {
+		b.allow()
+		b.done(i%2 == 0)
+	}
+	if state := b.status("").State; state != BreakerClosed {
+		t.Fatalf("state %s before MinRequests, want closed", state)
+	}
+	b.allow()
+	b.done(true)
+	if status := b.status(""); status.State != BreakerOpen || status.Failures != 6 {
+		t.Fatalf("state %s with %d/%d failures, want open", status.State, status.Failures, status.Requests)
+	}
+}
+
+func TestPeerFailed(t *testing.T) {
+	tests := []struct {
+		err    error
+		failed bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), true},
+		{&PeerError{Code: pb.ErrorCode_OVERLOADED}, true},
+		{&PeerError{Code: pb.ErrorCode_TIMEOUT}, true},
+		{&PeerError{Code: pb.ErrorCode_NOT_FOUND}, false},
+		{&PeerError{Code: pb.ErrorCode_INTERNAL}, false},
+	}
+	for _, tt := range tests {
+		if got := peerFailed(tt.err); got != tt.failed {
+			t.Errorf("peerFailed(%v) = %v, want %v", tt.err, got, tt.failed)
+		}
+	}
+}
+
+func TestBreakerIgnoresRejections(t *testing.T) {
+	// the nodes disagree on the secret, every peer request gets 401
+	nodes, pools := startSecureNodes(t, "breaker-rejected", 2, "http://", func(i int, pool *HTTPPool) {
+		pool.SetHMACSecret([]byte(fmt.Sprintf("secret-%d", i)), time.Second)
+	})
+	owner, other := ownerOf(nodes, "key-0")
+	for i, sent := 0, 0; sent < 2*DefaultBreakerConfig.ConsecutiveFailures; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if o, _ := ownerOf(nodes, key); o != owner {
+			continue
+		}
+		if view, err := other.group.Get(key); err != nil || view.String() != "value-"+key {
+			t.Fatalf("Get(%s) = %q, %v", key, view.String(), err)
+		}
+		sent++
+	}
+	for _, pool := range pools {
+		for _, status := range pool.Breakers() {
+			if status.State != BreakerClosed || status.Failures != 0 {
+				t.Fatalf("breaker %+v counted the rejections", status)
+			}
+		}
+	}
+}
+
+// testBreakerSkipsDeadPeer checks once the breaker of a dead peer opens, its
+// keys are loaded locally without calling it.
+func testBreakerSkipsDeadPeer(t *testing.T, nodes []*testNode) {
+	owner, other := ownerOf(nodes, "key-0")
+	var keys []string
+	for i := 0; len(keys) < DefaultBreakerConfig.ConsecutiveFailures+5; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if o, _ := ownerOf(nodes, key); o == owner {
+			keys = append(keys, key)
+		}
+	}
+	// the owner serves before it dies
+	if _, err := other.group.Get(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	owner.stop()
+	for _, key := range keys[1:] {
+		if view, err := other.group.Get(key); err != nil || view.String() != "value-"+key {
+			t.Fatalf("Get(%s) = %q, %v", key, view.String(), err)
+		}
+	}
+	if errs := other.group.Stats.PeerErrors.Get(); errs != int64(DefaultBreakerConfig.ConsecutiveFailures) {
+		t.Fatalf("%d requests sent to the dead peer, want %d", errs, DefaultBreakerConfig.ConsecutiveFailures)
+	}
+
+	statuses := other.group.peerPicker.(BreakerReporter).Breakers()
+	if len(statuses) != 1 || statuses[0].State != BreakerOpen {
+		t.Fatalf("breakers = %+v, want the dead peer open", statuses)
+	}
+}
+
+func TestHTTPBreakerSkipsDeadPeer(t *testing.T) {
+	testBreakerSkipsDeadPeer(t, startHTTPNodes(t, "http-breaker", 2))
+}
+
+func TestGRPCBreakerSkipsDeadPeer(t *testing.T) {
+	testBreakerSkipsDeadPeer(t, startGRPCNodes(t, "grpc-breaker", 2))
+}
+
+func TestAdminHandlerBreakers(t *testing.T) {
+	pool := NewHTTPPool("http://node-a")
+	pool.SetPeers("http://node-a", "http://node-b", "http://node-c")
+	pool.httpGetter["http://node-b"].breaker.open()
+	server := httptest.NewServer(NewAdminHandler(pool, "secret"))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+defaultAdminPath+"breakers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var statuses []struct {
+		Peer  string `json:"peer"`
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Peer != "http://node-b" || statuses[0].State != "open" || statuses[1].State != "closed" {
+		t.Fatalf("breakers = %+v, want node-b open and node-c closed", statuses)
+	}
+}
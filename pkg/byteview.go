@@ -1,7 +1,11 @@
 package pkg
 
+import "time"
+
 type ByteView struct {
 	b []byte
+	e time.Time // expiration, zero means the view never expires
+	f uint32    // opaque flags of memcached clients, see MemcacheServer
 }
 
 // Len returns the view's length
@@ -9,6 +13,22 @@ func (v ByteView) Len() int {
 	return len(v.b)
 }
 
+// Expire returns the view's expiration time, zero if it never expires.
+func (v ByteView) Expire() time.Time {
+	return v.e
+}
+
+// Flags returns the flags stored with the view by a memcached client.
+func (v ByteView) Flags() uint32 {
+	return v.f
+}
+
+// Stale reports whether the view is past its expiration, it is served while
+// a refresh runs, see WithStaleWhileRevalidate.
+func (v ByteView) Stale() bool {
+	return !v.e.IsZero() && !time.Now().Before(v.e)
+}
+
 // ByteSlice returns a copy of the data as a byte slice.
 func (v ByteView) ByteSlice() []byte {
 	return cloneBytes(v.b)
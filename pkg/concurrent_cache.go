@@ -1,39 +1,288 @@
 package pkg
 
 import (
+	"math"
+	"runtime"
 	"sync"
+	"time"
 
-	"github.com/alo-distributed-memcached/pkg/lru"
+	"github.com/alo-distributed-memcached/pkg/eviction"
 )
 
+const (
+	// minShardBytes is the smallest budget of a shard when the number of
+	// shards is derived from the cache size, small caches keep one shard.
+	minShardBytes = 1 << 20
+	maxShards     = 256
+)
+
+/*
+ConcurrentCache splits the keys over independent shards by hash, each one
+with its own lock, policy and share of the byte budget, so operations on
+different shards never wait on each other. A value bigger than the budget
+of its shard is not cached.
+
+With a read buffer, hits only take the read lock of their shard: the
+accesses are collected in per-CPU batches, and a full batch is replayed on
+the policy under one write lock. Batches may be dropped by the garbage
+collector, the policy then misses a few accesses.
+*/
 type ConcurrentCache struct {
-	mu        sync.Mutex
-	lruCache  *lru.Cache
-	cacheSize int64
+	cacheSize  int64
+	newPolicy  eviction.Factory // nil means LRU
+	shardCount int              // 0 means derived from cacheSize
+	readBuffer int              // accesses per batch, 0 promotes on every hit
+	grace      time.Duration    // how long entries are kept past their expiration
+
+	once   sync.Once
+	shards []*cacheShard
+	mask   uint32
+}
+
+type cacheShard struct {
+	mu        sync.RWMutex
+	cache     eviction.Policy
+	maxBytes  int64 // budget of the shard, 0 means no limit
+	peeker    eviction.Peeker // set when reads are buffered
+	reads     sync.Pool       // of *readBatch
+	batchSize int
+	nget      AtomicInt
+	nhit      AtomicInt
+}
+
+type readBatch struct {
+	keys []string
+}
+
+// CacheStats are returned by stats accessors on Group.
+type CacheStats struct {
+	Bytes       int64
+	Items       int64
+	Gets        int64
+	Hits        int64
+	Evictions   int64
+	Expirations int64
+}
+
+// defaultShardCount returns a power of two close to the number of CPUs,
+// lowered so each shard keeps at least minShardBytes.
+func defaultShardCount(cacheSize int64) int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxShards {
+		n <<= 1
+	}
+	for n > 1 && cacheSize != 0 && cacheSize/int64(n) < minShardBytes {
+		n >>= 1
+	}
+	return n
+}
+
+func (c *ConcurrentCache) init() {
+	c.once.Do(func() {
+		n := c.shardCount
+		if n <= 0 {
+			n = defaultShardCount(c.cacheSize)
+		}
+		// a power of two so the shard is picked with a mask
+		count := 1
+		for count < n && count < maxShards {
+			count <<= 1
+		}
+		newPolicy := c.newPolicy
+		if newPolicy == nil {
+			newPolicy = eviction.NewLRU
+		}
+
+		c.shards = make([]*cacheShard, count)
+		c.mask = uint32(count - 1)
+		for i := range c.shards {
+			maxBytes := c.cacheSize / int64(count)
+			s := &cacheShard{cache: newPolicy(maxBytes), maxBytes: maxBytes}
+			if peeker, ok := s.cache.(eviction.Peeker); ok && c.readBuffer > 0 {
+				s.peeker = peeker
+				s.batchSize = c.readBuffer
+			}
+			c.shards[i] = s
+		}
+	})
+}
+
+// shard returns the shard of key, hashed with fnv-1a.
+func (c *ConcurrentCache) shard(key string) *cacheShard {
+	c.init()
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h&c.mask]
 }
 
 func (c *ConcurrentCache) Add(key string, value ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.add(s, key, value)
+}
+
+// addIfAbsent adds the value unless the key is cached, and reports whether
+// it was added. It does not count as an access of the key.
+func (c *ConcurrentCache) addIfAbsent(key string, value ByteView) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if c.lruCache == nil {
-		c.lruCache = lru.New(c.cacheSize, nil)
+	if peeker, ok := s.cache.(eviction.Peeker); ok {
+		if _, cached := peeker.Peek(key); cached {
+			return false
+		}
 	}
-	c.lruCache.Add(key, value)
+	return c.add(s, key, value)
 }
 
-func (c *ConcurrentCache) Get(key string) (ByteView, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// add adds the value to the shard, whose lock is held, and reports whether
+// it fit. A value bigger than the budget would evict the whole shard before
+// itself, it is not cached and the previous value of the key is dropped.
+func (c *ConcurrentCache) add(s *cacheShard, key string, value ByteView) bool {
+	if s.maxBytes > 0 && int64(len(key)+value.Len()) > s.maxBytes {
+		s.cache.Remove(key)
+		return false
+	}
+	expire := value.Expire()
+	if !expire.IsZero() {
+		expire = expire.Add(c.grace)
+	}
+	s.cache.AddWithExpire(key, value, expire)
+	return true
+}
 
-	if c.lruCache == nil {
-		return ByteView{}, false
+func (c *ConcurrentCache) Get(key string) (ByteView, bool) {
+	s := c.shard(key)
+	s.nget.Add(1)
+	if s.peeker != nil {
+		return s.peek(key)
 	}
 
-	resp, ok := c.lruCache.Get(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp, ok := s.cache.Get(key)
 	if ok {
+		s.nhit.Add(1)
 		return resp.(ByteView), true
 	}
 
 	return ByteView{}, false
 }
+
+// Remove drops the key and reports whether it was cached.
+func (c *ConcurrentCache) Remove(key string) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cache.Remove(key)
+}
+
+// RemoveExpired drops the expired entries and returns how many were removed.
+func (c *ConcurrentCache) RemoveExpired() int {
+	c.init()
+	removed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		removed += s.cache.RemoveExpired()
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+func (c *ConcurrentCache) Stats() CacheStats {
+	c.init()
+	var stats CacheStats
+	for _, s := range c.shards {
+		s.mu.RLock()
+		stats.Bytes += s.cache.Bytes()
+		stats.Items += int64(s.cache.Len())
+		stats.Evictions += s.cache.Evictions()
+		stats.Expirations += s.cache.Expirations()
+		s.mu.RUnlock()
+		stats.Gets += s.nget.Get()
+		stats.Hits += s.nhit.Get()
+	}
+	return stats
+}
+
+// peek looks the key up under the read lock and records the access, misses
+// included so frequency based policies still count them.
+func (s *cacheShard) peek(key string) (ByteView, bool) {
+	s.mu.RLock()
+	resp, ok := s.peeker.Peek(key)
+	s.mu.RUnlock()
+	s.recordRead(key)
+
+	if ok {
+		s.nhit.Add(1)
+		return resp.(ByteView), true
+	}
+	return ByteView{}, false
+}
+
+// recordRead adds the access to a batch, and replays the batch once full.
+func (s *cacheShard) recordRead(key string) {
+	batch, _ := s.reads.Get().(*readBatch)
+	if batch == nil {
+		batch = &readBatch{keys: make([]string, 0, s.batchSize)}
+	}
+	batch.keys = append(batch.keys, key)
+	if len(batch.keys) >= s.batchSize {
+		s.mu.Lock()
+		for _, k := range batch.keys {
+			s.cache.Get(k)
+		}
+		s.mu.Unlock()
+		batch.keys = batch.keys[:0]
+	}
+	s.reads.Put(batch)
+}
+
+// cachedEntry is a key of the cache and its value.
+type cachedEntry struct {
+	key  string
+	view ByteView
+}
+
+// hottest returns up to n live entries, the most used of every shard, as
+// ranked by its policy, an equal share of n per shard. n <= 0 returns every
+// live entry.
+func (c *ConcurrentCache) hottest(n int) []cachedEntry {
+	c.init()
+	perShard := (n + len(c.shards) - 1) / len(c.shards)
+	if n <= 0 {
+		perShard = math.MaxInt
+	}
+	var entries []cachedEntry
+	for _, s := range c.shards {
+		walker, ok := s.cache.(eviction.Walker)
+		if !ok {
+			continue
+		}
+		taken := 0
+		s.mu.RLock()
+		walker.Walk(func(key string, value eviction.Value) bool {
+			view := value.(ByteView)
+			if view.Stale() {
+				// kept for the stale grace only
+				return true
+			}
+			entries = append(entries, cachedEntry{key: key, view: view})
+			taken++
+			return taken < perShard
+		})
+		s.mu.RUnlock()
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentCacheShards(t *testing.T) {
+	c := &ConcurrentCache{cacheSize: 8 << 10, shardCount: 6}
+	for i := 0; i < 2000; i++ {
+		c.Add(fmt.Sprintf("key-%04d", i), ByteView{b: []byte("value")})
+	}
+	if len(c.shards) != 8 {
+		t.Fatalf("%d shards, want 6 rounded up to 8", len(c.shards))
+	}
+	for i, s := range c.shards {
+		if s.cache.Bytes() > 1<<10 || s.cache.Len() == 0 {
+			t.Fatalf("shard %d holds %d entries of %d bytes, budget 1024", i, s.cache.Len(), s.cache.Bytes())
+		}
+	}
+	if stats := c.Stats(); stats.Items+stats.Evictions != 2000 || stats.Bytes > 8<<10 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	v, ok := c.Get("key-1999")
+	if !ok || v.String() != "value" {
+		t.Fatalf("last key added was evicted")
+	}
+	if !c.Remove("key-1999") || c.Remove("key-1999") {
+		t.Fatalf("Remove key-1999 failed")
+	}
+}
+
+func TestConcurrentCacheOversizeValue(t *testing.T) {
+	c := &ConcurrentCache{cacheSize: 1 << 10, shardCount: 1}
+	c.Add("small", ByteView{b: []byte("value")})
+	c.Add("big", ByteView{b: make([]byte, 1<<10)})
+	if _, ok := c.Get("big"); ok {
+		t.Fatal("a value bigger than the shard budget was cached")
+	}
+	if v, ok := c.Get("small"); !ok || v.String() != "value" {
+		t.Fatal("an oversize value evicted the other entries")
+	}
+
+	// the previous value of the key is not left behind
+	c.Add("small", ByteView{b: make([]byte, 1<<10)})
+	if _, ok := c.Get("small"); ok {
+		t.Fatal("an oversize update kept the previous value")
+	}
+	if stats := c.Stats(); stats.Items != 0 || stats.Evictions != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestDefaultShardCount(t *testing.T) {
+	if n := defaultShardCount(2 << 10); n != 1 {
+		t.Fatalf("small cache split in %d shards", n)
+	}
+	n := defaultShardCount(0)
+	if n < runtime.GOMAXPROCS(0) && n < maxShards || n&(n-1) != 0 {
+		t.Fatalf("unbounded cache split in %d shards", n)
+	}
+	if n := defaultShardCount(4 * minShardBytes); n > 4 {
+		t.Fatalf("%d shards of less than %d bytes", n, minShardBytes)
+	}
+}
+
+func TestConcurrentCacheReadBuffer(t *testing.T) {
+	// room for two entries of 6 bytes, every batch is full after one access
+	c := &ConcurrentCache{cacheSize: 12, shardCount: 1, readBuffer: 1}
+	c.Add("a", ByteView{b: []byte("aaaaa")})
+	c.Add("b", ByteView{b: []byte("bbbbb")})
+
+	if v, ok := c.Get("a"); !ok || v.String() != "aaaaa" {
+		t.Fatalf("buffered hit of a failed")
+	}
+	// the replayed hit promoted a before c evicts the least recently used
+	c.Add("c", ByteView{b: []byte("ccccc")})
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("b was kept over a")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("a was evicted, its hit was not replayed")
+	}
+	if stats := c.Stats(); stats.Gets != 3 || stats.Hits != 2 {
+		t.Fatalf("gets=%d hits=%d", stats.Gets, stats.Hits)
+	}
+}
+
+func TestConcurrentCacheParallel(t *testing.T) {
+	c := &ConcurrentCache{cacheSize: 4 << 10, shardCount: 4, readBuffer: 16}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key-%d", r.Intn(200))
+				if v, ok := c.Get(key); ok {
+					if v.String() != "value-"+key {
+						t.Errorf("%s = %q", key, v.String())
+						return
+					}
+					continue
+				}
+				c.Add(key, ByteView{b: []byte("value-" + key)})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Gets != 16000 || stats.Bytes > 4<<10 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// benchmarkCache runs a mix of hits and writes on the cache from GOMAXPROCS
+// goroutines, one write every writeEvery operations.
+func benchmarkCache(b *testing.B, c *ConcurrentCache, writeEvery int) {
+	const keys = 1 << 14
+	value := ByteView{b: make([]byte, 64)}
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key-%d", i)
+		c.Add(names[i], value)
+	}
+
+	var seed AtomicInt
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(seed.Get()))
+		seed.Add(1)
+		for i := 0; pb.Next(); i++ {
+			key := names[r.Intn(keys)]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				c.Add(key, value)
+			} else {
+				c.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkConcurrentCache(b *testing.B) {
+	variants := []struct {
+		name       string
+		shards     int
+		readBuffer int
+	}{
+		{"single-lock", 1, 0},
+		{"sharded", 0, 0},
+		{"sharded+read-buffer", 0, 64},
+	}
+	for _, mix := range []struct {
+		name       string
+		writeEvery int
+	}{{"reads", 0}, {"10%-writes", 10}} {
+		for _, v := range variants {
+			b.Run(mix.name+"/"+v.name, func(b *testing.B) {
+				c := &ConcurrentCache{cacheSize: 64 << 20, shardCount: v.shards, readBuffer: v.readBuffer}
+				benchmarkCache(b, c, mix.writeEvery)
+			})
+		}
+	}
+}
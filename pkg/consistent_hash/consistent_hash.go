@@ -39,6 +39,28 @@ func (c *ConsistentHashMap) AddNode(actualNodeKeys ...string) {
 	sort.Ints(c.nodeHashKeys)
 }
 
+// RemoveNode drops the virtual nodes of the actual nodes from the ring,
+// only the keys owned by the removed nodes move to other nodes.
+func (c *ConsistentHashMap) RemoveNode(actualNodeKeys ...string) {
+	for _, key := range actualNodeKeys {
+		for i := 0; i < c.replicas; i++ {
+			nodeHash := int(c.hashFunc([]byte(strconv.Itoa(i) + key)))
+			// another node may have taken this hash on collision
+			if c.hashMap[nodeHash] == key {
+				delete(c.hashMap, nodeHash)
+			}
+		}
+	}
+
+	nodeHashKeys := c.nodeHashKeys[:0]
+	for _, nodeHash := range c.nodeHashKeys {
+		if _, ok := c.hashMap[nodeHash]; ok {
+			nodeHashKeys = append(nodeHashKeys, nodeHash)
+		}
+	}
+	c.nodeHashKeys = nodeHashKeys
+}
+
 func (c *ConsistentHashMap) GetNode(key string) string {
 	if len(c.nodeHashKeys) == 0 {
 		return ""
@@ -51,3 +73,28 @@ func (c *ConsistentHashMap) GetNode(key string) string {
 
 	return c.hashMap[c.nodeHashKeys[idx%len(c.nodeHashKeys)]]
 }
+
+// GetNodes returns up to n distinct actual nodes for the key, walking the ring
+// clockwise from the key, so the first one is the node GetNode returns.
+// Fewer than n nodes are returned when the ring does not have that many.
+func (c *ConsistentHashMap) GetNodes(key string, n int) []string {
+	if len(c.nodeHashKeys) == 0 || n <= 0 {
+		return nil
+	}
+
+	hash := int(c.hashFunc([]byte(key)))
+	idx := sort.Search(len(c.nodeHashKeys), func(i int) bool {
+		return c.nodeHashKeys[i] >= hash
+	})
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(c.nodeHashKeys) && len(nodes) < n; i++ {
+		node := c.hashMap[c.nodeHashKeys[(idx+i)%len(c.nodeHashKeys)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -1,6 +1,8 @@
 package consistenthash
 
 import (
+	"fmt"
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -41,3 +43,123 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestRemoveNode(t *testing.T) {
+	hash := NewConsistentHashMap(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// 2, 4, 6, 8, 12, 14, 16, 18, 22, 24, 26, 28
+	hash.AddNode("6", "4", "2", "8")
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.RemoveNode("8")
+
+	testCases := map[string]string{
+		"2":  "2",
+		"11": "2",
+		"23": "4",
+		"27": "2",
+	}
+
+	for k, v := range testCases {
+		if hash.GetNode(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s", k, v)
+		}
+	}
+
+	hash.RemoveNode("6", "4", "2")
+	if node := hash.GetNode("2"); node != "" {
+		t.Errorf("empty ring yielded %s", node)
+	}
+}
+
+func TestMinimalMovement(t *testing.T) {
+	const keys = 10000
+	hash := NewConsistentHashMap(50, nil)
+	hash.AddNode("node-a", "node-b", "node-c")
+
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = hash.GetNode(fmt.Sprintf("key-%d", i))
+	}
+
+	hash.AddNode("node-d")
+	moved := 0
+	for i := range before {
+		node := hash.GetNode(fmt.Sprintf("key-%d", i))
+		if node == before[i] {
+			continue
+		}
+		if node != "node-d" {
+			t.Fatalf("key-%d moved from %s to %s, only moves to the new node are allowed", i, before[i], node)
+		}
+		moved++
+	}
+	// the new node should take roughly a quarter of the keys
+	if moved == 0 || moved > keys/2 {
+		t.Fatalf("%d of %d keys moved to the new node", moved, keys)
+	}
+
+	hash.RemoveNode("node-d")
+	for i := range before {
+		if node := hash.GetNode(fmt.Sprintf("key-%d", i)); node != before[i] {
+			t.Fatalf("key-%d owned by %s after removal, want %s", i, node, before[i])
+		}
+	}
+
+	hash.RemoveNode("node-b")
+	for i := range before {
+		node := hash.GetNode(fmt.Sprintf("key-%d", i))
+		if before[i] != "node-b" && node != before[i] {
+			t.Fatalf("key-%d moved from %s to %s although its owner stayed", i, before[i], node)
+		}
+		if node == "node-b" {
+			t.Fatalf("key-%d still owned by removed node", i)
+		}
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	hash := NewConsistentHashMap(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.AddNode("6", "4", "2")
+
+	testCases := map[string][]string{
+		"2":  {"2", "4"},
+		"11": {"2", "4"},
+		"23": {"4", "6"},
+		"27": {"2", "4"},
+	}
+	for k, v := range testCases {
+		if nodes := hash.GetNodes(k, 2); !reflect.DeepEqual(nodes, v) {
+			t.Errorf("Asking for %s, should have yielded %v, got %v", k, v, nodes)
+		}
+		if nodes := hash.GetNodes(k, 2); nodes[0] != hash.GetNode(k) {
+			t.Errorf("Asking for %s, primary %s differs from GetNode %s", k, nodes[0], hash.GetNode(k))
+		}
+	}
+
+	// more replicas than nodes yields every node exactly once
+	for i := 0; i < 100; i++ {
+		nodes := hash.GetNodes(strconv.Itoa(i), 5)
+		if len(nodes) != 3 {
+			t.Fatalf("Asking for %d with 5 replicas, got %v", i, nodes)
+		}
+		seen := make(map[string]bool)
+		for _, node := range nodes {
+			if seen[node] {
+				t.Fatalf("Asking for %d, node %s returned twice in %v", i, node, nodes)
+			}
+			seen[node] = true
+		}
+	}
+
+	if nodes := NewConsistentHashMap(3, nil).GetNodes("key", 2); len(nodes) != 0 {
+		t.Errorf("empty ring yielded %v", nodes)
+	}
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrGroupUnknown is returned by nodes which have no group of the requested name.
+	ErrGroupUnknown = errors.New("no such group")
+	// ErrOverloaded is returned, possibly wrapped, by a Getter or a node
+	// shedding load. A node answered OVERLOADED by the owner loads the key
+	// through its own getter instead, see fallbackOnPeerError.
+	ErrOverloaded = errors.New("overloaded")
+)
+
+// PeerError is a failure reported by another node, along with its code.
+// errors.Is matches it with ErrNotFound, ErrGroupUnknown, ErrOverloaded and
+// context.DeadlineExceeded according to the code.
+type PeerError struct {
+	Code    pb.ErrorCode
+	Message string
+	// TTL is how long the peer remembers a NOT_FOUND key, 0 if it does not.
+	TTL time.Duration
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer returned %s: %s", e.Code, e.Message)
+}
+
+func (e *PeerError) Is(target error) bool {
+	switch e.Code {
+	case pb.ErrorCode_NOT_FOUND:
+		return target == ErrNotFound
+	case pb.ErrorCode_GROUP_UNKNOWN:
+		return target == ErrGroupUnknown
+	case pb.ErrorCode_OVERLOADED:
+		return target == ErrOverloaded
+	case pb.ErrorCode_TIMEOUT:
+		return target == context.DeadlineExceeded
+	}
+	return false
+}
+
+// errorCode returns the code reporting err to other nodes.
+func errorCode(err error) pb.ErrorCode {
+	switch {
+	case err == nil:
+		return pb.ErrorCode_OK
+	case errors.Is(err, ErrNotFound):
+		return pb.ErrorCode_NOT_FOUND
+	case errors.Is(err, ErrGroupUnknown):
+		return pb.ErrorCode_GROUP_UNKNOWN
+	case errors.Is(err, ErrOverloaded):
+		return pb.ErrorCode_OVERLOADED
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return pb.ErrorCode_TIMEOUT
+	default:
+		return pb.ErrorCode_INTERNAL
+	}
+}
+
+// errorResponse builds the response reporting err to another node.
+func errorResponse(err error) *pb.Response {
+	res := &pb.Response{Code: errorCode(err), Error: err.Error()}
+	var nf *notFoundError
+	if errors.As(err, &nf) && !nf.expire.IsZero() {
+		res.TtlMs = max(time.Until(nf.expire).Milliseconds(), 1)
+	}
+	return res
+}
+
+// responseError returns the error of a response, nil if it succeeded.
+func responseError(res *pb.Response) error {
+	if res.GetCode() == pb.ErrorCode_OK {
+		return nil
+	}
+	return &PeerError{
+		Code:    res.GetCode(),
+		Message: res.GetError(),
+		TTL:     time.Duration(res.GetTtlMs()) * time.Millisecond,
+	}
+}
+
+// fallbackOnPeerError reports whether a key the owner failed to serve may be
+// loaded by the current node's getter: when the owner could not be reached,
+// has no such group or sheds load. Missing keys, timeouts and failures of
+// the owner's getter are returned as is, the getter would likely fail too.
+func fallbackOnPeerError(err error) bool {
+	var pe *PeerError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	switch pe.Code {
+	case pb.ErrorCode_GROUP_UNKNOWN, pb.ErrorCode_OVERLOADED:
+		return true
+	}
+	return false
+}
+
+// httpStatus returns the HTTP status of the responses failing with code.
+func httpStatus(code pb.ErrorCode) int {
+	switch code {
+	case pb.ErrorCode_OK:
+		return http.StatusOK
+	case pb.ErrorCode_NOT_FOUND, pb.ErrorCode_GROUP_UNKNOWN:
+		return http.StatusNotFound
+	case pb.ErrorCode_OVERLOADED:
+		return http.StatusServiceUnavailable
+	case pb.ErrorCode_TIMEOUT:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// grpcError returns the status error reporting err, with its pb.Response as detail.
+func grpcError(err error) error {
+	res := errorResponse(err)
+	var code codes.Code
+	switch res.GetCode() {
+	case pb.ErrorCode_NOT_FOUND, pb.ErrorCode_GROUP_UNKNOWN:
+		code = codes.NotFound
+	case pb.ErrorCode_OVERLOADED:
+		code = codes.ResourceExhausted
+	case pb.ErrorCode_TIMEOUT:
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	st, detailErr := status.New(code, err.Error()).WithDetails(res)
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
+
+// peerErrorFromGRPC returns the PeerError carried by a status error, or err
+// itself for failures of the transport.
+func peerErrorFromGRPC(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if res, ok := detail.(*pb.Response); ok {
+			if err := responseError(res); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
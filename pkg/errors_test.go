@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/alo-distributed-memcached/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code pb.ErrorCode
+	}{
+		{nil, pb.ErrorCode_OK},
+		{fmt.Errorf("Tom: %w", ErrNotFound), pb.ErrorCode_NOT_FOUND},
+		{fmt.Errorf("%w: scores", ErrGroupUnknown), pb.ErrorCode_GROUP_UNKNOWN},
+		{ErrOverloaded, pb.ErrorCode_OVERLOADED},
+		{context.DeadlineExceeded, pb.ErrorCode_TIMEOUT},
+		{errors.New("disk failed"), pb.ErrorCode_INTERNAL},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("errorCode(%v) = %s, want %s", tt.err, code, tt.code)
+		}
+		if tt.err == nil {
+			continue
+		}
+		// the code survives the round trip to another node
+		err := responseError(errorResponse(tt.err))
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("%v read back as %s, want %s", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestFallbackOnPeerError(t *testing.T) {
+	tests := []struct {
+		err      error
+		fallback bool
+	}{
+		{errors.New("connection refused"), true},
+		{&PeerError{Code: pb.ErrorCode_GROUP_UNKNOWN}, true},
+		{&PeerError{Code: pb.ErrorCode_OVERLOADED}, true},
+		{&PeerError{Code: pb.ErrorCode_NOT_FOUND}, false},
+		{&PeerError{Code: pb.ErrorCode_TIMEOUT}, false},
+		{fmt.Errorf("GetDataFromPeer(): %w", &PeerError{Code: pb.ErrorCode_INTERNAL}), false},
+	}
+	for _, tt := range tests {
+		if got := fallbackOnPeerError(tt.err); got != tt.fallback {
+			t.Errorf("fallbackOnPeerError(%v) = %v, want %v", tt.err, got, tt.fallback)
+		}
+	}
+}
+
+// testPeerErrorCodes checks the failures of the owner reach the other node
+// with their code, and only the ones allowed fall back to its getter.
+func testPeerErrorCodes(t *testing.T, nodes []*testNode) {
+	key := "broken-1"
+	owner, other := ownerOf(nodes, key)
+	_, err := other.group.Get(key)
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != pb.ErrorCode_INTERNAL {
+		t.Fatalf("Get(%s) = %v, want a PeerError with INTERNAL", key, err)
+	}
+	if owner.loadCount(key) != 1 || other.loadCount(key) != 0 {
+		t.Fatalf("%s loaded %d times by the owner and %d locally, want no fallback", key, owner.loadCount(key), other.loadCount(key))
+	}
+
+	// the owner sheds load, the other node tries its own getter
+	key = "overloaded-1"
+	owner, other = ownerOf(nodes, key)
+	if _, err := other.group.Get(key); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Get(%s) = %v, want ErrOverloaded", key, err)
+	}
+	if owner.loadCount(key) != 1 || other.loadCount(key) != 1 {
+		t.Fatalf("%s loaded %d times by the owner and %d locally, want a fallback", key, owner.loadCount(key), other.loadCount(key))
+	}
+
+	keys := []string{"key-1", "broken-2"}
+	_, other = ownerOf(nodes, "broken-2")
+	_, err = other.group.GetMulti(keys)
+	var errs KeyErrors
+	if !errors.As(err, &errs) || errorCode(errs["broken-2"]) != pb.ErrorCode_INTERNAL {
+		t.Fatalf("GetMulti = %v, want broken-2 failing with INTERNAL", err)
+	}
+}
+
+func TestHTTPPeerErrorCodes(t *testing.T) {
+	nodes := startHTTPNodes(t, "http-errors", 2)
+	testPeerErrorCodes(t, nodes)
+
+	tests := []struct {
+		path   string
+		status int
+		code   pb.ErrorCode
+	}{
+		{"nope/key-1", http.StatusNotFound, pb.ErrorCode_GROUP_UNKNOWN},
+		{"http-errors/missing-1", http.StatusNotFound, pb.ErrorCode_NOT_FOUND},
+		{"http-errors/overloaded-2", http.StatusServiceUnavailable, pb.ErrorCode_OVERLOADED},
+		{"http-errors/broken-3", http.StatusInternalServerError, pb.ErrorCode_INTERNAL},
+	}
+	for _, tt := range tests {
+		res, err := http.Get("http://" + nodes[0].addr + defaultBasePath + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := &pb.Response{}
+		readErr := readBody(res, body)
+		if res.StatusCode != tt.status || readErr != nil || body.GetCode() != tt.code {
+			t.Errorf("GET %s = %s, code %s (%v), want %d and %s", tt.path, res.Status, body.GetCode(), readErr, tt.status, tt.code)
+		}
+	}
+}
+
+func TestGRPCPeerErrorCodes(t *testing.T) {
+	nodes := startGRPCNodes(t, "grpc-errors", 2)
+	testPeerErrorCodes(t, nodes)
+
+	getter, err := NewGRPCGetter(nodes[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = getter.GetDataFromPeer(context.Background(), &pb.Request{Group: "nope", Key: "key-1"}, &pb.Response{})
+	if !errors.Is(err, ErrGroupUnknown) {
+		t.Fatalf("Get of an unknown group = %v, want ErrGroupUnknown", err)
+	}
+}
+
+func readBody(res *http.Response, out proto.Message) error {
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, out)
+}
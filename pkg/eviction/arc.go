@@ -0,0 +1,191 @@
+package eviction
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	segT1 = iota // ARC entries seen once recently
+	segT2        // ARC entries seen at least twice recently
+)
+
+/*
+ARC is the Adaptive Replacement Cache. It splits the budget between recent
+(T1) and frequent (T2) entries and keeps ghost lists of the keys it evicted
+from each (B1, B2). A miss on a ghost key moves the target size p of T1
+toward the list that should have kept it, so a scan only pollutes T1.
+Sizes are counted in bytes instead of entries.
+*/
+type ARC struct {
+	base
+	p       int64 // target bytes of T1
+	t1, t2  list.List
+	t1Bytes int64
+	t2Bytes int64
+
+	b1, b2  list.List
+	b1Bytes int64
+	b2Bytes int64
+	ghosts  map[string]*list.Element
+}
+
+type ghost struct {
+	key  string
+	size int64
+	inB2 bool
+}
+
+func NewARC(maxBytes int64) *ARC {
+	return &ARC{
+		base:   newBase(maxBytes),
+		ghosts: make(map[string]*list.Element),
+	}
+}
+
+func (c *ARC) Get(key string) (Value, bool) {
+	e, ok := c.lookup(key, c.remove)
+	if !ok {
+		return nil, false
+	}
+	c.unlink(e)
+	c.link(e, segT2)
+	return e.value, true
+}
+
+func (c *ARC) AddWithExpire(key string, value Value, expire time.Time) {
+	segment := segT1
+	if e, ok := c.items[key]; ok {
+		// an update counts as a second reference
+		c.remove(e)
+		segment = segT2
+	}
+	e := &entry{key: key, value: value}
+	size := e.size()
+	if c.maxBytes != 0 && size > c.maxBytes {
+		return
+	}
+
+	hitB2 := false
+	if elem, ok := c.ghosts[key]; ok {
+		g := elem.Value.(*ghost)
+		if g.inB2 {
+			// T2 was too small, shrink the target of T1
+			delta := size
+			if c.b2Bytes > 0 && c.b1Bytes > c.b2Bytes {
+				delta = size * c.b1Bytes / c.b2Bytes
+			}
+			c.p = max(c.p-delta, 0)
+			hitB2 = true
+		} else {
+			delta := size
+			if c.b1Bytes > 0 && c.b2Bytes > c.b1Bytes {
+				delta = size * c.b2Bytes / c.b1Bytes
+			}
+			c.p = min(c.p+delta, c.maxBytes)
+		}
+		c.dropGhost(elem)
+		segment = segT2
+	}
+
+	// expired entries go first so they never push out live ones
+	c.removeExpired(c.remove)
+	for c.full(size) {
+		c.replace(hitB2)
+	}
+
+	c.insert(e, expire)
+	c.link(e, segment)
+	c.trimGhosts()
+}
+
+func (c *ARC) Remove(key string) bool {
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+		return true
+	}
+	return false
+}
+
+// Walk visits the frequent entries, then the recent ones, the most recently used first.
+func (c *ARC) Walk(fn func(key string, value Value) bool) {
+	c.walk(fn, &c.t2, &c.t1)
+}
+
+func (c *ARC) RemoveExpired() int {
+	return c.removeExpired(c.remove)
+}
+
+// replace evicts the LRU entry of T1 or T2 into its ghost list.
+func (c *ARC) replace(hitB2 bool) {
+	var e *entry
+	if c.t1.Len() > 0 && (c.t1Bytes > c.p || (hitB2 && c.t1Bytes == c.p) || c.t2.Len() == 0) {
+		e = c.t1.Back().Value.(*entry)
+	} else {
+		e = c.t2.Back().Value.(*entry)
+	}
+	inB2 := e.segment == segT2
+	c.remove(e)
+	c.evictions++
+
+	g := &ghost{key: e.key, size: e.size(), inB2: inB2}
+	if inB2 {
+		c.ghosts[g.key] = c.b2.PushFront(g)
+		c.b2Bytes += g.size
+	} else {
+		c.ghosts[g.key] = c.b1.PushFront(g)
+		c.b1Bytes += g.size
+	}
+}
+
+// trimGhosts bounds T1+B1 to the budget, and all four lists to twice the budget.
+func (c *ARC) trimGhosts() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.b1.Len() > 0 && c.t1Bytes+c.b1Bytes > c.maxBytes {
+		c.dropGhost(c.b1.Back())
+	}
+	for c.b2.Len() > 0 && c.t1Bytes+c.t2Bytes+c.b1Bytes+c.b2Bytes > 2*c.maxBytes {
+		c.dropGhost(c.b2.Back())
+	}
+}
+
+func (c *ARC) dropGhost(elem *list.Element) {
+	g := elem.Value.(*ghost)
+	delete(c.ghosts, g.key)
+	if g.inB2 {
+		c.b2.Remove(elem)
+		c.b2Bytes -= g.size
+	} else {
+		c.b1.Remove(elem)
+		c.b1Bytes -= g.size
+	}
+}
+
+func (c *ARC) link(e *entry, segment int) {
+	e.segment = segment
+	if segment == segT2 {
+		e.elem = c.t2.PushFront(e)
+		c.t2Bytes += e.size()
+	} else {
+		e.elem = c.t1.PushFront(e)
+		c.t1Bytes += e.size()
+	}
+}
+
+func (c *ARC) unlink(e *entry) {
+	if e.segment == segT2 {
+		c.t2.Remove(e.elem)
+		c.t2Bytes -= e.size()
+	} else {
+		c.t1.Remove(e.elem)
+		c.t1Bytes -= e.size()
+	}
+	e.elem = nil
+}
+
+func (c *ARC) remove(e *entry) {
+	c.unlink(e)
+	c.forget(e)
+}
@@ -0,0 +1,264 @@
+// Package eviction provides the eviction policies a ConcurrentCache can be
+// built on: LRU (from pkg/lru), LFU, ARC and W-TinyLFU.
+package eviction
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"time"
+
+	"github.com/alo-distributed-memcached/pkg/lru"
+)
+
+// Value is the value stored by every policy, its Len is its size in bytes.
+type Value = lru.Value
+
+// Policy is a cache bounded by the bytes of its keys and values, which
+// decides which entries to drop when it is full. Policies are not safe for
+// concurrent use. A maxBytes of 0 means no limit. Get and AddWithExpire
+// drop the expired entries, Len and Bytes leave them out until then.
+type Policy interface {
+	Get(key string) (Value, bool)
+	// AddWithExpire adds the value and drops it once expire has passed,
+	// a zero expire means the value never expires.
+	AddWithExpire(key string, value Value, expire time.Time)
+	Remove(key string) bool
+	RemoveExpired() int
+	Len() int
+	Bytes() int64
+	Evictions() int64
+	Expirations() int64
+}
+
+// Peeker is implemented by policies which can look a key up without
+// updating their state, so concurrent Peeks only need a read lock.
+type Peeker interface {
+	Peek(key string) (Value, bool)
+}
+
+// Walker is implemented by policies which can list their live entries, the
+// ones they would evict last first, e.g. to hand the hottest ones to another
+// node. Walk stops when fn returns false, fn must not modify the policy.
+type Walker interface {
+	Walk(fn func(key string, value Value) bool)
+}
+
+var (
+	_ Walker = (*lru.Cache)(nil)
+	_ Walker = (*LFU)(nil)
+	_ Walker = (*ARC)(nil)
+	_ Walker = (*TinyLFU)(nil)
+	_ Policy = (*lru.Cache)(nil)
+	_ Peeker = (*lru.Cache)(nil)
+	_ Peeker = (*LFU)(nil)
+	_ Peeker = (*ARC)(nil)
+	_ Peeker = (*TinyLFU)(nil)
+)
+
+// Factory creates a policy with a budget of maxBytes.
+type Factory func(maxBytes int64) Policy
+
+// NewLRU evicts the least recently used entries.
+func NewLRU(maxBytes int64) Policy {
+	return lru.New(maxBytes, nil)
+}
+
+// Factories are the policies selectable by name.
+var Factories = map[string]Factory{
+	"lru":     NewLRU,
+	"lfu":     func(maxBytes int64) Policy { return NewLFU(maxBytes) },
+	"arc":     func(maxBytes int64) Policy { return NewARC(maxBytes) },
+	"tinylfu": func(maxBytes int64) Policy { return NewTinyLFU(maxBytes) },
+}
+
+// ByName returns the factory of the policy, see Factories.
+func ByName(name string) (Factory, error) {
+	if f, ok := Factories[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// entry is shared by the policies of this package, each one uses its own fields.
+type entry struct {
+	key         string
+	value       Value
+	expire      time.Time // zero means the entry never expires
+	expireIndex int       // position in expiryHeap, -1 if the entry never expires
+
+	// LFU
+	freq      int
+	tick      uint64
+	heapIndex int
+
+	// ARC and W-TinyLFU
+	segment int
+	elem    *list.Element
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key) + e.value.Len())
+}
+
+// base keeps the entries, their size and their expiration for the policies.
+type base struct {
+	maxBytes    int64
+	curBytes    int64
+	items       map[string]*entry
+	expires     expiryHeap
+	now         func() time.Time
+	evictions   int64
+	expirations int64
+}
+
+func newBase(maxBytes int64) base {
+	return base{
+		maxBytes: maxBytes,
+		items:    make(map[string]*entry),
+		now:      time.Now,
+	}
+}
+
+// Len returns the number of live entries.
+func (b *base) Len() int {
+	n, _ := b.expiredSize(0)
+	return len(b.items) - n
+}
+
+// Bytes returns the storage size used by the live entries, keys included.
+func (b *base) Bytes() int64 {
+	_, bytes := b.expiredSize(0)
+	return b.curBytes - bytes
+}
+
+// expiredSize returns the number and the size of the expired entries under
+// position i of the heap, without dropping them. A live entry only has later
+// entries under it, so the walk costs the expired entries only.
+func (b *base) expiredSize(i int) (int, int64) {
+	if i >= len(b.expires) || !b.expired(b.expires[i]) {
+		return 0, 0
+	}
+	n, bytes := 1, b.expires[i].size()
+	for _, child := range []int{2*i + 1, 2*i + 2} {
+		childN, childBytes := b.expiredSize(child)
+		n += childN
+		bytes += childBytes
+	}
+	return n, bytes
+}
+
+// Evictions returns how many entries were removed to make room.
+func (b *base) Evictions() int64 {
+	return b.evictions
+}
+
+// Expirations returns how many entries were removed because they expired.
+func (b *base) Expirations() int64 {
+	return b.expirations
+}
+
+// Peek returns the live value of key without marking it used.
+func (b *base) Peek(key string) (Value, bool) {
+	if e, ok := b.items[key]; ok && !b.expired(e) {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// walk calls fn on the live entries of the lists, each walked from its front.
+func (b *base) walk(fn func(key string, value Value) bool, lists ...*list.List) {
+	for _, l := range lists {
+		for elem := l.Front(); elem != nil; elem = elem.Next() {
+			e := elem.Value.(*entry)
+			if !b.expired(e) && !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// full reports whether n more bytes do not fit.
+func (b *base) full(n int64) bool {
+	return b.maxBytes != 0 && b.curBytes+n > b.maxBytes
+}
+
+// lookup returns the live entry of key, the expired ones are dropped with
+// remove first.
+func (b *base) lookup(key string, remove func(*entry)) (*entry, bool) {
+	b.removeExpired(remove)
+	e, ok := b.items[key]
+	return e, ok
+}
+
+// insert tracks a new entry.
+func (b *base) insert(e *entry, expire time.Time) {
+	e.expireIndex = -1
+	b.items[e.key] = e
+	b.curBytes += e.size()
+	b.setExpire(e, expire)
+}
+
+// forget stops tracking the entry, the policy unlinks it from its own structures.
+func (b *base) forget(e *entry) {
+	delete(b.items, e.key)
+	if e.expireIndex >= 0 {
+		heap.Remove(&b.expires, e.expireIndex)
+	}
+	b.curBytes -= e.size()
+}
+
+// removeExpired drops every expired entry with remove.
+func (b *base) removeExpired(remove func(*entry)) int {
+	removed := 0
+	for len(b.expires) > 0 && b.expired(b.expires[0]) {
+		remove(b.expires[0])
+		b.expirations++
+		removed++
+	}
+	return removed
+}
+
+func (b *base) expired(e *entry) bool {
+	return !e.expire.IsZero() && !b.now().Before(e.expire)
+}
+
+func (b *base) setExpire(e *entry, expire time.Time) {
+	e.expire = expire
+	switch {
+	case expire.IsZero() && e.expireIndex >= 0:
+		heap.Remove(&b.expires, e.expireIndex)
+	case !expire.IsZero() && e.expireIndex >= 0:
+		heap.Fix(&b.expires, e.expireIndex)
+	case !expire.IsZero():
+		heap.Push(&b.expires, e)
+	}
+}
+
+// expiryHeap is a min-heap of entries ordered by expiration time.
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expireIndex = i
+	h[j].expireIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.expireIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.expireIndex = -1
+	*h = old[:len(old)-1]
+	return e
+}
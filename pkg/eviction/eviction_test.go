@@ -0,0 +1,260 @@
+package eviction
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func policies() []string {
+	names := make([]string, 0, len(Factories))
+	for name := range Factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func forEachPolicy(t *testing.T, test func(t *testing.T, newPolicy Factory)) {
+	for _, name := range policies() {
+		t.Run(name, func(t *testing.T) {
+			test(t, Factories[name])
+		})
+	}
+}
+
+func TestPolicyGetAddRemove(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		c := newPolicy(0)
+		c.AddWithExpire("key1", String("1234"), time.Time{})
+		if v, ok := c.Get("key1"); !ok || string(v.(String)) != "1234" {
+			t.Fatalf("cache hit key1=1234 failed")
+		}
+		if _, ok := c.Get("key2"); ok {
+			t.Fatalf("cache miss key2 failed")
+		}
+
+		c.AddWithExpire("key1", String("123456"), time.Time{})
+		if v, ok := c.Get("key1"); !ok || string(v.(String)) != "123456" {
+			t.Fatalf("update of key1 failed")
+		}
+		if c.Len() != 1 || c.Bytes() != int64(len("key1123456")) {
+			t.Fatalf("len=%d bytes=%d after update", c.Len(), c.Bytes())
+		}
+
+		if !c.Remove("key1") || c.Remove("key1") {
+			t.Fatalf("Remove key1 failed")
+		}
+		if c.Len() != 0 || c.Bytes() != 0 {
+			t.Fatalf("len=%d bytes=%d after Remove", c.Len(), c.Bytes())
+		}
+	})
+}
+
+func TestPolicyExpire(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		c := newPolicy(0)
+		past := time.Now().Add(-time.Second)
+		c.AddWithExpire("stale", String("v"), past)
+		if c.Len() != 0 || c.Bytes() != 0 {
+			t.Fatalf("len=%d bytes=%d with only an expired entry", c.Len(), c.Bytes())
+		}
+		// each Add drops the entries expired before it
+		c.AddWithExpire("swept", String("v"), past)
+		c.AddWithExpire("live", String("v"), time.Now().Add(time.Hour))
+
+		if _, ok := c.Get("stale"); ok {
+			t.Fatalf("expired key hit")
+		}
+		if n := c.RemoveExpired(); n != 0 {
+			t.Fatalf("RemoveExpired removed %d entries, want 0 after Add dropped them", n)
+		}
+		if _, ok := c.Get("live"); !ok || c.Len() != 1 {
+			t.Fatalf("live key lost, len=%d", c.Len())
+		}
+		if c.Expirations() != 2 || c.Evictions() != 0 {
+			t.Fatalf("expirations=%d evictions=%d", c.Expirations(), c.Evictions())
+		}
+	})
+}
+
+func TestPolicyBudget(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		// entries of 10 bytes, room for 10 of them
+		c := newPolicy(100)
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			c.Get(key)
+			c.AddWithExpire(key, String("1234567"), time.Time{})
+			if c.Bytes() > 100 {
+				t.Fatalf("%d bytes used after adding %s", c.Bytes(), key)
+			}
+		}
+		if c.Bytes() != int64(10*c.Len()) || c.Len() == 0 {
+			t.Fatalf("len=%d bytes=%d", c.Len(), c.Bytes())
+		}
+		if int(c.Evictions())+c.Len() != 50 {
+			t.Fatalf("evictions=%d len=%d, want 50 entries in total", c.Evictions(), c.Len())
+		}
+
+		c.AddWithExpire("big", String(make([]byte, 200)), time.Time{})
+		if _, ok := c.Get("big"); ok || c.Bytes() > 100 {
+			t.Fatalf("value over the budget was kept")
+		}
+	})
+}
+
+func TestPolicyExpiredGoFirst(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		c := newPolicy(100)
+		c.AddWithExpire("k00", String("1234567"), time.Now().Add(50*time.Millisecond))
+		for i := 1; i < 10; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			c.AddWithExpire(key, String("1234567"), time.Time{})
+			c.Get(key)
+			c.Get(key)
+		}
+		time.Sleep(60 * time.Millisecond)
+
+		c.Get("k10")
+		c.Get("k10")
+		c.AddWithExpire("k10", String("1234567"), time.Time{})
+		if c.Expirations() != 1 || c.Evictions() != 0 {
+			t.Fatalf("expirations=%d evictions=%d, want the expired entry dropped", c.Expirations(), c.Evictions())
+		}
+	})
+}
+
+// hotAfterScan warms the cache with hot keys, runs a scan of keys used once
+// and returns how many hot keys are still cached.
+func hotAfterScan(c Policy, hot, scan int) int {
+	access := func(key string) {
+		if _, ok := c.Get(key); !ok {
+			c.AddWithExpire(key, String("1234567"), time.Time{})
+		}
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < hot; i++ {
+			access(fmt.Sprintf("h%03d", i))
+		}
+	}
+	for i := 0; i < scan; i++ {
+		access(fmt.Sprintf("s%05d", i))
+	}
+
+	kept := 0
+	for i := 0; i < hot; i++ {
+		if _, ok := c.Get(fmt.Sprintf("h%03d", i)); ok {
+			kept++
+		}
+	}
+	return kept
+}
+
+func TestScanResistance(t *testing.T) {
+	// 100 entries of 12 bytes, half of them hot
+	for _, name := range []string{"arc", "tinylfu", "lfu"} {
+		if kept := hotAfterScan(Factories[name](1200), 50, 5000); kept < 45 {
+			t.Fatalf("%s kept %d of 50 hot keys after a scan", name, kept)
+		}
+	}
+	if kept := hotAfterScan(NewLRU(1200), 50, 5000); kept != 0 {
+		t.Fatalf("lru kept %d hot keys after a scan", kept)
+	}
+}
+
+func TestLFUKeepsFrequent(t *testing.T) {
+	c := NewLFU(30)
+	c.AddWithExpire("k1", String("1234567"), time.Time{})
+	c.AddWithExpire("k2", String("1234567"), time.Time{})
+	c.AddWithExpire("k3", String("1234567"), time.Time{})
+	c.Get("k1")
+	c.Get("k1")
+	c.Get("k3")
+
+	// k2 is the least frequent, then k3 the least recent of the equally frequent
+	c.AddWithExpire("k4", String("1234567"), time.Time{})
+	if _, ok := c.Get("k2"); ok {
+		t.Fatalf("least frequent k2 was kept")
+	}
+	c.AddWithExpire("k5", String("1234567"), time.Time{})
+	if _, ok := c.Get("k1"); !ok {
+		t.Fatalf("most frequent k1 was evicted")
+	}
+	if _, ok := c.Get("k4"); ok {
+		t.Fatalf("k4 used once was kept over k3")
+	}
+}
+
+func TestByName(t *testing.T) {
+	for _, name := range policies() {
+		f, err := ByName(name)
+		if err != nil || f(0) == nil {
+			t.Fatalf("ByName(%q) = %v", name, err)
+		}
+	}
+	if _, err := ByName("random"); err == nil {
+		t.Fatalf("unknown policy accepted")
+	}
+}
+
+func TestPolicyPeek(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		c := newPolicy(0).(Peeker)
+		c.(Policy).AddWithExpire("key1", String("1234"), time.Time{})
+		c.(Policy).AddWithExpire("stale", String("1234"), time.Now().Add(-time.Second))
+		if v, ok := c.Peek("key1"); !ok || string(v.(String)) != "1234" {
+			t.Fatalf("Peek key1=1234 failed")
+		}
+		if _, ok := c.Peek("stale"); ok {
+			t.Fatalf("Peek returned an expired value")
+		}
+	})
+
+	// Peek does not mark the entry used
+	c := NewLRU(20)
+	c.AddWithExpire("k1", String("1234567"), time.Time{})
+	c.AddWithExpire("k2", String("1234567"), time.Time{})
+	c.(Peeker).Peek("k1")
+	c.AddWithExpire("k3", String("1234567"), time.Time{})
+	if _, ok := c.Get("k1"); ok {
+		t.Fatalf("Peek promoted k1")
+	}
+}
+
+func TestPolicyWalk(t *testing.T) {
+	forEachPolicy(t, func(t *testing.T, newPolicy Factory) {
+		c := newPolicy(1 << 10)
+		c.AddWithExpire("cold", String("1"), time.Time{})
+		c.AddWithExpire("hot", String("2"), time.Time{})
+		c.AddWithExpire("gone", String("3"), time.Now().Add(-time.Second))
+		for i := 0; i < 3; i++ {
+			c.Get("hot")
+		}
+
+		var keys []string
+		c.(Walker).Walk(func(key string, value Value) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if len(keys) != 2 || keys[0] != "hot" || keys[1] != "cold" {
+			t.Fatalf("walked %v, want the live entries, the hottest first", keys)
+		}
+
+		n := 0
+		c.(Walker).Walk(func(key string, value Value) bool {
+			n++
+			return false
+		})
+		if n != 1 {
+			t.Fatalf("walk went on after fn returned false")
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package eviction
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// LFU evicts the least frequently used entries, the least recently used
+// first among equally frequent ones.
+type LFU struct {
+	base
+	heap lfuHeap
+	tick uint64
+}
+
+func NewLFU(maxBytes int64) *LFU {
+	return &LFU{base: newBase(maxBytes)}
+}
+
+func (c *LFU) Get(key string) (Value, bool) {
+	e, ok := c.lookup(key, c.remove)
+	if !ok {
+		return nil, false
+	}
+	c.touch(e)
+	return e.value, true
+}
+
+// AddWithExpire makes room before adding the value, so a new entry
+// is never the one evicted.
+func (c *LFU) AddWithExpire(key string, value Value, expire time.Time) {
+	freq := 0
+	if e, ok := c.items[key]; ok {
+		freq = e.freq
+		c.remove(e)
+	}
+	e := &entry{key: key, value: value, freq: freq}
+	if c.maxBytes != 0 && e.size() > c.maxBytes {
+		return
+	}
+
+	// expired entries go first so they never push out live ones
+	c.removeExpired(c.remove)
+	for c.full(e.size()) {
+		c.remove(c.heap[0])
+		c.evictions++
+	}
+
+	c.insert(e, expire)
+	heap.Push(&c.heap, e)
+	c.touch(e)
+}
+
+func (c *LFU) Remove(key string) bool {
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+		return true
+	}
+	return false
+}
+
+// Walk visits the entries the most frequently used first.
+func (c *LFU) Walk(fn func(key string, value Value) bool) {
+	entries := make(lfuHeap, len(c.heap))
+	copy(entries, c.heap)
+	sort.Slice(entries, func(i, j int) bool { return entries.Less(j, i) })
+	for _, e := range entries {
+		if !c.expired(e) && !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+func (c *LFU) RemoveExpired() int {
+	return c.removeExpired(c.remove)
+}
+
+func (c *LFU) touch(e *entry) {
+	c.tick++
+	e.freq++
+	e.tick = c.tick
+	heap.Fix(&c.heap, e.heapIndex)
+}
+
+func (c *LFU) remove(e *entry) {
+	heap.Remove(&c.heap, e.heapIndex)
+	c.forget(e)
+}
+
+// lfuHeap is a min-heap of entries ordered by frequency, then by last access.
+type lfuHeap []*entry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
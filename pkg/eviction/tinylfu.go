@@ -0,0 +1,274 @@
+package eviction
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+const (
+	segWindow = iota
+	segProbation
+	segProtected
+	segNone // taken out of the window, waiting for admission
+)
+
+const (
+	tinyLFUWindowPercent    = 1
+	tinyLFUProtectedPercent = 80
+	// tinyLFUEntryBytes is the assumed mean entry size, used to size the sketch
+	tinyLFUEntryBytes = 64
+)
+
+/*
+TinyLFU is W-TinyLFU: new entries go to a small LRU window, and an entry
+leaving the window only enters the main cache if a count-min sketch of the
+recent accesses says it is used more often than the entry it would evict.
+The main cache is a segmented LRU, entries hit on probation are protected.
+One-hit wonders and scans stay in the window and never push out the
+popular entries.
+*/
+type TinyLFU struct {
+	base
+	sketch *cmSketch
+
+	window, probation, protected list.List
+	windowBytes                  int64
+	probationBytes               int64
+	protectedBytes               int64
+	windowMax, protectedMax      int64
+}
+
+func NewTinyLFU(maxBytes int64) *TinyLFU {
+	c := &TinyLFU{base: newBase(maxBytes)}
+	c.windowMax = maxBytes * tinyLFUWindowPercent / 100
+	c.protectedMax = (maxBytes - c.windowMax) * tinyLFUProtectedPercent / 100
+	c.sketch = newCMSketch(int(maxBytes / tinyLFUEntryBytes))
+	return c
+}
+
+func (c *TinyLFU) Get(key string) (Value, bool) {
+	c.sketch.add(key)
+	e, ok := c.lookup(key, c.remove)
+	if !ok {
+		return nil, false
+	}
+	switch e.segment {
+	case segWindow:
+		c.window.MoveToFront(e.elem)
+	case segProbation:
+		c.unlink(e)
+		c.link(e, segProtected)
+		c.balanceProtected()
+	case segProtected:
+		c.protected.MoveToFront(e.elem)
+	}
+	return e.value, true
+}
+
+func (c *TinyLFU) AddWithExpire(key string, value Value, expire time.Time) {
+	c.sketch.add(key)
+	segment := segWindow
+	if e, ok := c.items[key]; ok {
+		segment = e.segment
+		c.remove(e)
+	}
+	e := &entry{key: key, value: value}
+	if c.maxBytes != 0 && e.size() > c.maxBytes {
+		return
+	}
+
+	// expired entries go first so they never push out live ones
+	c.removeExpired(c.remove)
+	c.insert(e, expire)
+	c.link(e, segment)
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.windowBytes > c.windowMax && c.window.Len() > 0 {
+		candidate := c.window.Back().Value.(*entry)
+		c.unlink(candidate)
+		c.admit(candidate)
+	}
+	c.balanceProtected()
+	// an update may still have grown the main cache
+	for c.full(0) {
+		c.evict(c.victim(&c.probation, &c.protected, &c.window))
+	}
+}
+
+func (c *TinyLFU) Remove(key string) bool {
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+		return true
+	}
+	return false
+}
+
+// Walk visits the entries the most frequent first according to the sketch,
+// then the protected ones, the ones on probation and in the window.
+func (c *TinyLFU) Walk(fn func(key string, value Value) bool) {
+	entries := make([]*entry, 0, len(c.items))
+	c.walk(func(key string, value Value) bool {
+		entries = append(entries, c.items[key])
+		return true
+	}, &c.protected, &c.probation, &c.window)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return c.sketch.estimate(entries[i].key) > c.sketch.estimate(entries[j].key)
+	})
+	for _, e := range entries {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+func (c *TinyLFU) RemoveExpired() int {
+	return c.removeExpired(c.remove)
+}
+
+// admit moves the candidate leaving the window to probation, if it is more
+// frequent than every entry it has to evict. The main cache may use the room
+// the window leaves free, the candidate is already counted in curBytes.
+func (c *TinyLFU) admit(candidate *entry) {
+	freq := c.sketch.estimate(candidate.key)
+	for c.full(0) {
+		victim := c.victim(&c.probation, &c.protected)
+		if victim == nil || freq <= c.sketch.estimate(victim.key) {
+			c.evict(candidate)
+			return
+		}
+		c.evict(victim)
+	}
+	c.link(candidate, segProbation)
+}
+
+// victim returns the LRU entry of the first non empty list.
+func (c *TinyLFU) victim(lists ...*list.List) *entry {
+	for _, l := range lists {
+		if back := l.Back(); back != nil {
+			return back.Value.(*entry)
+		}
+	}
+	return nil
+}
+
+// balanceProtected demotes the LRU protected entries over budget to probation.
+func (c *TinyLFU) balanceProtected() {
+	for c.protectedBytes > c.protectedMax && c.protected.Len() > 0 {
+		e := c.protected.Back().Value.(*entry)
+		c.unlink(e)
+		c.link(e, segProbation)
+	}
+}
+
+func (c *TinyLFU) evict(e *entry) {
+	c.remove(e)
+	c.evictions++
+}
+
+func (c *TinyLFU) link(e *entry, segment int) {
+	e.segment = segment
+	switch segment {
+	case segWindow:
+		e.elem = c.window.PushFront(e)
+		c.windowBytes += e.size()
+	case segProbation:
+		e.elem = c.probation.PushFront(e)
+		c.probationBytes += e.size()
+	case segProtected:
+		e.elem = c.protected.PushFront(e)
+		c.protectedBytes += e.size()
+	}
+}
+
+func (c *TinyLFU) unlink(e *entry) {
+	switch e.segment {
+	case segWindow:
+		c.window.Remove(e.elem)
+		c.windowBytes -= e.size()
+	case segProbation:
+		c.probation.Remove(e.elem)
+		c.probationBytes -= e.size()
+	case segProtected:
+		c.protected.Remove(e.elem)
+		c.protectedBytes -= e.size()
+	}
+	e.segment = segNone
+	e.elem = nil
+}
+
+func (c *TinyLFU) remove(e *entry) {
+	c.unlink(e)
+	c.forget(e)
+}
+
+const (
+	cmDepth       = 4
+	cmMaxCounter  = 15
+	cmMinWidth    = 1 << 10
+	cmMaxWidth    = 1 << 20
+	cmSampleRatio = 10 // counters are halved every cmSampleRatio*width additions
+)
+
+// cmSketch is a count-min sketch of 4 bit counters which ages by halving
+// them periodically, so the estimates follow the recent popularity.
+type cmSketch struct {
+	rows      [cmDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCMSketch(width int) *cmSketch {
+	w := cmMinWidth
+	for w < width && w < cmMaxWidth {
+		w <<= 1
+	}
+	s := &cmSketch{mask: uint64(w - 1), resetAt: cmSampleRatio * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *cmSketch) add(key string) {
+	h1, h2 := sketchHash(key)
+	for i := range s.rows {
+		idx := (h1 + uint64(i)*h2) & s.mask
+		if s.rows[i][idx] < cmMaxCounter {
+			s.rows[i][idx]++
+		}
+	}
+	if s.additions++; s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *cmSketch) estimate(key string) uint8 {
+	h1, h2 := sketchHash(key)
+	min := uint8(cmMaxCounter)
+	for i := range s.rows {
+		if v := s.rows[i][(h1+uint64(i)*h2)&s.mask]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+func sketchHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>32 | 1
+}
@@ -0,0 +1,122 @@
+package eviction
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+The benchmarks replay access traces against every policy and report the hit
+ratio. A recorded trace, one key per line, is replayed as well when its path
+is set in ALO_EVICTION_TRACE:
+
+	ALO_EVICTION_TRACE=trace.txt go test -run=^$ -bench=HitRatio ./pkg/eviction
+*/
+
+const (
+	traceLen     = 200000
+	traceKeys    = 20000
+	traceEntries = 1000 // cache size in entries of traceValue
+)
+
+var traceValue = String("0123456789abcdef")
+
+func zipfTrace(r *rand.Rand, n int) []string {
+	z := rand.NewZipf(r, 1.1, 1, traceKeys-1)
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("k%d", z.Uint64())
+	}
+	return trace
+}
+
+// zipfScanTrace interleaves zipf accesses with scans of keys never seen again.
+func zipfScanTrace(r *rand.Rand) []string {
+	trace := zipfTrace(r, traceLen)
+	for i := 0; i < len(trace); i += 10000 {
+		for j := 0; j < 2000 && i+j < len(trace); j++ {
+			trace[i+j] = fmt.Sprintf("scan%d-%d", i, j)
+		}
+	}
+	return trace
+}
+
+// loopTrace cycles over slightly more keys than fit the cache, the worst case of LRU.
+func loopTrace() []string {
+	trace := make([]string, traceLen)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("k%d", i%(traceEntries*5/4))
+	}
+	return trace
+}
+
+func readTrace(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			trace = append(trace, key)
+		}
+	}
+	return trace, scanner.Err()
+}
+
+// hitRatio replays the trace, every miss adds the key.
+func hitRatio(c Policy, trace []string) float64 {
+	hits := 0
+	for _, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+			continue
+		}
+		c.AddWithExpire(key, traceValue, time.Time{})
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func BenchmarkHitRatio(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"zipf", zipfTrace(r, traceLen)},
+		{"zipf+scan", zipfScanTrace(r)},
+		{"loop", loopTrace()},
+	}
+	if path := os.Getenv("ALO_EVICTION_TRACE"); path != "" {
+		trace, err := readTrace(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		traces = append(traces, struct {
+			name  string
+			trace []string
+		}{"recorded", trace})
+	}
+
+	for _, tr := range traces {
+		for _, name := range policies() {
+			b.Run(tr.name+"/"+name, func(b *testing.B) {
+				// keys are about 6 bytes, the budget holds traceEntries entries
+				maxBytes := int64(traceEntries * (traceValue.Len() + 6))
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = hitRatio(Factories[name](maxBytes), tr.trace)
+				}
+				b.ReportMetric(100*ratio, "hit%")
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(tr.trace)), "ns/access")
+			})
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+	consistenthash "github.com/alo-distributed-memcached/pkg/consistent_hash"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+1. GRPCPool implements PeerPicker interface.
+It plays the same role as HTTPPool, but the peers are addressed by "host:port"
+and every peer is reached through one long-lived gRPC (HTTP/2) connection.
+2. GRPCPool implements pb.GroupCacheServer interface.
+It will handle the Get rpc from other node and return the data to the other node.
+*/
+type GRPCPool struct {
+	pb.UnimplementedGroupCacheServer
+
+	self       string // store it owns host and port, e.g. "10.0.0.2:8008"
+	mu         sync.Mutex
+	peers      *consistenthash.ConsistentHashMap
+	grpcGetter map[string]*GRPCGetter // keyed by e.g. "10.0.0.2:8008"
+	breakers   peerBreakers
+	server     *grpc.Server
+	watchers   []func()    // called when peers join, see WatchRing
+	draining   atomic.Bool // set by Drain, the rpc of other nodes are turned away
+	stopped    bool        // set by Stop, the peers are no longer changed
+	// getGroup resolves the group named in an incoming request, GetGroup by default.
+	getGroup func(name string) *Group
+}
+
+func NewGRPCPool(self string) *GRPCPool {
+	return &GRPCPool{
+		self:     self,
+		breakers: peerBreakers{self: self, cfg: DefaultBreakerConfig},
+		getGroup: GetGroup,
+	}
+}
+
+// SetBreakerConfig sets the circuit breakers of the peers, a zero config
+// disables them. It applies to the peers set afterwards, call it before SetPeers.
+func (p *GRPCPool) SetBreakerConfig(cfg BreakerConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breakers = peerBreakers{self: p.self, cfg: cfg}
+}
+
+// Breakers returns the state of the circuit breaker of every peer.
+func (p *GRPCPool) Breakers() []BreakerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.breakers.statuses()
+}
+
+func (p *GRPCPool) SetPeers(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	for _, getter := range p.grpcGetter {
+		getter.Close()
+	}
+
+	p.peers = consistenthash.NewConsistentHashMap(defaultReplicas, nil)
+	p.peers.AddNode(peers...)
+	p.grpcGetter = make(map[string]*GRPCGetter)
+
+	kept := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		p.addGetter(peer)
+		kept[peer] = true
+	}
+	p.breakers.keep(kept)
+	notifyRing(p.watchers)
+}
+
+// WatchRing calls fn every time peers are added, see RingWatcher.
+func (p *GRPCPool) WatchRing(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watchers = append(p.watchers, fn)
+}
+
+// AddPeer adds peers to the running pool, only the keys the ring reassigns
+// to the new peers change their owner. It does nothing once the pool is stopped.
+func (p *GRPCPool) AddPeer(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return
+	}
+	if p.peers == nil {
+		p.peers = consistenthash.NewConsistentHashMap(defaultReplicas, nil)
+		p.grpcGetter = make(map[string]*GRPCGetter)
+	}
+	added := false
+	for _, peer := range peers {
+		if _, ok := p.grpcGetter[peer]; ok {
+			continue
+		}
+		if p.addGetter(peer) {
+			p.peers.AddNode(peer)
+			added = true
+		}
+	}
+	if added {
+		notifyRing(p.watchers)
+	}
+}
+
+// RemovePeer removes peers from the running pool and closes their connections.
+func (p *GRPCPool) RemovePeer(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, peer := range peers {
+		getter, ok := p.grpcGetter[peer]
+		if !ok {
+			continue
+		}
+		p.peers.RemoveNode(peer)
+		getter.Close()
+		delete(p.grpcGetter, peer)
+		p.breakers.remove(peer)
+	}
+}
+
+// Peers returns the sorted addresses of all peers, the current node included.
+func (p *GRPCPool) Peers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := make([]string, 0, len(p.grpcGetter))
+	for peer := range p.grpcGetter {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// addGetter dials the peer, the connection is established lazily by gRPC.
+func (p *GRPCPool) addGetter(peer string) bool {
+	getter, err := NewGRPCGetter(peer)
+	if err != nil {
+		p.log("dial peer %s: %v", peer, err)
+		return false
+	}
+	getter.breaker = p.breakers.get(peer)
+	p.grpcGetter[peer] = getter
+	return true
+}
+
+var _ PeerPicker = (*GRPCPool)(nil)
+var _ PeerManager = (*GRPCPool)(nil)
+var _ ReplicaPicker = (*GRPCPool)(nil)
+var _ BreakerReporter = (*GRPCPool)(nil)
+var _ RingWatcher = (*GRPCPool)(nil)
+var _ DrainablePool = (*GRPCPool)(nil)
+
+// PickReplicas returns the getters of the n nodes holding the key, nil for the current node.
+func (p *GRPCPool) PickReplicas(key string, n int) []PeerGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil {
+		return nil
+	}
+	var replicas []PeerGetter
+	for _, peer := range p.peers.GetNodes(key, n) {
+		if peer == p.self {
+			replicas = append(replicas, nil)
+		} else if getter, ok := p.grpcGetter[peer]; ok {
+			replicas = append(replicas, getter)
+		}
+	}
+	return replicas
+}
+
+// PickPeer() picks the owner of the key from the consistent hash ring,
+// return the GRPCGetter of that node when it is not the current node.
+func (p *GRPCPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.peers.GetNode(key); peer != "" && peer != p.self {
+		if getter, ok := p.grpcGetter[peer]; ok {
+			if getter.breaker != nil && !getter.breaker.available() {
+				// load locally rather than wait for a peer known to fail
+				p.log("skip unhealthy peer %s", peer)
+				return nil, false
+			}
+			p.log("pick peer %s", peer)
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+var _ pb.GroupCacheServer = (*GRPCPool)(nil)
+
+// group resolves the group of an rpc of another node, the rpc are turned
+// away while the node drains.
+func (p *GRPCPool) group(name string) (*Group, error) {
+	if p.draining.Load() {
+		// the caller loads the key itself, see fallbackOnPeerError
+		return nil, fmt.Errorf("%w: %s is draining", ErrOverloaded, p.self)
+	}
+	group := p.getGroup(name)
+	if group == nil {
+		return nil, fmt.Errorf("%w: %s", ErrGroupUnknown, name)
+	}
+	return group, nil
+}
+
+// Get implements pb.GroupCacheServer, the gRPC counterpart of HTTPPool.ServeHTTP.
+func (p *GRPCPool) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	p.log("Get %s/%s", in.GetGroup(), in.GetKey())
+
+	group, err := p.group(in.GetGroup())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	view, err := group.GetContext(ctx, in.GetKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return viewToResponse(view), nil
+}
+
+// Set implements pb.GroupCacheServer, the gRPC counterpart of PUT on HTTPPool.
+func (p *GRPCPool) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetResponse, error) {
+	p.log("Set %s/%s", in.GetGroup(), in.GetKey())
+
+	group, err := p.group(in.GetGroup())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	ttl := time.Duration(in.GetTtlMs()) * time.Millisecond
+	if err := group.handleSet(ctx, in.GetKey(), in.GetValue(), in.GetFlags(), ttl, in.GetReplica()); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pb.SetResponse{}, nil
+}
+
+// Delete implements pb.GroupCacheServer, the gRPC counterpart of DELETE on HTTPPool.
+func (p *GRPCPool) Delete(ctx context.Context, in *pb.Request) (*pb.DeleteResponse, error) {
+	p.log("Delete %s/%s", in.GetGroup(), in.GetKey())
+
+	group, err := p.group(in.GetGroup())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	deleted, err := group.handleDelete(ctx, in.GetKey(), in.GetReplica())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pb.DeleteResponse{Deleted: deleted}, nil
+}
+
+// GetMulti implements pb.GroupCacheServer, the gRPC counterpart of POST on HTTPPool.
+func (p *GRPCPool) GetMulti(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	p.log("GetMulti %s %d keys", in.GetGroup(), len(in.GetKeys()))
+
+	group, err := p.group(in.GetGroup())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return batchResponse(group.GetMultiContext(ctx, in.GetKeys())), nil
+}
+
+// Handoff implements pb.GroupCacheServer, the gRPC counterpart of PUT without key on HTTPPool.
+func (p *GRPCPool) Handoff(ctx context.Context, in *pb.HandoffRequest) (*pb.HandoffResponse, error) {
+	p.log("Handoff %s %d entries", in.GetGroup(), len(in.GetEntries()))
+
+	group, err := p.group(in.GetGroup())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pb.HandoffResponse{Stored: group.storeHandoff(in.GetEntries())}, nil
+}
+
+// Serve registers the pool as GroupCache service and serves the rpc on lis.
+// It blocks until Stop() is called or lis fails.
+func (p *GRPCPool) Serve(lis net.Listener) error {
+	return p.grpcServer().Serve(lis)
+}
+
+// grpcServer returns the gRPC server of the pool, created on first use. Once
+// stopped it stays so, and Serve returns grpc.ErrServerStopped.
+func (p *GRPCPool) grpcServer() *grpc.Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server == nil {
+		p.server = grpc.NewServer()
+		pb.RegisterGroupCacheServer(p.server, p)
+	}
+	return p.server
+}
+
+// Self returns the address of the current node in the ring.
+func (p *GRPCPool) Self() string {
+	return p.self
+}
+
+// Drain answers the rpc of other nodes OVERLOADED from now on, see Node.
+func (p *GRPCPool) Drain() {
+	p.draining.Store(true)
+}
+
+// Shutdown stops the gRPC server once the rpc in flight are answered, or at
+// once when ctx is done, and closes the connections to all peers.
+func (p *GRPCPool) Shutdown(ctx context.Context) error {
+	// a Serve called after is stopped too
+	server := p.grpcServer()
+	var err error
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// Stop ends GracefulStop too
+		server.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+	p.Stop()
+	return err
+}
+
+// Stop stops the gRPC server for good and closes the connections to all peers.
+func (p *GRPCPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		p.server.Stop()
+	}
+	for _, getter := range p.grpcGetter {
+		getter.Close()
+	}
+	p.peers = nil
+	p.grpcGetter = nil
+	p.stopped = true
+}
+
+func (p *GRPCPool) log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+/*
+GRPCGetter implements PeerGetter interface and uses gRPC to get data from other nodes.
+The underlying connection is created once and reused by every request.
+*/
+type GRPCGetter struct {
+	conn    *grpc.ClientConn
+	client  pb.GroupCacheClient
+	breaker *circuitBreaker // nil when the pool has no breakers
+}
+
+func NewGRPCGetter(addr string) (*GRPCGetter, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCGetter{
+		conn:   conn,
+		client: pb.NewGroupCacheClient(conn),
+	}, nil
+}
+
+func (g *GRPCGetter) GetDataFromPeer(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	var res *pb.Response
+	err := g.breaker.call(ctx, func() (err error) {
+		res, err = g.client.Get(ctx, in)
+		return peerErrorFromGRPC(err)
+	})
+	if err != nil {
+		return fmt.Errorf("GetDataFromPeer(): %w", err)
+	}
+
+	proto.Reset(out)
+	proto.Merge(out, res)
+	return nil
+}
+
+func (g *GRPCGetter) SetDataToPeer(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	var res *pb.SetResponse
+	err := g.breaker.call(ctx, func() (err error) {
+		res, err = g.client.Set(ctx, in)
+		return peerErrorFromGRPC(err)
+	})
+	if err != nil {
+		return fmt.Errorf("SetDataToPeer(): %w", err)
+	}
+
+	proto.Reset(out)
+	proto.Merge(out, res)
+	return nil
+}
+
+func (g *GRPCGetter) DeleteDataFromPeer(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	var res *pb.DeleteResponse
+	err := g.breaker.call(ctx, func() (err error) {
+		res, err = g.client.Delete(ctx, in)
+		return peerErrorFromGRPC(err)
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteDataFromPeer(): %w", err)
+	}
+
+	proto.Reset(out)
+	proto.Merge(out, res)
+	return nil
+}
+
+func (g *GRPCGetter) GetMultiFromPeer(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	var res *pb.BatchResponse
+	err := g.breaker.call(ctx, func() (err error) {
+		res, err = g.client.GetMulti(ctx, in)
+		return peerErrorFromGRPC(err)
+	})
+	if err != nil {
+		return fmt.Errorf("GetMultiFromPeer(): %w", err)
+	}
+
+	proto.Reset(out)
+	proto.Merge(out, res)
+	return nil
+}
+
+func (g *GRPCGetter) HandOffToPeer(ctx context.Context, in *pb.HandoffRequest, out *pb.HandoffResponse) error {
+	var res *pb.HandoffResponse
+	err := g.breaker.call(ctx, func() (err error) {
+		res, err = g.client.Handoff(ctx, in)
+		return peerErrorFromGRPC(err)
+	})
+	if err != nil {
+		return fmt.Errorf("HandOffToPeer(): %w", err)
+	}
+
+	proto.Reset(out)
+	proto.Merge(out, res)
+	return nil
+}
+
+// Close closes the connection to the peer.
+func (g *GRPCGetter) Close() error {
+	return g.conn.Close()
+}
+
+var _ PeerGetter = (*GRPCGetter)(nil)
+var _ BatchPeerGetter = (*GRPCGetter)(nil)
+var _ HandoffPeerGetter = (*GRPCGetter)(nil)
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// testNode is an in-process cache node with its own group, so that several
+// nodes sharing the same group name can live in one test binary.
+type testNode struct {
+	addr  string
+	group *Group
+
+	mu    sync.Mutex
+	loads map[string]int // number of times the local getter loaded each key
+	stop  func()         // stops serving peer requests
+}
+
+func newTestNode(t *testing.T, groupName string, opts ...GroupOption) (*testNode, net.Listener) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{addr: lis.Addr().String(), loads: make(map[string]int)}
+	n.group = newGroup(groupName, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		n.mu.Lock()
+		n.loads[key]++
+		n.mu.Unlock()
+		switch {
+		case strings.HasPrefix(key, "missing"):
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		case strings.HasPrefix(key, "overloaded"):
+			return nil, fmt.Errorf("%s: %w", key, ErrOverloaded)
+		case strings.HasPrefix(key, "broken"):
+			return nil, fmt.Errorf("%s: backing store failed", key)
+		}
+		return []byte("value-" + key), nil
+	}), opts...)
+	return n, lis
+}
+
+func (n *testNode) lookup(name string) *Group {
+	if name == n.group.name {
+		return n.group
+	}
+	return nil
+}
+
+func (n *testNode) loadCount(key string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.loads[key]
+}
+
+func startGRPCNodes(t *testing.T, groupName string, count int, opts ...GroupOption) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, count)
+	lises := make([]net.Listener, count)
+	addrs := make([]string, count)
+	for i := range nodes {
+		nodes[i], lises[i] = newTestNode(t, groupName, opts...)
+		addrs[i] = nodes[i].addr
+	}
+	for i, n := range nodes {
+		pool := NewGRPCPool(n.addr)
+		pool.getGroup = n.lookup
+		pool.SetPeers(addrs...)
+		n.group.RegisterPeerPicker(pool)
+		go pool.Serve(lises[i])
+		n.stop = pool.Stop
+		t.Cleanup(pool.Stop)
+	}
+	return nodes
+}
+
+func TestGRPCPoolRoutesToOwner(t *testing.T) {
+	nodes := startGRPCNodes(t, "grpc-scores", 3)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		view, err := nodes[0].group.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		if view.String() != "value-"+key {
+			t.Fatalf("Get(%q) = %q", key, view.String())
+		}
+
+		loaded := 0
+		for _, n := range nodes {
+			loaded += n.loadCount(key)
+		}
+		if loaded != 1 {
+			t.Fatalf("key %q loaded %d times, want exactly once on its owner", key, loaded)
+		}
+	}
+
+	// Every node should own part of the key space.
+	for i, n := range nodes {
+		total := 0
+		for i := 0; i < 30; i++ {
+			total += n.loadCount(fmt.Sprintf("key-%d", i))
+		}
+		if total == 0 {
+			t.Errorf("node %d (%s) owns no key", i, n.addr)
+		}
+	}
+}
+
+func TestGRPCPoolWritePath(t *testing.T) {
+	testWritePath(t, startGRPCNodes(t, "grpc-write", 3))
+}
+
+func TestGRPCAndHTTPTransportsInteroperate(t *testing.T) {
+	node, grpcLis := newTestNode(t, "interop")
+	grpcPool := NewGRPCPool(node.addr)
+	grpcPool.getGroup = node.lookup
+	go grpcPool.Serve(grpcLis)
+	t.Cleanup(grpcPool.Stop)
+
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPool := NewHTTPPool("http://" + httpLis.Addr().String())
+	httpPool.getGroup = node.lookup
+	server := &http.Server{Handler: httpPool}
+	go server.Serve(httpLis)
+	t.Cleanup(func() { server.Close() })
+
+	grpcGetter, err := NewGRPCGetter(node.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grpcGetter.Close()
+	httpGetter := &HTTPGetter{baseURL: "http://" + httpLis.Addr().String() + defaultBasePath}
+
+	for _, peer := range []PeerGetter{grpcGetter, httpGetter} {
+		res := &pb.Response{}
+		if err := peer.GetDataFromPeer(context.Background(), &pb.Request{Group: "interop", Key: "Tom"}, res); err != nil {
+			t.Fatalf("%T: %v", peer, err)
+		}
+		if string(res.GetValue()) != "value-Tom" {
+			t.Fatalf("%T returned %q", peer, res.GetValue())
+		}
+	}
+	if n := node.loadCount("Tom"); n != 1 {
+		t.Fatalf("Tom loaded %d times, want the second transport to hit the cache", n)
+	}
+
+	res := &pb.Response{}
+	if err := grpcGetter.GetDataFromPeer(context.Background(), &pb.Request{Group: "unknown", Key: "Tom"}, res); err == nil {
+		t.Fatalf("expected error for unknown group")
+	}
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minLatencySamples is the number of peer latencies observed before the hedge
+// delay follows their percentile instead of the minimum delay.
+const minLatencySamples = 16
+
+// WithPeerRetries retries a get which failed to reach the peer up to retries
+// times, waiting backoff before the first retry and twice longer before each
+// next one, with jitter. Answers of the peer, e.g. not found or overloaded,
+// and peers whose circuit breaker is open are not retried.
+func WithPeerRetries(retries int, backoff time.Duration) GroupOption {
+	return func(g *Group) {
+		g.peerRetries = retries
+		g.retryBackoff = backoff
+	}
+}
+
+// WithHedging sends a second request when a peer get has not answered within
+// the given percentile, e.g. 0.95, of the latencies of the recent peer gets,
+// and no sooner than minDelay. The hedge goes to the next replica, or to the
+// getter of the current node without replicas. The first value wins and the
+// other request is cancelled.
+func WithHedging(percentile float64, minDelay time.Duration) GroupOption {
+	return func(g *Group) {
+		g.hedgePercentile = percentile
+		g.hedgeMinDelay = minDelay
+		g.peerLatency = &latencyTracker{}
+	}
+}
+
+// getFromPeerWithRetries is getFromPeer retried as set by WithPeerRetries.
+func (g *Group) getFromPeerWithRetries(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
+	view, err := g.getFromPeer(ctx, peer, key)
+	for attempt := 0; attempt < g.peerRetries && retryablePeerError(err); attempt++ {
+		if !sleepContext(ctx, backoff(g.retryBackoff, attempt)) {
+			return ByteView{}, ctx.Err()
+		}
+		g.Stats.PeerRetries.Add(1)
+		view, err = g.getFromPeer(ctx, peer, key)
+	}
+	return view, err
+}
+
+// retryablePeerError reports whether err is a failure to reach the peer,
+// which another attempt may not hit.
+func retryablePeerError(err error) bool {
+	if err == nil || errors.Is(err, ErrPeerUnavailable) {
+		return false
+	}
+	var pe *PeerError
+	return !errors.As(err, &pe)
+}
+
+// backoff returns the wait before the retry following attempt, between
+// half and all of base doubled attempt times.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << attempt
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits d, it returns false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// hedgedGet runs primary, and backup too if primary has not answered within
+// the hedge delay. It returns the first value, a failure of the primary which
+// does not fall back is returned as is, see fallbackOnPeerError. hedged
+// reports whether backup ran, in which case its error is returned when both
+// failed. Without hedging or backup, it is primary.
+func (g *Group) hedgedGet(ctx context.Context, primary, backup func(context.Context) (ByteView, error)) (view ByteView, hedged bool, err error) {
+	if g.peerLatency == nil || backup == nil {
+		view, err = primary(ctx)
+		return view, false, err
+	}
+
+	// cancels the loser
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		view   ByteView
+		err    error
+		backup bool
+	}
+	results := make(chan result, 2)
+	run := func(get func(context.Context) (ByteView, error), backup bool) {
+		view, err := get(ctx)
+		results <- result{view, err, backup}
+	}
+	go run(primary, false)
+	timer := time.NewTimer(g.hedgeDelay())
+	defer timer.Stop()
+
+	pending := 1
+	var backupErr error
+	for {
+		select {
+		case <-timer.C:
+			hedged = true
+			pending++
+			g.Stats.HedgesFired.Add(1)
+			go run(backup, true)
+		case r := <-results:
+			pending--
+			switch {
+			case r.err == nil:
+				if r.backup {
+					g.Stats.HedgesWon.Add(1)
+				}
+				return r.view, hedged, nil
+			case r.backup:
+				backupErr = r.err
+			case !hedged || !fallbackOnPeerError(r.err):
+				return ByteView{}, hedged, r.err
+			}
+			if pending == 0 {
+				return ByteView{}, true, backupErr
+			}
+		}
+	}
+}
+
+// hedgeDelay returns how long a peer get runs before it is hedged.
+func (g *Group) hedgeDelay() time.Duration {
+	if d, ok := g.peerLatency.percentile(g.hedgePercentile); ok && d > g.hedgeMinDelay {
+		return d
+	}
+	return g.hedgeMinDelay
+}
+
+// latencyTracker keeps the latencies of the recent peer gets.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [128]time.Duration
+	n       int // samples observed, the oldest are overwritten
+}
+
+func (l *latencyTracker) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.n%len(l.samples)] = d
+	l.n++
+}
+
+// percentile returns the p-th percentile, 0 < p <= 1, of the recent samples,
+// false until enough were observed.
+func (l *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	n := min(l.n, len(l.samples))
+	if n < minLatencySamples {
+		l.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, l.samples[:n])
+	l.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(n)+0.5) - 1
+	return sorted[max(0, min(i, n-1))], true
+}
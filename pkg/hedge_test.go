@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// slowPeer answers "peer-<key>" after delay, the first fails requests fail
+// to reach it.
+type slowPeer struct {
+	delay     time.Duration
+	fails     atomic.Int32
+	calls     atomic.Int32
+	cancelled atomic.Int32
+	notFound  bool
+}
+
+func (p *slowPeer) GetDataFromPeer(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	p.calls.Add(1)
+	if p.fails.Add(-1) >= 0 {
+		return errors.New("connection refused")
+	}
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		p.cancelled.Add(1)
+		return ctx.Err()
+	}
+	if p.notFound {
+		out.Code = pb.ErrorCode_NOT_FOUND
+		return nil
+	}
+	out.Value = []byte("peer-" + in.GetKey())
+	return nil
+}
+
+func (p *slowPeer) SetDataToPeer(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	return nil
+}
+
+func (p *slowPeer) DeleteDataFromPeer(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	return nil
+}
+
+// replicaPicker makes the peers, then the current node, the replicas of every key.
+type replicaPicker []PeerGetter
+
+func (p replicaPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p[0], true
+}
+
+func (p replicaPicker) PickReplicas(key string, n int) []PeerGetter {
+	return append(append([]PeerGetter{}, p...), nil)
+}
+
+func newHedgeGroup(name string, picker PeerPicker, opts ...GroupOption) *Group {
+	g := newGroup(name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("local-" + key), nil
+	}), opts...)
+	g.RegisterPeerPicker(picker)
+	return g
+}
+
+func TestPeerRetries(t *testing.T) {
+	peer := &slowPeer{}
+	peer.fails.Store(2)
+	g := newHedgeGroup("retries", replicaPicker{peer}, WithPeerRetries(2, time.Millisecond))
+
+	if view, err := g.Get("Tom"); err != nil || view.String() != "peer-Tom" {
+		t.Fatalf("Get = %q, %v", view.String(), err)
+	}
+	if peer.calls.Load() != 3 || g.Stats.PeerRetries.Get() != 2 {
+		t.Fatalf("calls=%d retries=%d, want 3 and 2", peer.calls.Load(), g.Stats.PeerRetries.Get())
+	}
+
+	// answers of the peer are not retried
+	missing := &slowPeer{notFound: true}
+	g = newHedgeGroup("retries-missing", replicaPicker{missing}, WithPeerRetries(2, time.Millisecond))
+	if _, err := g.Get("Tom"); !errors.Is(err, ErrNotFound) || missing.calls.Load() != 1 {
+		t.Fatalf("Get = %v after %d calls, want ErrNotFound after 1", err, missing.calls.Load())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, base := range []time.Duration{10, 20, 40} {
+		for i := 0; i < 100; i++ {
+			d := backoff(10*time.Millisecond, attempt)
+			if d < base*time.Millisecond/2 || d > base*time.Millisecond {
+				t.Fatalf("backoff of attempt %d = %v, want within [%v, %v]", attempt, d, base*time.Millisecond/2, base*time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestHedgeToLocal(t *testing.T) {
+	peer := &slowPeer{delay: time.Second}
+	g := newHedgeGroup("hedge-local", replicaPicker{peer}, WithHedging(0.95, 20*time.Millisecond))
+
+	start := time.Now()
+	if view, err := g.Get("Tom"); err != nil || view.String() != "local-Tom" {
+		t.Fatalf("Get = %q, %v, want the local value", view.String(), err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged Get took %v", elapsed)
+	}
+	if g.Stats.HedgesFired.Get() != 1 || g.Stats.HedgesWon.Get() != 1 {
+		t.Fatalf("hedges fired=%d won=%d, want 1 and 1", g.Stats.HedgesFired.Get(), g.Stats.HedgesWon.Get())
+	}
+	eventually(t, time.Second, func() bool {
+		return peer.cancelled.Load() == 1
+	}, "the slow peer request was not cancelled")
+}
+
+func TestHedgeNotFired(t *testing.T) {
+	peer := &slowPeer{}
+	g := newHedgeGroup("hedge-fast", replicaPicker{peer}, WithHedging(0.95, 50*time.Millisecond))
+	if view, err := g.Get("Tom"); err != nil || view.String() != "peer-Tom" {
+		t.Fatalf("Get = %q, %v", view.String(), err)
+	}
+	if g.Stats.HedgesFired.Get() != 0 {
+		t.Fatalf("hedged a fast peer")
+	}
+}
+
+func TestHedgeToReplica(t *testing.T) {
+	primary, secondary := &slowPeer{delay: time.Second}, &slowPeer{}
+	g := newHedgeGroup("hedge-replica", replicaPicker{primary, secondary},
+		WithReplicas(3), WithHedging(0.95, 20*time.Millisecond))
+
+	if view, err := g.Get("Tom"); err != nil || view.String() != "peer-Tom" {
+		t.Fatalf("Get = %q, %v, want the value of the second replica", view.String(), err)
+	}
+	if secondary.calls.Load() != 1 || g.Stats.HedgesWon.Get() != 1 {
+		t.Fatalf("second replica called %d times, %d hedges won", secondary.calls.Load(), g.Stats.HedgesWon.Get())
+	}
+	eventually(t, time.Second, func() bool {
+		return primary.cancelled.Load() == 1
+	}, "the slow replica request was not cancelled")
+}
+
+func TestHedgeDelay(t *testing.T) {
+	g := newGroup("hedge-delay", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	}), WithHedging(0.9, 5*time.Millisecond))
+
+	if d := g.hedgeDelay(); d != 5*time.Millisecond {
+		t.Fatalf("delay without samples = %v, want the minimum", d)
+	}
+	for i := 1; i <= 100; i++ {
+		g.peerLatency.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := g.hedgeDelay(); d != 90*time.Millisecond {
+		t.Fatalf("delay = %v, want the 90th percentile", d)
+	}
+}
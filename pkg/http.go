@@ -1,11 +1,17 @@
 package pkg
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alo-distributed-memcached/pb"
 	consistenthash "github.com/alo-distributed-memcached/pkg/consistent_hash"
@@ -15,6 +21,9 @@ import (
 const (
 	defaultBasePath = "/alo-cache/"
 	defaultReplicas = 50
+	// DefaultMaxBodyBytes bounds the body of a request of another node, see
+	// SetMaxBodyBytes.
+	DefaultMaxBodyBytes = 32 << 20
 )
 
 /*
@@ -30,15 +39,65 @@ type HTTPPool struct {
 	mu         sync.Mutex
 	peers      *consistenthash.ConsistentHashMap
 	httpGetter map[string]*HTTPGetter // keyed by e.g. "http://10.0.0.2:8008"
+	breakers   peerBreakers
+	client     *http.Client // shared by the getters of every peer
+	serverTLS  *tls.Config  // set by SetTLS
+	signer     *requestSigner
+	maxBody    int64       // bytes read from the body of a request, see SetMaxBodyBytes
+	draining   atomic.Bool // set by Drain, requests of other nodes are turned away
+	watchers   []func()    // called when peers join, see WatchRing
+	// getGroup resolves the group named in an incoming request, GetGroup by default.
+	getGroup func(name string) *Group
 }
 
 func NewHTTPPool(self string) *HTTPPool {
 	return &HTTPPool{
 		self:     self,
 		basePath: defaultBasePath,
+		breakers: peerBreakers{self: self, cfg: DefaultBreakerConfig},
+		client:   NewHTTPClient(DefaultHTTPClientConfig),
+		maxBody:  DefaultMaxBodyBytes,
+		getGroup: GetGroup,
 	}
 }
 
+// SetMaxBodyBytes bounds the body of the requests of other nodes, larger
+// ones are answered 413 before their signature is checked. It must be above
+// the largest value stored and the handoff batches, see WithRebalance.
+func (h *HTTPPool) SetMaxBodyBytes(n int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxBody = n
+}
+
+// SetHTTPClient sets the client reaching the peers, see NewHTTPClient.
+// The requests in flight finish on the previous client.
+func (h *HTTPPool) SetHTTPClient(client *http.Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.setClient(client)
+}
+
+// SetBreakerConfig sets the circuit breakers of the peers, a zero config
+// disables them. It applies to the peers set afterwards, call it before SetPeers.
+func (h *HTTPPool) SetBreakerConfig(cfg BreakerConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.breakers = peerBreakers{self: h.self, cfg: cfg}
+}
+
+// Breakers returns the state of the circuit breaker of every peer.
+func (h *HTTPPool) Breakers() []BreakerStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.breakers.statuses()
+}
+
+func (h *HTTPPool) newGetter(peer string) *HTTPGetter {
+	return &HTTPGetter{baseURL: peer + h.basePath, client: h.client, breaker: h.breakers.get(peer)}
+}
+
 func (h *HTTPPool) SetPeers(peers ...string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -47,17 +106,164 @@ func (h *HTTPPool) SetPeers(peers ...string) {
 	h.peers.AddNode(peers...)
 	h.httpGetter = make(map[string]*HTTPGetter)
 
+	kept := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		h.httpGetter[peer] = h.newGetter(peer)
+		kept[peer] = true
+	}
+	h.breakers.keep(kept)
+	notifyRing(h.watchers)
+}
+
+// Self returns the address of the current node in the ring.
+func (h *HTTPPool) Self() string {
+	return h.self
+}
+
+// Drain answers the requests of other nodes OVERLOADED from now on, see Node.
+func (h *HTTPPool) Drain() {
+	h.draining.Store(true)
+}
+
+// WatchRing calls fn every time peers are added, see RingWatcher.
+func (h *HTTPPool) WatchRing(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchers = append(h.watchers, fn)
+}
+
+// AddPeer adds peers to the running pool, only the keys the ring reassigns
+// to the new peers change their owner.
+func (h *HTTPPool) AddPeer(peers ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.peers == nil {
+		h.peers = consistenthash.NewConsistentHashMap(defaultReplicas, nil)
+		h.httpGetter = make(map[string]*HTTPGetter)
+	}
+	added := false
 	for _, peer := range peers {
-		h.httpGetter[peer] = &HTTPGetter{baseURL: peer + h.basePath}
+		if _, ok := h.httpGetter[peer]; ok {
+			continue
+		}
+		h.peers.AddNode(peer)
+		h.httpGetter[peer] = h.newGetter(peer)
+		added = true
+	}
+	if added {
+		notifyRing(h.watchers)
 	}
 }
 
+// RemovePeer removes peers from the running pool, their keys move to the
+// next peers on the ring.
+func (h *HTTPPool) RemovePeer(peers ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, peer := range peers {
+		if _, ok := h.httpGetter[peer]; !ok {
+			continue
+		}
+		h.peers.RemoveNode(peer)
+		delete(h.httpGetter, peer)
+		h.breakers.remove(peer)
+	}
+}
+
+// Peers returns the sorted addresses of all peers, the current node included.
+func (h *HTTPPool) Peers() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peers := make([]string, 0, len(h.httpGetter))
+	for peer := range h.httpGetter {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
 // ------ PeerPicker interface ------
 type PeerPicker interface {
 	PickPeer(key string) (peer PeerGetter, ok bool)
 }
 
+// PeerManager is implemented by pools whose peers can join and leave at runtime.
+type PeerManager interface {
+	AddPeer(peers ...string)
+	RemovePeer(peers ...string)
+	Peers() []string
+}
+
 var _ PeerPicker = (*HTTPPool)(nil)
+var _ PeerManager = (*HTTPPool)(nil)
+var _ ReplicaPicker = (*HTTPPool)(nil)
+var _ BreakerReporter = (*HTTPPool)(nil)
+var _ RingWatcher = (*HTTPPool)(nil)
+var _ DrainablePool = (*HTTPPool)(nil)
+
+// PickReplicas returns the getters of the n nodes holding the key, nil for the current node.
+func (h *HTTPPool) PickReplicas(key string, n int) []PeerGetter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.peers == nil {
+		return nil
+	}
+	var replicas []PeerGetter
+	for _, peer := range h.peers.GetNodes(key, n) {
+		if peer == h.self {
+			replicas = append(replicas, nil)
+		} else {
+			replicas = append(replicas, h.httpGetter[peer])
+		}
+	}
+	return replicas
+}
+
+// SyncPeers reconciles the peers of pm with the live members, e.g. as the
+// OnChange callback of a membership.Memberlist.
+func SyncPeers(pm PeerManager, alive []string) {
+	live := make(map[string]bool, len(alive))
+	for _, peer := range alive {
+		live[peer] = true
+	}
+
+	var removed []string
+	for _, peer := range pm.Peers() {
+		if !live[peer] {
+			removed = append(removed, peer)
+		}
+		delete(live, peer)
+	}
+	if len(removed) > 0 {
+		pm.RemovePeer(removed...)
+	}
+	if len(live) > 0 {
+		added := make([]string, 0, len(live))
+		for peer := range live {
+			added = append(added, peer)
+		}
+		pm.AddPeer(added...)
+	}
+}
+
+// SyncPeersOnJoin returns an OnChange callback of a membership.Memberlist
+// calling SyncPeers once the membership knows another member. Until then the
+// node only knows itself, e.g. before a seed answered Join, and the static
+// peers of pm are kept.
+func SyncPeersOnJoin(pm PeerManager) func(alive []string) {
+	joined := false // OnChange is called by one goroutine
+	return func(alive []string) {
+		if !joined && len(alive) < 2 {
+			return
+		}
+		joined = true
+		SyncPeers(pm, alive)
+	}
+}
 
 // implement PeerPicker interface
 // PickPeer() is used to pick a peer from the consistent hash ring to get the data from other node
@@ -66,9 +272,18 @@ func (h *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if h.peers == nil {
+		return nil, false
+	}
 	if peer := h.peers.GetNode(key); peer != "" && peer != h.self {
+		getter := h.httpGetter[peer]
+		if getter.breaker != nil && !getter.breaker.available() {
+			// load locally rather than wait for a peer known to fail
+			h.log("skip unhealthy peer %s", peer)
+			return nil, false
+		}
 		h.log("pick peer %s", peer)
-		return h.httpGetter[peer], true
+		return getter, true
 	}
 	return nil, false
 }
@@ -78,6 +293,19 @@ func (h *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("unexpected path:" + r.URL.Path)
 	}
 	h.log("%s, %s", r.Method, r.URL.Path)
+	h.mu.Lock()
+	maxBody := h.maxBody
+	h.mu.Unlock()
+	// the body of a request is read whole, before its signature is checked
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	if !h.authenticate(w, r) {
+		return
+	}
+	if h.draining.Load() {
+		// the caller loads the key itself, see fallbackOnPeerError
+		writeError(w, fmt.Errorf("%w: %s is draining", ErrOverloaded, h.self))
+		return
+	}
 	// /<basepath>/<groupname>/<key>
 	parts := strings.SplitN(r.URL.Path[len(h.basePath):], "/", 2)
 	if len(parts) != 2 {
@@ -88,27 +316,117 @@ func (h *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	groupName := parts[0]
 	key := parts[1]
 
-	group := GetGroup(groupName)
+	group := h.getGroup(groupName)
 	if group == nil {
-		http.Error(w, "no such group", http.StatusBadRequest)
+		writeError(w, fmt.Errorf("%w: %s", ErrGroupUnknown, groupName))
 		return
 	}
 
-	view, err := group.Get(key)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	ctx, cancel := requestContext(r)
+	defer cancel()
+
+	var res proto.Message
+	switch r.Method {
+	case http.MethodGet:
+		if key == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+		view, err := group.GetContext(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res = viewToResponse(view)
+	case http.MethodPut:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if key == "" {
+			// PUT /<basepath>/<groupname>/ stores the entries of a HandoffRequest
+			req := &pb.HandoffRequest{}
+			if err := proto.Unmarshal(value, req); err != nil {
+				http.Error(w, "decoding request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			res = &pb.HandoffResponse{Stored: group.storeHandoff(req.GetEntries())}
+			break
+		}
+		var ttl time.Duration
+		if s := r.URL.Query().Get("ttl_ms"); s != "" {
+			ms, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, "bad ttl_ms", http.StatusBadRequest)
+				return
+			}
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+		var flags uint64
+		if s := r.URL.Query().Get("flags"); s != "" {
+			if flags, err = strconv.ParseUint(s, 10, 32); err != nil {
+				http.Error(w, "bad flags", http.StatusBadRequest)
+				return
+			}
+		}
+		replica := r.URL.Query().Get("replica") == "true"
+		if err := group.handleSet(ctx, key, value, uint32(flags), ttl, replica); err != nil {
+			writeError(w, err)
+			return
+		}
+		res = &pb.SetResponse{}
+	case http.MethodDelete:
+		deleted, err := group.handleDelete(ctx, key, r.URL.Query().Get("replica") == "true")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res = &pb.DeleteResponse{Deleted: deleted}
+	case http.MethodPost:
+		// POST /<basepath>/<groupname>/ fetches the keys of a BatchRequest
+		if key != "" {
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		req := &pb.BatchRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			http.Error(w, "decoding request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		res = batchResponse(group.GetMultiContext(ctx, req.GetKeys()))
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	body, err := proto.Marshal(&pb.Response{
-		Value: view.ByteSlice(),
-	})
+	writeProto(w, http.StatusOK, res)
+}
+
+// writeError reports err to another node with a pb.Response carrying its
+// code, and the HTTP status of the code.
+func writeError(w http.ResponseWriter, err error) {
+	res := errorResponse(err)
+	writeProto(w, httpStatus(res.GetCode()), res)
+}
+
+// writeProto writes the message as the body of a response with the status code.
+func writeProto(w http.ResponseWriter, code int, res proto.Message) {
+	body, err := proto.Marshal(res)
 	if err != nil{
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(code)
 	w.Write(body)
 }
 
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTPClientConfig tunes the client an HTTPPool uses to reach its peers.
+type HTTPClientConfig struct {
+	// Timeout bounds a whole request, 0 leaves it to the caller's context.
+	Timeout         time.Duration
+	DialTimeout     time.Duration
+	KeepAlive       time.Duration // interval of the TCP keep-alive probes
+	IdleConnTimeout time.Duration // how long an idle connection is kept
+	// MaxIdleConnsPerPeer is the number of idle connections kept open to each
+	// peer, http.DefaultClient keeps 2 and opens new ones under load.
+	MaxIdleConnsPerPeer int
+	MaxConnsPerPeer     int // 0 means no limit
+	// H2C talks HTTP/2 without TLS, every request to a peer shares one
+	// connection. The peers must serve with H2CHandler.
+	H2C bool
+}
+
+// DefaultHTTPClientConfig is the configuration of the client of new pools.
+var DefaultHTTPClientConfig = HTTPClientConfig{
+	Timeout:             10 * time.Second,
+	DialTimeout:         2 * time.Second,
+	KeepAlive:           30 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConnsPerPeer: 64,
+}
+
+// NewHTTPClient returns a client configured by cfg, to be set with
+// HTTPPool.SetHTTPClient. A custom RoundTripper, e.g. a middleware, can wrap
+// its Transport.
+func NewHTTPClient(cfg HTTPClientConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	if cfg.H2C {
+		return &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+				ReadIdleTimeout: cfg.KeepAlive,
+			},
+		}
+	}
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: cfg.MaxIdleConnsPerPeer,
+			MaxConnsPerHost:     cfg.MaxConnsPerPeer,
+			IdleConnTimeout:     cfg.IdleConnTimeout,
+		},
+	}
+}
+
+// H2CHandler serves h with HTTP/2 without TLS as well as HTTP/1, for the
+// peers whose client has H2C set.
+func H2CHandler(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
@@ -0,0 +1,323 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+func startHTTPNodes(t *testing.T, groupName string, count int, opts ...GroupOption) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, count)
+	lises := make([]net.Listener, count)
+	addrs := make([]string, count)
+	for i := range nodes {
+		nodes[i], lises[i] = newTestNode(t, groupName, opts...)
+		addrs[i] = "http://" + nodes[i].addr
+	}
+	for i, n := range nodes {
+		pool := NewHTTPPool(addrs[i])
+		pool.getGroup = n.lookup
+		pool.SetPeers(addrs...)
+		n.group.RegisterPeerPicker(pool)
+		server := &http.Server{Handler: pool}
+		go server.Serve(lises[i])
+		n.stop = func() { server.Close() }
+		t.Cleanup(n.stop)
+	}
+	return nodes
+}
+
+// ownerOf returns the node owning the key and another node.
+func ownerOf(nodes []*testNode, key string) (owner, other *testNode) {
+	for _, n := range nodes {
+		if _, ok := n.group.peerPicker.PickPeer(key); ok {
+			other = n
+		} else {
+			owner = n
+		}
+	}
+	return owner, other
+}
+
+// testWritePath checks Set, Delete and Invalidate issued on one node are
+// applied on the owner and observed by every other node.
+func testWritePath(t *testing.T, nodes []*testNode) {
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		writer, reader := nodes[i%len(nodes)], nodes[(i+1)%len(nodes)]
+
+		if err := writer.group.Set(key, []byte("new-"+key)); err != nil {
+			t.Fatalf("Set(%q): %v", key, err)
+		}
+		view, err := reader.group.Get(key)
+		if err != nil || view.String() != "new-"+key {
+			t.Fatalf("Get(%q) after Set = %q, %v", key, view.String(), err)
+		}
+
+		deleted, err := writer.group.Delete(key)
+		if err != nil || !deleted {
+			t.Fatalf("Delete(%q) = %v, %v", key, deleted, err)
+		}
+		if deleted, _ := writer.group.Delete(key); deleted {
+			t.Fatalf("Delete(%q) twice reported the key cached", key)
+		}
+		view, err = reader.group.Get(key)
+		if err != nil || view.String() != "value-"+key {
+			t.Fatalf("Get(%q) after Delete = %q, %v", key, view.String(), err)
+		}
+
+		if err := writer.group.Set(key, []byte("new-"+key)); err != nil {
+			t.Fatal(err)
+		}
+		if err := reader.group.Invalidate(key); err != nil {
+			t.Fatalf("Invalidate(%q): %v", key, err)
+		}
+		view, _ = writer.group.Get(key)
+		if view.String() != "value-"+key {
+			t.Fatalf("Get(%q) after Invalidate = %q", key, view.String())
+		}
+	}
+}
+
+func TestHTTPPoolWritePath(t *testing.T) {
+	testWritePath(t, startHTTPNodes(t, "http-write", 3))
+}
+
+// testSetNoExpiration checks the owner of a key set with NoExpiration keeps
+// it past the default TTL of the group.
+func testSetNoExpiration(t *testing.T, nodes []*testNode) {
+	owner, other := ownerOf(nodes, "k")
+	if err := other.group.SetWithTTL("k", []byte("v"), NoExpiration); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := owner.group.lookupCache("k"); !ok || !view.Expire().IsZero() {
+		t.Fatalf("owner has k = %v expiring at %v, want it without expiration", ok, view.Expire())
+	}
+	if err := other.group.Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if view, _ := owner.group.lookupCache("k"); view.Expire().IsZero() {
+		t.Fatal("a Set without ttl ignored the default TTL")
+	}
+}
+
+func TestHTTPSetNoExpiration(t *testing.T) {
+	testSetNoExpiration(t, startHTTPNodes(t, "http-no-expiration", 2, WithTTL(time.Hour)))
+}
+
+func TestGRPCSetNoExpiration(t *testing.T) {
+	testSetNoExpiration(t, startGRPCNodes(t, "grpc-no-expiration", 2, WithTTL(time.Hour)))
+}
+
+func TestHTTPPoolRejectsUnknownMethod(t *testing.T) {
+	nodes := startHTTPNodes(t, "http-method", 1)
+	req, _ := http.NewRequest(http.MethodPost, "http://"+nodes[0].addr+defaultBasePath+"http-method/Tom", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST returned %v", res.Status)
+	}
+}
+
+// withGetter replaces the getter of a test node.
+func withGetter(getter Getter) GroupOption {
+	return func(g *Group) {
+		g.getter = getter
+	}
+}
+
+func TestDeadlinePropagatesToPeer(t *testing.T) {
+	deadlines := make(chan time.Duration, 2)
+	nodes := startHTTPNodes(t, "deadline", 2, withGetter(ContextGetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				deadlines <- 0
+				return []byte(key), nil
+			}
+			deadlines <- time.Until(deadline)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	)))
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if _, ok := nodes[0].group.peerPicker.PickPeer(fmt.Sprintf("key-%d", i)); ok {
+			key = fmt.Sprintf("key-%d", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := nodes[0].group.GetContext(ctx, key)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetContext err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("GetContext returned after %v", elapsed)
+	}
+
+	// only the owner ran the getter, under the deadline of the caller
+	if remaining := <-deadlines; remaining <= 0 || remaining > 100*time.Millisecond {
+		t.Fatalf("owner's getter saw %v left before the deadline", remaining)
+	}
+	select {
+	case <-deadlines:
+		t.Fatalf("caller fell back to its own getter after the deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// startHTTPOwner serves the group of a single node, countConns counts the
+// connections the server accepted.
+func startHTTPOwner(t *testing.T, groupName string, wrap func(http.Handler) http.Handler) (n *testNode, url string, countConns func() int) {
+	t.Helper()
+	n, lis := newTestNode(t, groupName)
+	url = "http://" + n.addr
+	pool := NewHTTPPool(url)
+	pool.getGroup = n.lookup
+	var mu sync.Mutex
+	conns := 0
+	server := &http.Server{Handler: wrap(pool), ConnState: func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}}
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+	return n, url, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+}
+
+// getFromClientPool gets keys from the owner at url through a pool using client.
+func getFromClientPool(t *testing.T, url string, client *http.Client, keys []string) {
+	t.Helper()
+	pool := NewHTTPPool("http://client")
+	pool.SetHTTPClient(client)
+	pool.SetPeers(url)
+	getter := pool.httpGetter[url]
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			res := &pb.Response{}
+			if err := getter.GetDataFromPeer(context.Background(), &pb.Request{Group: "client", Key: key}, res); err != nil {
+				t.Errorf("Get %s: %v", key, err)
+			} else if string(res.GetValue()) != "value-"+key {
+				t.Errorf("Get %s = %q", key, res.GetValue())
+			}
+		}(key)
+	}
+	wg.Wait()
+}
+
+func TestHTTPPoolReusesConnections(t *testing.T) {
+	_, url, conns := startHTTPOwner(t, "client", func(h http.Handler) http.Handler { return h })
+	client := NewHTTPClient(DefaultHTTPClientConfig)
+
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	getFromClientPool(t, url, client, keys)
+	opened := conns()
+	for i := 0; i < 3; i++ {
+		getFromClientPool(t, url, client, keys)
+	}
+	if conns() != opened {
+		t.Fatalf("opened %d connections after the first burst of %d, want the idle ones reused", conns()-opened, opened)
+	}
+}
+
+// roundTripFunc is a RoundTripper middleware of the tests.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestHTTPPoolCustomRoundTripper(t *testing.T) {
+	_, url, _ := startHTTPOwner(t, "client", func(h http.Handler) http.Handler { return h })
+	client := NewHTTPClient(DefaultHTTPClientConfig)
+	var calls atomic.Int32
+	next := client.Transport
+	client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return next.RoundTrip(r)
+	})
+
+	getFromClientPool(t, url, client, []string{"Tom", "Jack"})
+	if calls.Load() != 2 {
+		t.Fatalf("RoundTripper saw %d requests, want 2", calls.Load())
+	}
+}
+
+func TestHTTPPoolH2C(t *testing.T) {
+	_, url, conns := startHTTPOwner(t, "client", H2CHandler)
+	cfg := DefaultHTTPClientConfig
+	cfg.H2C = true
+	client := NewHTTPClient(cfg)
+	var protos sync.Map
+	next := client.Transport
+	client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		res, err := next.RoundTrip(r)
+		if err == nil {
+			protos.Store(res.Proto, true)
+		}
+		return res, err
+	})
+
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	getFromClientPool(t, url, client, keys)
+	if _, ok := protos.Load("HTTP/2.0"); !ok {
+		t.Fatalf("peer was not reached over HTTP/2")
+	}
+	if conns() != 1 {
+		t.Fatalf("opened %d connections, want the requests multiplexed on 1", conns())
+	}
+}
+
+func TestSyncPeersOnJoin(t *testing.T) {
+	pool := NewHTTPPool("http://a")
+	pool.SetPeers("http://a", "http://b", "http://c")
+	onChange := SyncPeersOnJoin(pool)
+
+	// the membership reports the node alone before any seed answered
+	onChange([]string{"http://a"})
+	if peers := pool.Peers(); len(peers) != 3 {
+		t.Fatalf("peers = %v before the join, want the static peers", peers)
+	}
+	onChange([]string{"http://a", "http://d"})
+	if peers := pool.Peers(); fmt.Sprint(peers) != "[http://a http://d]" {
+		t.Fatalf("peers = %v after the join, want the members", peers)
+	}
+	// once joined, the node alone is a real change
+	onChange([]string{"http://a"})
+	if peers := pool.Peers(); len(peers) != 1 {
+		t.Fatalf("peers = %v, want the node only", peers)
+	}
+}
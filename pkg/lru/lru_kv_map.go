@@ -1,6 +1,10 @@
 package lru
 
-import "container/list"
+import (
+	"container/heap"
+	"container/list"
+	"time"
+)
 
 type Value interface{
 	Len() int
@@ -9,6 +13,8 @@ type Value interface{
 type entry struct{
 	key string
 	value Value
+	expire time.Time // zero means the entry never expires
+	index int // position in expiryHeap, -1 if the entry never expires
 }
 
 type Cache struct {
@@ -16,6 +22,10 @@ type Cache struct {
 	curByte int64 // storage size currently used 
 	list    *list.List
 	cache	map[string]*list.Element
+	expires expiryHeap // entries with an expiration, the earliest first
+	now func() time.Time
+	evictions int64 // entries removed to make room
+	expirations int64 // entries removed because they expired
 	OnEvicted func(key string, value Value)
 }
 
@@ -25,11 +35,14 @@ func New(maxByte int64, onEvicted func(key string, value Value)) *Cache {
 		curByte: 0,
 		list: list.New(),
 		cache: make(map[string]*list.Element),
+		now: time.Now,
 		OnEvicted: onEvicted,
 	}
 } 
 
 func (c *Cache) Get(key string) (Value, bool){
+	// the expired entries stop counting in Bytes as soon as possible
+	c.RemoveExpired()
 	if listEle, ok := c.cache[key]; ok{
 		// listEle is the most recent used, 
 		// move to the back to make it least possible to be purged
@@ -44,33 +57,99 @@ func (c *Cache) Get(key string) (Value, bool){
 	return nil, false
 }
 
+// Peek returns the value without marking it used nor dropping it when
+// expired, so concurrent Peeks only need a read lock.
+func (c *Cache) Peek(key string) (Value, bool) {
+	if listEle, ok := c.cache[key]; ok {
+		if kv := listEle.Value.(*entry); !c.expired(kv) {
+			return kv.value, true
+		}
+	}
+	return nil, false
+}
+
+// Walk calls fn on the live entries, the most recently used first,
+// until fn returns false.
+func (c *Cache) Walk(fn func(key string, value Value) bool) {
+	for listEle := c.list.Back(); listEle != nil; listEle = listEle.Prev() {
+		kv := listEle.Value.(*entry)
+		if !c.expired(kv) && !fn(kv.key, kv.value) {
+			return
+		}
+	}
+}
+
 func (c *Cache) RemovdeOldest() {
 	listEle := c.list.Front()
 	if listEle != nil{
-		c.list.Remove(listEle)
+		c.removeElement(listEle)
+		c.evictions++
+	}
+}
 
-		kv := listEle.Value.(*entry)
-		delete(c.cache, kv.key)
+// Remove drops the key from the cache, return false if it is not cached.
+func (c *Cache) Remove(key string) bool {
+	if listEle, ok := c.cache[key]; ok {
+		c.removeElement(listEle)
+		return true
+	}
+	return false
+}
 
-		c.curByte -= int64(len(kv.key) + kv.value.Len())
+// RemoveExpired drops every entry whose expiration has passed
+// and returns how many entries were removed.
+func (c *Cache) RemoveExpired() int {
+	removed := 0
+	for len(c.expires) > 0 && c.expired(c.expires[0]) {
+		c.removeElement(c.cache[c.expires[0].key])
+		c.expirations++
+		removed++
+	}
+	return removed
+}
 
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+func (c *Cache) removeElement(listEle *list.Element) {
+	c.list.Remove(listEle)
+
+	kv := listEle.Value.(*entry)
+	delete(c.cache, kv.key)
+	if kv.index >= 0 {
+		heap.Remove(&c.expires, kv.index)
+	}
+
+	c.curByte -= int64(len(kv.key) + kv.value.Len())
+
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
 	}
 }
 
+func (c *Cache) expired(kv *entry) bool {
+	return !kv.expire.IsZero() && !c.now().Before(kv.expire)
+}
+
 func (c *Cache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds the value and drops it once expire has passed,
+// a zero expire means the value never expires.
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	// expired entries go first so they never push out live ones
+	c.RemoveExpired()
 	if ele, ok := c.cache[key]; ok {
 		c.list.MoveToBack(ele)
 		
 		kv := ele.Value.(*entry)
 		c.curByte += int64(value.Len() - kv.value.Len())
 		kv.value = value
+		c.setExpire(kv, expire)
 	}else {
-		ele := c.list.PushBack(&entry{key: key, value: value})
+		kv := &entry{key: key, value: value, index: -1}
+		ele := c.list.PushBack(kv)
 		c.cache[key] = ele
 		c.curByte += int64(value.Len() + len(key))
+		c.setExpire(kv, expire)
 	}
 
 	for c.curByte > c.maxByte && c.maxByte != 0{
@@ -78,6 +157,83 @@ func (c *Cache) Add(key string, value Value) {
 	}
 }
 
+func (c *Cache) setExpire(kv *entry, expire time.Time) {
+	kv.expire = expire
+	switch {
+	case expire.IsZero() && kv.index >= 0:
+		heap.Remove(&c.expires, kv.index)
+	case !expire.IsZero() && kv.index >= 0:
+		heap.Fix(&c.expires, kv.index)
+	case !expire.IsZero():
+		heap.Push(&c.expires, kv)
+	}
+}
+
+// Len returns the number of live entries.
 func (c *Cache) Len() int {
-	return c.list.Len()
+	n, _ := c.expiredSize(0)
+	return c.list.Len() - n
+}
+
+// Bytes returns the storage size used by the live entries, keys included.
+// Get and Add drop the expired entries, Len and Bytes leave them out
+// without modifying the cache, e.g. under a read lock.
+func (c *Cache) Bytes() int64 {
+	_, bytes := c.expiredSize(0)
+	return c.curByte - bytes
+}
+
+// expiredSize returns the number and the size of the expired entries under
+// position i of the heap. A live entry only has later entries under it, so
+// the walk stops there and costs the expired entries only.
+func (c *Cache) expiredSize(i int) (int, int64) {
+	if i >= len(c.expires) || !c.expired(c.expires[i]) {
+		return 0, 0
+	}
+	kv := c.expires[i]
+	n, bytes := 1, int64(len(kv.key)+kv.value.Len())
+	for _, child := range []int{2*i + 1, 2*i + 2} {
+		childN, childBytes := c.expiredSize(child)
+		n += childN
+		bytes += childBytes
+	}
+	return n, bytes
+}
+
+// Evictions returns how many entries were removed to make room.
+func (c *Cache) Evictions() int64 {
+	return c.evictions
+}
+
+// Expirations returns how many entries were removed because they expired.
+func (c *Cache) Expirations() int64 {
+	return c.expirations
+}
+
+// expiryHeap is a min-heap of entries ordered by expiration time.
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	kv := x.(*entry)
+	kv.index = len(*h)
+	*h = append(*h, kv)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	kv := old[len(old)-1]
+	old[len(old)-1] = nil
+	kv.index = -1
+	*h = old[:len(old)-1]
+	return kv
 }
@@ -3,6 +3,7 @@ package lru
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 type String string
@@ -34,6 +35,9 @@ func TestRemoveoldest(t *testing.T) {
 	if _, ok := lru.Get("key1"); ok || lru.Len() != 2 {
 		t.Fatalf("Removeoldest key1 failed")
 	}
+	if lru.Evictions() != 1 || lru.Bytes() != int64(len(k2+k3+v2+v3)) {
+		t.Fatalf("evictions=%d bytes=%d after Removeoldest", lru.Evictions(), lru.Bytes())
+	}
 }
 
 func TestOnEvicted(t *testing.T) {
@@ -53,3 +57,93 @@ func TestOnEvicted(t *testing.T) {
 		t.Fatalf("Call OnEvicted failed, expect keys equals to %s", expect)
 	}
 }
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+	lru.AddWithExpire("key1", String("1234"), now.Add(time.Second))
+	lru.Add("key2", String("5678"))
+
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatalf("cache hit key1 before expiration failed")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := lru.Get("key1"); ok {
+		t.Fatalf("expired key1 should not be returned")
+	}
+	if _, ok := lru.Get("key2"); !ok {
+		t.Fatalf("key2 without expiration should not expire")
+	}
+	if lru.Len() != 1 || lru.curByte != int64(len("key2")+len("5678")) {
+		t.Fatalf("expired key1 still counted, len=%d curByte=%d", lru.Len(), lru.curByte)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	now := time.Now()
+	keys := make([]string, 0)
+	lru := New(int64(0), func(key string, value Value) {
+		keys = append(keys, key)
+	})
+	lru.now = func() time.Time { return now }
+	lru.AddWithExpire("k1", String("v1"), now.Add(3*time.Second))
+	lru.AddWithExpire("k2", String("v2"), now.Add(1*time.Second))
+	lru.AddWithExpire("k3", String("v3"), now.Add(2*time.Second))
+	// refreshing k3 without expiration keeps it forever
+	lru.Add("k3", String("v3"))
+
+	now = now.Add(5 * time.Second)
+	if n := lru.RemoveExpired(); n != 2 || lru.Expirations() != 2 || lru.Evictions() != 0 {
+		t.Fatalf("RemoveExpired removed %d entries, expirations=%d evictions=%d", n, lru.Expirations(), lru.Evictions())
+	}
+	if expect := []string{"k2", "k1"}; !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("expired keys %v, want %v", keys, expect)
+	}
+	if lru.Len() != 1 || lru.curByte != 4 {
+		t.Fatalf("len=%d curByte=%d after RemoveExpired", lru.Len(), lru.curByte)
+	}
+}
+
+func TestExpiredRemovedBeforeOldest(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(8), nil)
+	lru.now = func() time.Time { return now }
+	lru.Add("k1", String("v1"))
+	lru.AddWithExpire("k2", String("v2"), now.Add(time.Second))
+
+	now = now.Add(time.Second)
+	lru.Add("k3", String("v3"))
+
+	if _, ok := lru.Get("k1"); !ok {
+		t.Fatalf("live k1 evicted while expired k2 was still cached")
+	}
+}
+
+func TestExpiredNotCounted(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+	lru.AddWithExpire("k1", String("v1"), now.Add(time.Second))
+	lru.AddWithExpire("k2", String("v2"), now.Add(2*time.Second))
+	lru.AddWithExpire("k3", String("v3"), now.Add(3*time.Second))
+	lru.Add("k4", String("v4"))
+
+	// Len and Bytes leave the expired entries out before they are dropped
+	now = now.Add(2 * time.Second)
+	if lru.Len() != 2 || lru.Bytes() != 8 || lru.list.Len() != 4 {
+		t.Fatalf("len=%d bytes=%d entries=%d with k1 and k2 expired", lru.Len(), lru.Bytes(), lru.list.Len())
+	}
+
+	// Add and Get of other keys drop them
+	lru.Add("k5", String("v5"))
+	if lru.list.Len() != 3 || lru.curByte != 12 || lru.Expirations() != 2 {
+		t.Fatalf("entries=%d curByte=%d expirations=%d after Add", lru.list.Len(), lru.curByte, lru.Expirations())
+	}
+	now = now.Add(time.Second)
+	lru.Get("k4")
+	if lru.list.Len() != 2 || lru.curByte != 8 || lru.Expirations() != 3 {
+		t.Fatalf("entries=%d curByte=%d expirations=%d after Get", lru.list.Len(), lru.curByte, lru.Expirations())
+	}
+}
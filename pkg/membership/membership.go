@@ -0,0 +1,524 @@
+package membership
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Memberlist is a SWIM style membership of the cluster.
+
+Every ProbeInterval the node pings one member in round robin order. When no ack
+arrives within ProbeTimeout, IndirectChecks other members are asked to ping the
+target on our behalf (ping-req). If nobody got an ack by the end of the period
+the target becomes suspect, and it is declared dead unless it refutes the
+suspicion with a higher incarnation within SuspicionTimeout.
+State changes are disseminated by piggybacking them on ping and ack messages.
+*/
+type Memberlist struct {
+	cfg       Config
+	transport Transport
+
+	mu         sync.Mutex
+	self       *Member
+	members    map[string]*member // keyed by name, the current node included
+	seq        uint64
+	acks       map[uint64]func() // pending ack handlers keyed by sequence number
+	broadcasts []*broadcast
+	probeOrder []string
+	probeIndex int
+	lastAlive  []string
+	changed    chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+}
+
+type Config struct {
+	Name string // identity of the node, e.g. its peer address in the hash ring
+	Addr string // transport address other members use to reach the node
+
+	ProbeInterval    time.Duration // default 1s
+	ProbeTimeout     time.Duration // default ProbeInterval / 3
+	IndirectChecks   int           // default 3
+	SuspicionTimeout time.Duration // default 5 * ProbeInterval
+	RetransmitMult   int           // an update is piggybacked RetransmitMult * log(n) times, default 4
+
+	// OnChange is called with the sorted names of the live members, the
+	// current node included, every time the live set changes.
+	OnChange func(alive []string)
+}
+
+type member struct {
+	Member
+	suspectTimer *time.Timer
+}
+
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// maxPiggyback bounds the number of updates carried by a single message.
+const maxPiggyback = 8
+
+func New(cfg Config, transport Transport) *Memberlist {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 || cfg.ProbeTimeout >= cfg.ProbeInterval {
+		cfg.ProbeTimeout = cfg.ProbeInterval / 3
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = 3
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.RetransmitMult <= 0 {
+		cfg.RetransmitMult = 4
+	}
+
+	self := &member{Member: Member{Name: cfg.Name, Addr: cfg.Addr, State: StateAlive}}
+	return &Memberlist{
+		cfg:       cfg,
+		transport: transport,
+		self:      &self.Member,
+		members:   map[string]*member{cfg.Name: self},
+		acks:      make(map[uint64]func()),
+		changed:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start runs the probe and receive loops in background.
+func (m *Memberlist) Start() {
+	m.wg.Add(3)
+	go m.receiveLoop()
+	go m.probeLoop()
+	go m.notifyLoop()
+	m.notify()
+}
+
+// Stop stops the loops and closes the transport, without telling other members.
+func (m *Memberlist) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		m.transport.Close()
+		m.wg.Wait()
+
+		m.mu.Lock()
+		for _, mem := range m.members {
+			if mem.suspectTimer != nil {
+				mem.suspectTimer.Stop()
+			}
+		}
+		m.mu.Unlock()
+	})
+}
+
+// Leave tells every live member the node is leaving, so they drop it at once
+// instead of waiting for the failure detection, then stops.
+func (m *Memberlist) Leave() {
+	m.mu.Lock()
+	leave := Update{Name: m.self.Name, Addr: m.self.Addr, State: StateDead, Incarnation: m.self.Incarnation}
+	var addrs []string
+	for _, mem := range m.members {
+		if mem.Name != m.self.Name && mem.State != StateDead {
+			addrs = append(addrs, mem.Addr)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, addr := range addrs {
+		m.mu.Lock()
+		msg := &Message{Type: MessagePing, Seq: m.nextSeq(), Updates: []Update{leave}}
+		m.mu.Unlock()
+		m.send(addr, msg)
+	}
+	m.Stop()
+}
+
+// Join contacts the seed nodes by their transport address, the seeds answer
+// with their full view so the node learns the cluster in one round trip.
+func (m *Memberlist) Join(seeds ...string) {
+	for _, addr := range seeds {
+		if addr == m.cfg.Addr {
+			continue
+		}
+		m.mu.Lock()
+		msg := &Message{Type: MessagePing, Seq: m.nextSeq(), Updates: m.fullState()}
+		m.mu.Unlock()
+		m.send(addr, msg)
+	}
+}
+
+// Members returns the view of the cluster sorted by name, the current node included.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		members = append(members, mem.Member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Alive returns the sorted names of the members which are not dead,
+// suspects are still alive until the suspicion times out.
+func (m *Memberlist) Alive() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.alive()
+}
+
+func (m *Memberlist) alive() []string {
+	alive := make([]string, 0, len(m.members))
+	for name, mem := range m.members {
+		if mem.State != StateDead {
+			alive = append(alive, name)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+func (m *Memberlist) receiveLoop() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case msg, ok := <-m.transport.Messages():
+			if !ok {
+				return
+			}
+			m.handle(msg)
+		}
+	}
+}
+
+func (m *Memberlist) probeLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.probe()
+		}
+	}
+}
+
+// notifyLoop calls OnChange outside of the lock, coalescing bursts of changes.
+func (m *Memberlist) notifyLoop() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.changed:
+			if m.cfg.OnChange != nil {
+				m.cfg.OnChange(m.Alive())
+			}
+		}
+	}
+}
+
+func (m *Memberlist) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Memberlist) probe() {
+	m.mu.Lock()
+	target := m.nextProbeTarget()
+	if target == nil {
+		m.mu.Unlock()
+		return
+	}
+	seq := m.nextSeq()
+	acked := make(chan struct{})
+	var ackOnce sync.Once
+	m.acks[seq] = func() { ackOnce.Do(func() { close(acked) }) }
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.acks, seq)
+		m.mu.Unlock()
+	}()
+
+	m.send(target.Addr, &Message{Type: MessagePing, Seq: seq})
+	if m.wait(acked, m.cfg.ProbeTimeout) {
+		return
+	}
+
+	// no direct ack, ask other members to probe the target for us
+	m.mu.Lock()
+	helpers := m.randomMembers(m.cfg.IndirectChecks, target.Name)
+	m.mu.Unlock()
+	for _, helper := range helpers {
+		m.send(helper.Addr, &Message{Type: MessagePingReq, Seq: seq, Target: target.Name, TargetAddr: target.Addr})
+	}
+	if m.wait(acked, m.cfg.ProbeInterval-m.cfg.ProbeTimeout) {
+		return
+	}
+
+	m.mu.Lock()
+	if mem, ok := m.members[target.Name]; ok && mem.State == StateAlive {
+		m.apply(Update{Name: mem.Name, Addr: mem.Addr, State: StateSuspect, Incarnation: mem.Incarnation})
+	}
+	m.mu.Unlock()
+}
+
+func (m *Memberlist) wait(acked chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+		return false
+	case <-m.stop:
+		return true
+	}
+}
+
+func (m *Memberlist) handle(msg *Message) {
+	m.mu.Lock()
+	sender, known := m.members[msg.From]
+	// a dead member talking again has restarted, it must learn it was declared dead to refute it
+	known = known && sender.State != StateDead
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+
+	switch msg.Type {
+	case MessagePing:
+		ack := &Message{Type: MessageAck, Seq: msg.Seq}
+		if !known {
+			// a new member, tell it everything we know
+			ack.Updates = m.fullState()
+		}
+		m.mu.Unlock()
+		m.send(msg.FromAddr, ack)
+	case MessagePingReq:
+		seq := m.nextSeq()
+		from, origSeq := msg.FromAddr, msg.Seq
+		m.acks[seq] = func() {
+			m.send(from, &Message{Type: MessageAck, Seq: origSeq})
+		}
+		m.mu.Unlock()
+		m.send(msg.TargetAddr, &Message{Type: MessagePing, Seq: seq})
+		time.AfterFunc(m.cfg.ProbeInterval, func() {
+			m.mu.Lock()
+			delete(m.acks, seq)
+			m.mu.Unlock()
+		})
+	case MessageAck:
+		handler := m.acks[msg.Seq]
+		m.mu.Unlock()
+		if handler != nil {
+			handler()
+		}
+	default:
+		m.mu.Unlock()
+	}
+}
+
+// apply merges an update into the view following the SWIM precedence rules,
+// and queues it for dissemination when it changed the view.
+func (m *Memberlist) apply(u Update) {
+	if u.Name == m.self.Name {
+		if u.State != StateAlive && u.Incarnation >= m.self.Incarnation {
+			// refute the suspicion about ourselves
+			m.self.Incarnation = u.Incarnation + 1
+			m.queue(m.selfUpdate())
+		}
+		return
+	}
+
+	mem, ok := m.members[u.Name]
+	if !ok {
+		mem = &member{Member: Member{Name: u.Name, Addr: u.Addr, State: u.State, Incarnation: u.Incarnation}}
+		m.members[u.Name] = mem
+		if u.State == StateSuspect {
+			m.startSuspicion(mem)
+		}
+		m.queue(u)
+		m.checkChange()
+		return
+	}
+
+	switch u.State {
+	case StateAlive:
+		if u.Incarnation <= mem.Incarnation {
+			return
+		}
+	case StateSuspect:
+		if mem.State == StateDead || u.Incarnation < mem.Incarnation ||
+			(u.Incarnation == mem.Incarnation && mem.State != StateAlive) {
+			return
+		}
+	case StateDead:
+		if u.Incarnation < mem.Incarnation || mem.State == StateDead {
+			return
+		}
+	}
+
+	if mem.suspectTimer != nil {
+		mem.suspectTimer.Stop()
+		mem.suspectTimer = nil
+	}
+	mem.State, mem.Incarnation = u.State, u.Incarnation
+	if u.Addr != "" {
+		mem.Addr = u.Addr
+	}
+	if u.State == StateSuspect {
+		m.startSuspicion(mem)
+	}
+	m.queue(u)
+	m.checkChange()
+}
+
+func (m *Memberlist) startSuspicion(mem *member) {
+	name, incarnation := mem.Name, mem.Incarnation
+	mem.suspectTimer = time.AfterFunc(m.cfg.SuspicionTimeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if mem, ok := m.members[name]; ok && mem.State == StateSuspect && mem.Incarnation == incarnation {
+			m.apply(Update{Name: name, Addr: mem.Addr, State: StateDead, Incarnation: incarnation})
+		}
+	})
+}
+
+func (m *Memberlist) checkChange() {
+	alive := m.alive()
+	if len(alive) == len(m.lastAlive) {
+		same := true
+		for i := range alive {
+			if alive[i] != m.lastAlive[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	m.lastAlive = alive
+	m.notify()
+}
+
+// queue schedules the update for piggybacking, replacing older updates about the same member.
+func (m *Memberlist) queue(u Update) {
+	for i, b := range m.broadcasts {
+		if b.update.Name == u.Name {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	transmits := m.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+	m.broadcasts = append(m.broadcasts, &broadcast{update: u, transmits: transmits})
+}
+
+// piggyback takes the updates to carry on an outgoing message, the freshest
+// first, and always announces the current node itself.
+func (m *Memberlist) piggyback() []Update {
+	sort.SliceStable(m.broadcasts, func(i, j int) bool {
+		return m.broadcasts[i].transmits > m.broadcasts[j].transmits
+	})
+	updates := []Update{m.selfUpdate()}
+	kept := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if len(updates) <= maxPiggyback && b.update.Name != m.self.Name {
+			updates = append(updates, b.update)
+			b.transmits--
+		}
+		if b.transmits > 0 {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+	return updates
+}
+
+func (m *Memberlist) fullState() []Update {
+	updates := make([]Update, 0, len(m.members))
+	for _, mem := range m.members {
+		updates = append(updates, Update{Name: mem.Name, Addr: mem.Addr, State: mem.State, Incarnation: mem.Incarnation})
+	}
+	return updates
+}
+
+func (m *Memberlist) selfUpdate() Update {
+	return Update{Name: m.self.Name, Addr: m.self.Addr, State: StateAlive, Incarnation: m.self.Incarnation}
+}
+
+func (m *Memberlist) send(addr string, msg *Message) {
+	m.mu.Lock()
+	msg.From, msg.FromAddr = m.self.Name, m.self.Addr
+	msg.Updates = append(msg.Updates, m.piggyback()...)
+	m.mu.Unlock()
+	m.transport.Send(addr, msg)
+}
+
+func (m *Memberlist) nextSeq() uint64 {
+	m.seq++
+	return m.seq
+}
+
+// nextProbeTarget walks the live members in a shuffled round robin order.
+func (m *Memberlist) nextProbeTarget() *Member {
+	for tries := 0; tries <= len(m.probeOrder); tries++ {
+		if m.probeIndex >= len(m.probeOrder) {
+			m.probeOrder = m.probeOrder[:0]
+			for name := range m.members {
+				if name != m.self.Name {
+					m.probeOrder = append(m.probeOrder, name)
+				}
+			}
+			rand.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+			m.probeIndex = 0
+			if len(m.probeOrder) == 0 {
+				return nil
+			}
+		}
+		mem, ok := m.members[m.probeOrder[m.probeIndex]]
+		m.probeIndex++
+		if ok && mem.State != StateDead {
+			target := mem.Member
+			return &target
+		}
+	}
+	return nil
+}
+
+// randomMembers picks up to k live members other than the current node and exclude.
+func (m *Memberlist) randomMembers(k int, exclude string) []Member {
+	candidates := make([]Member, 0, len(m.members))
+	for name, mem := range m.members {
+		if name != m.self.Name && name != exclude && mem.State == StateAlive {
+			candidates = append(candidates, mem.Member)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
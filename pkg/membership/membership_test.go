@@ -0,0 +1,223 @@
+package membership
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCluster struct {
+	network *Network
+	nodes   []*Memberlist
+	names   []string
+
+	mu    sync.Mutex
+	views map[string][]string // the last view reported by OnChange of each node
+}
+
+func newTestCluster(t *testing.T, size int, loss float64) *testCluster {
+	t.Helper()
+	c := &testCluster{network: NewNetwork(loss, 1), views: make(map[string][]string)}
+	for i := 0; i < size; i++ {
+		c.start(t, fmt.Sprintf("node-%d", i))
+	}
+	return c
+}
+
+func (c *testCluster) start(t *testing.T, name string) *Memberlist {
+	m := New(Config{
+		Name:             name,
+		Addr:             name + ":7946",
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     8 * time.Millisecond,
+		SuspicionTimeout: 150 * time.Millisecond,
+		OnChange: func(alive []string) {
+			c.mu.Lock()
+			c.views[name] = alive
+			c.mu.Unlock()
+		},
+	}, c.network.Transport(name+":7946"))
+	m.Start()
+	t.Cleanup(m.Stop)
+	if len(c.nodes) > 0 {
+		m.Join(c.nodes[0].cfg.Addr)
+	}
+	c.nodes = append(c.nodes, m)
+	c.names = append(c.names, name)
+	return m
+}
+
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf(format, args...)
+}
+
+func TestJoinConverges(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+
+	eventually(t, 2*time.Second, func() bool {
+		for _, n := range c.nodes {
+			if !reflect.DeepEqual(n.Alive(), c.names) {
+				return false
+			}
+		}
+		return true
+	}, "members did not converge to %v", c.names)
+}
+
+func TestFailureDetectionOnLossyNetwork(t *testing.T) {
+	c := newTestCluster(t, 6, 0.1)
+	eventually(t, 3*time.Second, func() bool {
+		for _, n := range c.nodes {
+			if len(n.Alive()) != len(c.names) {
+				return false
+			}
+		}
+		return true
+	}, "members did not converge on a lossy network")
+
+	// a crashed node is detected by every survivor, and nobody else is declared dead
+	crashed := c.nodes[5]
+	c.network.SetDown(crashed.cfg.Addr, true)
+	expect := c.names[:5]
+	eventually(t, 5*time.Second, func() bool {
+		for _, n := range c.nodes[:5] {
+			if !reflect.DeepEqual(n.Alive(), expect) {
+				return false
+			}
+		}
+		return true
+	}, "survivors did not agree on %v", expect)
+
+	for _, n := range c.nodes[:5] {
+		for _, m := range n.Members() {
+			if m.Name == crashed.cfg.Name && m.State != StateDead {
+				t.Fatalf("%s sees %s as %v", n.cfg.Name, m.Name, m.State)
+			}
+		}
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	eventually(t, 2*time.Second, func() bool {
+		return len(c.nodes[0].Alive()) == 3
+	}, "members did not converge")
+
+	// node-0 wrongly suspects node-2, node-2 must refute with a higher incarnation
+	n := c.nodes[0]
+	n.mu.Lock()
+	n.apply(Update{Name: "node-2", Addr: "node-2:7946", State: StateSuspect, Incarnation: 0})
+	n.mu.Unlock()
+
+	eventually(t, 2*time.Second, func() bool {
+		for _, m := range n.Members() {
+			if m.Name == "node-2" {
+				return m.State == StateAlive && m.Incarnation > 0
+			}
+		}
+		return false
+	}, "suspicion about node-2 was not refuted")
+	if alive := n.Alive(); !reflect.DeepEqual(alive, c.names) {
+		t.Fatalf("alive = %v after refutation", alive)
+	}
+}
+
+func TestRestartedNodeRejoins(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+
+	c.nodes[2].Stop()
+	eventually(t, 3*time.Second, func() bool {
+		return reflect.DeepEqual(c.nodes[0].Alive(), c.names[:2])
+	}, "stopped node was not declared dead")
+
+	// the restarted node starts again at incarnation 0 and must refute its death
+	c.nodes = c.nodes[:2]
+	c.names = c.names[:2]
+	c.start(t, "node-2")
+	eventually(t, 3*time.Second, func() bool {
+		return reflect.DeepEqual(c.nodes[0].Alive(), c.names)
+	}, "restarted node did not rejoin, alive = %v", c.nodes[0].Alive())
+
+	eventually(t, time.Second, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return reflect.DeepEqual(c.views["node-0"], c.names)
+	}, "OnChange did not report the rejoin")
+}
+
+func TestLeave(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	eventually(t, 2*time.Second, func() bool {
+		for _, n := range c.nodes {
+			if len(n.Alive()) != 3 {
+				return false
+			}
+		}
+		return true
+	}, "members did not converge")
+
+	// the survivors drop the node before the suspicion could time out
+	c.nodes[2].Leave()
+	eventually(t, 100*time.Millisecond, func() bool {
+		for _, n := range c.nodes[:2] {
+			if !reflect.DeepEqual(n.Alive(), c.names[:2]) {
+				return false
+			}
+		}
+		return true
+	}, "survivors still see %v", c.nodes[0].Alive())
+}
+
+func TestSignedUDPTransport(t *testing.T) {
+	listen := func(secret string) *UDPTransport {
+		t.Helper()
+		tr, err := NewSignedUDPTransport("127.0.0.1:0", []byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	receiver := listen("secret")
+	received := func() *Message {
+		select {
+		case msg := <-receiver.Messages():
+			return msg
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	for _, sender := range []*UDPTransport{listen(""), listen("wrong")} {
+		if err := sender.Send(receiver.Addr(), &Message{From: "intruder"}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := received(); msg != nil {
+			t.Fatalf("received %+v not signed with the secret", msg)
+		}
+	}
+	old := listen("secret")
+	if _, err := old.conn.WriteTo(old.sign([]byte(`{"from":"old"}`), time.Now().Add(-time.Minute)), receiver.conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := received(); msg != nil {
+		t.Fatalf("received %+v signed a minute ago", msg)
+	}
+
+	if err := listen("secret").Send(receiver.Addr(), &Message{From: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := received(); msg == nil || msg.From != "member" {
+		t.Fatalf("received %+v, want the signed message", msg)
+	}
+}
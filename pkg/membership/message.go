@@ -0,0 +1,69 @@
+package membership
+
+import "fmt"
+
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+var stateNames = []string{"alive", "suspect", "dead"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if name == string(text) {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown member state %q", text)
+}
+
+// Member is a node of the cluster as seen by the current node.
+type Member struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"` // bumped by the member to refute suspicions about it
+}
+
+type MessageType int
+
+const (
+	MessagePing MessageType = iota
+	MessagePingReq
+	MessageAck
+)
+
+// Update is a piggybacked change of a member's state.
+type Update struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"inc"`
+}
+
+type Message struct {
+	Type     MessageType `json:"type"`
+	Seq      uint64      `json:"seq"`
+	From     string      `json:"from"`
+	FromAddr string      `json:"from_addr"`
+	// Target is the member to probe on behalf of the sender of a ping-req.
+	Target     string   `json:"target,omitempty"`
+	TargetAddr string   `json:"target_addr,omitempty"`
+	Updates    []Update `json:"updates,omitempty"`
+}
@@ -0,0 +1,244 @@
+package membership
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport delivers messages between members on a best effort basis,
+// a lost message is not an error.
+type Transport interface {
+	Send(addr string, msg *Message) error
+	Messages() <-chan *Message
+	Close() error
+}
+
+const transportBuffer = 256
+
+const (
+	// signedHeaderLen is the HMAC-SHA256 and the unix milliseconds
+	// timestamp leading a signed datagram.
+	signedHeaderLen = sha256.Size + 8
+	// maxSignedSkew is how old a signed datagram may be.
+	maxSignedSkew = 30 * time.Second
+)
+
+/*
+UDPTransport sends every message as one JSON encoded UDP datagram.
+
+Without a secret any host reaching the UDP port can join the cluster or
+declare members dead, so the port must only be reachable by the nodes. With
+a secret, see NewSignedUDPTransport, the datagrams are signed and the ones
+not signed with the secret, or signed more than 30 seconds ago, are dropped.
+A datagram captured on the network can still be replayed within that window,
+which at worst repeats a state change the members already know of.
+*/
+type UDPTransport struct {
+	conn     net.PacketConn
+	secret   []byte // signs the datagrams when not empty
+	messages chan *Message
+}
+
+func NewUDPTransport(addr string) (*UDPTransport, error) {
+	return NewSignedUDPTransport(addr, nil)
+}
+
+// NewSignedUDPTransport returns a transport signing its datagrams with the
+// secret shared by every member, and dropping the ones which are not.
+func NewSignedUDPTransport(addr string, secret []byte) (*UDPTransport, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &UDPTransport{
+		conn:     conn,
+		secret:   secret,
+		messages: make(chan *Message, transportBuffer),
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+// Addr returns the local address the transport listens on.
+func (t *UDPTransport) Addr() string {
+	return t.conn.LocalAddr().String()
+}
+
+func (t *UDPTransport) Send(addr string, msg *Message) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(t.secret) > 0 {
+		b = t.sign(b, time.Now())
+	}
+	_, err = t.conn.WriteTo(b, udpAddr)
+	return err
+}
+
+// sign prepends the signature and the timestamp to the payload.
+func (t *UDPTransport) sign(payload []byte, now time.Time) []byte {
+	b := make([]byte, signedHeaderLen, signedHeaderLen+len(payload))
+	binary.BigEndian.PutUint64(b[sha256.Size:], uint64(now.UnixMilli()))
+	b = append(b, payload...)
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(b[sha256.Size:])
+	copy(b, mac.Sum(nil))
+	return b
+}
+
+// verify returns the payload of a signed datagram, false when it is not
+// signed with the secret or too old.
+func (t *UDPTransport) verify(b []byte, now time.Time) ([]byte, bool) {
+	if len(b) < signedHeaderLen {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(b[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), b[:sha256.Size]) {
+		return nil, false
+	}
+	sent := time.UnixMilli(int64(binary.BigEndian.Uint64(b[sha256.Size:])))
+	if skew := now.Sub(sent); skew > maxSignedSkew || skew < -maxSignedSkew {
+		return nil, false
+	}
+	return b[signedHeaderLen:], true
+}
+
+func (t *UDPTransport) Messages() <-chan *Message {
+	return t.messages
+}
+
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *UDPTransport) readLoop() {
+	defer close(t.messages)
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload := buf[:n]
+		if len(t.secret) > 0 {
+			var ok bool
+			if payload, ok = t.verify(payload, time.Now()); !ok {
+				continue
+			}
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(payload, msg); err != nil {
+			continue
+		}
+		select {
+		case t.messages <- msg:
+		default: // receiver is overloaded, behave like a dropped datagram
+		}
+	}
+}
+
+/*
+Network is an in-process simulated network for tests. Each message is dropped
+with probability loss, and nodes can be taken down to simulate crashes or partitions.
+*/
+type Network struct {
+	mu    sync.Mutex
+	loss  float64
+	rand  *rand.Rand
+	nodes map[string]*memTransport
+	down  map[string]bool
+}
+
+func NewNetwork(loss float64, seed int64) *Network {
+	return &Network{
+		loss:  loss,
+		rand:  rand.New(rand.NewSource(seed)),
+		nodes: make(map[string]*memTransport),
+		down:  make(map[string]bool),
+	}
+}
+
+// Transport attaches a new node listening on addr to the network.
+func (n *Network) Transport(addr string) Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t := &memTransport{network: n, addr: addr, messages: make(chan *Message, transportBuffer)}
+	n.nodes[addr] = t
+	delete(n.down, addr)
+	return t
+}
+
+// SetDown makes every message from and to addr disappear while down is true.
+func (n *Network) SetDown(addr string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = down
+}
+
+func (n *Network) deliver(from, to string, msg *Message) {
+	n.mu.Lock()
+	dst, ok := n.nodes[to]
+	drop := !ok || n.down[from] || n.down[to] || n.rand.Float64() < n.loss
+	n.mu.Unlock()
+	if drop {
+		return
+	}
+
+	// mimic serialization, the receiver must not share memory with the sender
+	cp := *msg
+	cp.Updates = append([]Update(nil), msg.Updates...)
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if dst.closed {
+		return
+	}
+	select {
+	case dst.messages <- &cp:
+	default:
+	}
+}
+
+type memTransport struct {
+	network  *Network
+	addr     string
+	mu       sync.Mutex
+	closed   bool
+	messages chan *Message
+}
+
+func (t *memTransport) Send(addr string, msg *Message) error {
+	t.network.deliver(t.addr, addr, msg)
+	return nil
+}
+
+func (t *memTransport) Messages() <-chan *Message {
+	return t.messages
+}
+
+func (t *memTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.messages)
+	}
+	t.network.mu.Lock()
+	if t.network.nodes[t.addr] == t {
+		delete(t.network.nodes, t.addr)
+	}
+	t.network.mu.Unlock()
+	return nil
+}
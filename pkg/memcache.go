@@ -0,0 +1,487 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memcacheVersion = "1.6.0-alo"
+
+	// exptime up to 30 days is relative, larger values are unix timestamps
+	memcacheRelativeExpireLimit = 60 * 60 * 24 * 30
+
+	defaultMaxItemSize = 1 << 20
+	maxMemcacheKeyLen  = 250
+	maxMemcacheLineLen = 64 << 10
+)
+
+var (
+	errMemcacheLineTooLong = errors.New("line too long")
+	errMemcacheBadFormat   = errors.New("bad command line format")
+	errMemcacheBadChunk    = errors.New("bad data chunk")
+
+	// outcomes of the item operations shared by both protocols
+	errMemcacheNotStored  = errors.New("not stored")
+	errMemcacheNotFound   = errors.New("not found")
+	errMemcacheExists     = errors.New("exists")
+	errMemcacheNonNumeric = errors.New("cannot increment or decrement non-numeric value")
+)
+
+/*
+MemcacheServer implements the memcached ASCII and binary protocols on top
+of a Group, so memcached clients can talk to the cluster. The protocol is
+chosen by the first byte of each connection, the ASCII commands are:
+
+	get <key>*                                   read through the group
+	gets <key>*                                  get with a cas unique of the value
+	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+	delete <key> [noreply]
+	touch <key> <exptime> [noreply]
+	incr|decr <key> <delta> [noreply]
+	stats, version, quit
+
+Flags are stored with the value, values loaded by the getter have flags 0.
+add, replace, touch and incr/decr read the key before writing it, they are
+serialized per key on this server but not across the cluster.
+*/
+type MemcacheServer struct {
+	group       *Group
+	maxItemSize int
+	started     time.Time
+
+	// rmw serializes the read-modify-write commands of a key
+	rmw keyLocks
+
+	tcpServer
+	stats memcacheStats
+}
+
+type memcacheStats struct {
+	cmdGet    AtomicInt
+	cmdSet    AtomicInt
+	cmdTouch  AtomicInt
+	getHits   AtomicInt
+	getMisses AtomicInt
+}
+
+// NewMemcacheServer returns a memcached front-end of group.
+func NewMemcacheServer(group *Group) *MemcacheServer {
+	s := &MemcacheServer{
+		group:       group,
+		maxItemSize: defaultMaxItemSize,
+		started:     time.Now(),
+	}
+	s.init()
+	return s
+}
+
+// Serve accepts memcached connections on lis until Close is called.
+func (s *MemcacheServer) Serve(lis net.Listener) error {
+	return s.serve(lis, s.serveConn)
+}
+
+func (s *MemcacheServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	// like memcached, the first byte of a connection selects the protocol
+	if magic, err := r.Peek(1); err == nil && magic[0] == binaryReqMagic {
+		s.serveBinary(conn, r, w)
+		return
+	}
+	for {
+		line, err := readMemcacheLine(r)
+		if err == errMemcacheLineTooLong {
+			fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		quit, err := s.dispatch(r, w, line)
+		if err != nil {
+			logConnError(conn, err)
+			return
+		}
+		// flush once the pipelined commands are all served
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// dispatch serves one command, it reports whether the connection
+// should be closed and fails on broken connections only.
+func (s *MemcacheServer) dispatch(r *bufio.Reader, w *bufio.Writer, line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		_, err := w.WriteString("ERROR\r\n")
+		return false, err
+	}
+
+	var err error
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		err = s.get(w, args, cmd == "gets")
+	case "set", "add", "replace":
+		err = s.store(r, w, cmd, args)
+	case "delete":
+		err = s.delete(w, args)
+	case "touch":
+		err = s.touch(w, args)
+	case "incr", "decr":
+		err = s.incr(w, args, cmd == "incr")
+	case "stats":
+		err = s.writeStats(w)
+	case "version":
+		_, err = w.WriteString("VERSION " + memcacheVersion + "\r\n")
+	case "quit":
+		return true, nil
+	default:
+		_, err = w.WriteString("ERROR\r\n")
+	}
+	return false, err
+}
+
+func (s *MemcacheServer) get(w *bufio.Writer, keys []string, cas bool) error {
+	if len(keys) == 0 {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	for _, key := range keys {
+		if !validMemcacheKey(key) {
+			return writeMemcacheError(w, errMemcacheBadFormat)
+		}
+	}
+
+	// a key the getter cannot load is a miss
+	views, _ := s.group.GetMultiContext(s.ctx, keys)
+	for _, key := range keys {
+		s.stats.cmdGet.Add(1)
+		view, ok := views[key]
+		if !ok {
+			s.stats.getMisses.Add(1)
+			continue
+		}
+		s.stats.getHits.Add(1)
+		if cas {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, view.Flags(), view.Len(), casUnique(view))
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, view.Flags(), view.Len())
+		}
+		w.Write(view.ByteSlice())
+		w.WriteString("\r\n")
+	}
+	_, err := w.WriteString("END\r\n")
+	return err
+}
+
+// store serves set, add and replace:
+// <cmd> <key> <flags> <exptime> <bytes> [noreply]\r\n<data>\r\n
+func (s *MemcacheServer) store(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	if len(args) != 4 && len(args) != 5 {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	noreply := len(args) == 5 && args[4] == "noreply"
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, expErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	if flagsErr != nil || expErr != nil || sizeErr != nil || size < 0 || !validMemcacheKey(args[0]) {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+
+	if size > s.maxItemSize {
+		// swallow the data block so the connection stays in sync
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		return s.reply(w, noreply, "SERVER_ERROR object too large for cache")
+	}
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return writeMemcacheError(w, errMemcacheBadChunk)
+	}
+	value = value[:size]
+
+	switch err := s.storeItem(cmd, args[0], value, uint32(flags), exptime, 0); err {
+	case nil:
+		return s.reply(w, noreply, "STORED")
+	case errMemcacheNotStored:
+		return s.reply(w, noreply, "NOT_STORED")
+	default:
+		return s.reply(w, noreply, "SERVER_ERROR "+err.Error())
+	}
+}
+
+func (s *MemcacheServer) delete(w *bufio.Writer, args []string) error {
+	// memcached still accepts the legacy "delete <key> 0"
+	if len(args) == 0 || len(args) > 3 || !validMemcacheKey(args[0]) {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	noreply := args[len(args)-1] == "noreply"
+
+	deleted, err := s.group.deleteWithContext(s.ctx, args[0])
+	switch {
+	case err != nil:
+		return s.reply(w, noreply, "SERVER_ERROR "+err.Error())
+	case deleted:
+		return s.reply(w, noreply, "DELETED")
+	default:
+		return s.reply(w, noreply, "NOT_FOUND")
+	}
+}
+
+func (s *MemcacheServer) touch(w *bufio.Writer, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	noreply := len(args) == 3 && args[2] == "noreply"
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || !validMemcacheKey(args[0]) {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+
+	switch _, err := s.touchItem(args[0], exptime); err {
+	case nil:
+		return s.reply(w, noreply, "TOUCHED")
+	case errMemcacheNotFound:
+		return s.reply(w, noreply, "NOT_FOUND")
+	default:
+		return s.reply(w, noreply, "SERVER_ERROR "+err.Error())
+	}
+}
+
+func (s *MemcacheServer) incr(w *bufio.Writer, args []string, incr bool) error {
+	if len(args) != 2 && len(args) != 3 {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if !validMemcacheKey(args[0]) {
+		return writeMemcacheError(w, errMemcacheBadFormat)
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return s.reply(w, noreply, "CLIENT_ERROR invalid numeric delta argument")
+	}
+
+	switch n, err := s.incrItem(args[0], delta, incr, nil, 0); err {
+	case nil:
+		return s.reply(w, noreply, strconv.FormatUint(n, 10))
+	case errMemcacheNotFound:
+		return s.reply(w, noreply, "NOT_FOUND")
+	case errMemcacheNonNumeric:
+		return s.reply(w, noreply, "CLIENT_ERROR "+err.Error())
+	default:
+		return s.reply(w, noreply, "SERVER_ERROR "+err.Error())
+	}
+}
+
+func (s *MemcacheServer) writeStats(w *bufio.Writer) error {
+	for _, stat := range s.statList() {
+		fmt.Fprintf(w, "STAT %s %s\r\n", stat[0], stat[1])
+	}
+	_, err := w.WriteString("END\r\n")
+	return err
+}
+
+// statList returns the name and value of every stat.
+func (s *MemcacheServer) statList() [][2]string {
+	main := s.group.CacheStats(MainCache)
+	hot := s.group.CacheStats(HotCache)
+	now := time.Now()
+	var stats [][2]string
+	for _, stat := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(s.started).Seconds())},
+		{"time", now.Unix()},
+		{"version", memcacheVersion},
+		{"curr_connections", s.currConns.Get()},
+		{"total_connections", s.totalConns.Get()},
+		{"cmd_get", s.stats.cmdGet.Get()},
+		{"cmd_set", s.stats.cmdSet.Get()},
+		{"cmd_touch", s.stats.cmdTouch.Get()},
+		{"get_hits", s.stats.getHits.Get()},
+		{"get_misses", s.stats.getMisses.Get()},
+		{"bytes", main.Bytes + hot.Bytes},
+		{"curr_items", main.Items + hot.Items},
+		{"evictions", main.Evictions + hot.Evictions},
+		{"limit_maxbytes", s.group.mainCache.cacheSize + s.group.hotCache.cacheSize},
+	} {
+		stats = append(stats, [2]string{stat.name, fmt.Sprint(stat.value)})
+	}
+	return stats
+}
+
+// storeItem serves set, add and replace, a non-zero cas only replaces
+// the value it was computed from.
+func (s *MemcacheServer) storeItem(mode, key string, value []byte, flags uint32, exptime int64, cas uint64) error {
+	s.stats.cmdSet.Add(1)
+	if mode != "set" || cas != 0 {
+		defer s.rmw.lock(s.group.name, key).Unlock()
+		view, err := s.group.GetContext(s.ctx, key)
+		exists := err == nil
+		switch {
+		case cas != 0 && !exists:
+			return errMemcacheNotFound
+		case cas != 0 && casUnique(view) != cas:
+			return errMemcacheExists
+		case mode == "add" && exists, mode == "replace" && !exists:
+			return errMemcacheNotStored
+		}
+	}
+	return s.write(key, value, flags, exptime)
+}
+
+// touchItem renews the expiration of the key.
+func (s *MemcacheServer) touchItem(key string, exptime int64) (ByteView, error) {
+	s.stats.cmdTouch.Add(1)
+	defer s.rmw.lock(s.group.name, key).Unlock()
+	view, err := s.group.GetContext(s.ctx, key)
+	if err != nil {
+		return ByteView{}, errMemcacheNotFound
+	}
+	return view, s.write(key, view.ByteSlice(), view.Flags(), exptime)
+}
+
+// incrItem adds or subtracts delta to the decimal value of the key.
+// A missing key is created with initial when it is given.
+func (s *MemcacheServer) incrItem(key string, delta uint64, incr bool, initial *uint64, exptime int64) (uint64, error) {
+	defer s.rmw.lock(s.group.name, key).Unlock()
+	view, err := s.group.GetContext(s.ctx, key)
+	if err != nil {
+		if initial == nil {
+			return 0, errMemcacheNotFound
+		}
+		return *initial, s.write(key, []byte(strconv.FormatUint(*initial, 10)), 0, exptime)
+	}
+	n, err := strconv.ParseUint(view.String(), 10, 64)
+	if err != nil {
+		return 0, errMemcacheNonNumeric
+	}
+	switch {
+	case incr:
+		n += delta // wraps around at 64 bits like memcached
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+
+	// the counter keeps the flags and the remaining time to live of the key
+	var ttl time.Duration
+	if !view.Expire().IsZero() {
+		if ttl = time.Until(view.Expire()); ttl <= 0 {
+			return 0, errMemcacheNotFound
+		}
+	}
+	return n, s.group.setWithFlags(s.ctx, key, []byte(strconv.FormatUint(n, 10)), view.Flags(), ttl)
+}
+
+// write stores value and its flags with a memcached exptime, a negative
+// one expires the key at once.
+func (s *MemcacheServer) write(key string, value []byte, flags uint32, exptime int64) error {
+	var ttl time.Duration
+	switch {
+	case exptime < 0:
+		_, err := s.group.deleteWithContext(s.ctx, key)
+		return err
+	case exptime == 0:
+	case exptime <= memcacheRelativeExpireLimit:
+		ttl = time.Duration(exptime) * time.Second
+	default:
+		if ttl = time.Until(time.Unix(exptime, 0)); ttl <= 0 {
+			_, err := s.group.deleteWithContext(s.ctx, key)
+			return err
+		}
+	}
+	return s.group.setWithFlags(s.ctx, key, value, flags, ttl)
+}
+
+func (s *MemcacheServer) reply(w *bufio.Writer, noreply bool, msg string) error {
+	if noreply {
+		return nil
+	}
+	_, err := w.WriteString(msg + "\r\n")
+	return err
+}
+
+func writeMemcacheError(w *bufio.Writer, err error) error {
+	_, werr := fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+	return werr
+}
+
+// readMemcacheLine reads a command line without its "\r\n".
+func readMemcacheLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxMemcacheLineLen {
+			return "", errMemcacheLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func validMemcacheKey(key string) bool {
+	if len(key) == 0 || len(key) > maxMemcacheKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// keyLockStripes is the number of locks the keys of a keyLocks share.
+const keyLockStripes = 256
+
+// keyLocks serializes the read-modify-write commands of a front-end per
+// key, the keys are spread over a fixed number of locks.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// lock locks the stripe of the key of group and returns it.
+func (l *keyLocks) lock(group, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%keyLockStripes]
+	mu.Lock()
+	return mu
+}
+
+// casUnique derives the cas unique of a value from its content,
+// the group keeps no version of its entries.
+func casUnique(view ByteView) uint64 {
+	h := fnv.New64a()
+	h.Write(view.ByteSlice())
+	return h.Sum64()
+}
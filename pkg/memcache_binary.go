@@ -0,0 +1,451 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	binaryReqMagic = 0x80
+	binaryResMagic = 0x81
+
+	binaryHeaderLen = 24
+
+	// exptime of incr/decr which fails on a missing key instead of creating it
+	binaryNoCreate = 0xffffffff
+)
+
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opQuit      = 0x07
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opStat      = 0x10
+	opSetQ      = 0x11
+	opAddQ      = 0x12
+	opReplaceQ  = 0x13
+	opDeleteQ   = 0x14
+	opIncrQ     = 0x15
+	opDecrQ     = 0x16
+	opQuitQ     = 0x17
+	opTouch     = 0x1c
+)
+
+const (
+	statusOK              = 0x00
+	statusKeyNotFound     = 0x01
+	statusKeyExists       = 0x02
+	statusValueTooLarge   = 0x03
+	statusInvalidArgs     = 0x04
+	statusNotStored       = 0x05
+	statusNonNumeric      = 0x06
+	statusUnknownCommand  = 0x81
+	statusInternalError   = 0x84
+	statusTemporaryFailed = 0x86
+)
+
+var binaryStatusText = map[uint16]string{
+	statusKeyNotFound:     "Not found",
+	statusKeyExists:       "Data exists for key.",
+	statusValueTooLarge:   "Too large.",
+	statusInvalidArgs:     "Invalid arguments",
+	statusNotStored:       "Not stored.",
+	statusNonNumeric:      "Non-numeric server-side value for incr or decr",
+	statusUnknownCommand:  "Unknown command",
+	statusInternalError:   "Internal error",
+	statusTemporaryFailed: "Temporary failure",
+}
+
+// binaryQuiet maps the quiet opcodes to the command they are a variant of.
+var binaryQuiet = map[uint8]uint8{
+	opGetQ:     opGet,
+	opGetKQ:    opGetK,
+	opSetQ:     opSet,
+	opAddQ:     opAdd,
+	opReplaceQ: opReplace,
+	opDeleteQ:  opDelete,
+	opIncrQ:    opIncrement,
+	opDecrQ:    opDecrement,
+	opQuitQ:    opQuit,
+}
+
+// binaryHeader is the 24 bytes header of binary requests and responses,
+// status is the vbucket id in requests.
+type binaryHeader struct {
+	magic    uint8
+	opcode   uint8
+	keyLen   uint16
+	extLen   uint8
+	dataType uint8
+	status   uint16
+	bodyLen  uint32
+	opaque   uint32
+	cas      uint64
+}
+
+type binaryRequest struct {
+	binaryHeader
+	extras []byte
+	key    string
+	value  []byte
+}
+
+type binaryResponse struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// serveBinary serves the memcached binary protocol. The quiet commands
+// only answer failures (and hits for GetQ/GetKQ), responses are flushed
+// once the pipelined requests are all served. A run of pipelined quiet gets
+// is loaded at once, see binaryGets.
+func (s *MemcacheServer) serveBinary(conn net.Conn, r *bufio.Reader, w *bufio.Writer) {
+	var (
+		next    *binaryRequest // read after a run of quiet gets, served next
+		nextErr error
+		held    bool
+	)
+	for {
+		var req *binaryRequest
+		var err error
+		if held {
+			req, err, held = next, nextErr, false
+		} else {
+			req, err = readBinaryRequest(r, s.maxItemSize)
+		}
+		if err != nil && err != errMemcacheTooLarge {
+			logConnError(conn, err)
+			return
+		}
+
+		if err == nil && binaryQuietGet(req.opcode) {
+			// the quiet gets pipelined after req, up to a noop or
+			// another command, are loaded together
+			batch := []*binaryRequest{req}
+			for r.Buffered() > 0 {
+				next, nextErr = readBinaryRequest(r, s.maxItemSize)
+				if nextErr != nil || !binaryQuietGet(next.opcode) {
+					held = true
+					break
+				}
+				batch = append(batch, next)
+			}
+			if err := s.binaryGets(w, batch); err != nil {
+				return
+			}
+		} else {
+			opcode, quiet := req.opcode, false
+			if op, ok := binaryQuiet[opcode]; ok {
+				opcode, quiet = op, true
+			}
+
+			var res *binaryResponse
+			if err == errMemcacheTooLarge {
+				res = &binaryResponse{status: statusValueTooLarge}
+			} else {
+				res = s.binaryCommand(w, req, opcode)
+			}
+			if res != nil && !(quiet && res.status == statusOK && opcode != opGet && opcode != opGetK) {
+				if err := writeBinaryResponse(w, req, res); err != nil {
+					return
+				}
+			}
+
+			if opcode == opQuit {
+				w.Flush()
+				return
+			}
+		}
+		if !held && r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func binaryQuietGet(opcode uint8) bool {
+	return opcode == opGetQ || opcode == opGetKQ
+}
+
+// binaryGets serves quiet gets with one GetMultiContext, so the keys owned
+// by a peer are fetched in one request. The responses are written in the
+// order of the requests.
+func (s *MemcacheServer) binaryGets(w *bufio.Writer, reqs []*binaryRequest) error {
+	keys := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		if validBinaryGet(req) {
+			keys = append(keys, req.key)
+		}
+	}
+	views, err := s.group.GetMultiContext(s.ctx, keys)
+	errs, _ := err.(KeyErrors)
+
+	for _, req := range reqs {
+		var res *binaryResponse
+		if !validBinaryGet(req) {
+			res = &binaryResponse{status: statusInvalidArgs}
+		} else {
+			s.stats.cmdGet.Add(1)
+			view, ok := views[req.key]
+			err := errs[req.key]
+			if !ok && err == nil {
+				err = ErrNotFound
+			}
+			res = s.binaryGetResponse(req, binaryQuiet[req.opcode], view, err)
+		}
+		if res == nil {
+			continue
+		}
+		if err := writeBinaryResponse(w, req, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validBinaryGet reports whether req is a well formed get.
+func validBinaryGet(req *binaryRequest) bool {
+	return req.key != "" && validMemcacheKey(req.key) && len(req.extras) == 0 && len(req.value) == 0
+}
+
+// binaryGetResponse answers a get of the key of req, nil for a miss of a
+// quiet get, and counts the hit or miss.
+func (s *MemcacheServer) binaryGetResponse(req *binaryRequest, opcode uint8, view ByteView, err error) *binaryResponse {
+	if err != nil {
+		s.stats.getMisses.Add(1)
+		status := binaryGetStatus(err)
+		if status == statusKeyNotFound && binaryQuietGet(req.opcode) {
+			return nil
+		}
+		res := &binaryResponse{status: status}
+		if opcode == opGetK {
+			res.key = req.key
+		}
+		return res
+	}
+	s.stats.getHits.Add(1)
+	res := &binaryResponse{cas: casUnique(view), extras: make([]byte, 4), value: view.ByteSlice()}
+	binary.BigEndian.PutUint32(res.extras, view.Flags())
+	if opcode == opGetK {
+		res.key = req.key
+	}
+	return res
+}
+
+// binaryCommand serves one request, a nil response sends nothing.
+func (s *MemcacheServer) binaryCommand(w *bufio.Writer, req *binaryRequest, opcode uint8) *binaryResponse {
+	if req.key != "" && !validMemcacheKey(req.key) {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	switch opcode {
+	case opGet, opGetK:
+		if req.key == "" || len(req.extras) != 0 || len(req.value) != 0 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		s.stats.cmdGet.Add(1)
+		view, err := s.group.GetContext(s.ctx, req.key)
+		return s.binaryGetResponse(req, opcode, view, err)
+
+	case opSet, opAdd, opReplace:
+		if req.key == "" || len(req.extras) != 8 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		mode := map[uint8]string{opSet: "set", opAdd: "add", opReplace: "replace"}[opcode]
+		flags := binary.BigEndian.Uint32(req.extras)
+		exptime := int64(int32(binary.BigEndian.Uint32(req.extras[4:])))
+		err := s.storeItem(mode, req.key, req.value, flags, exptime, req.cas)
+		if err == errMemcacheNotStored {
+			// the binary protocol tells why add and replace did not store
+			if opcode == opAdd {
+				err = errMemcacheExists
+			} else {
+				err = errMemcacheNotFound
+			}
+		}
+		if err != nil {
+			return &binaryResponse{status: binaryWriteStatus(err)}
+		}
+		return &binaryResponse{cas: casUnique(ByteView{b: req.value})}
+
+	case opDelete:
+		if req.key == "" || len(req.extras) != 0 || len(req.value) != 0 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		deleted, err := s.group.deleteWithContext(s.ctx, req.key)
+		switch {
+		case err != nil:
+			return &binaryResponse{status: binaryWriteStatus(err)}
+		case !deleted:
+			return &binaryResponse{status: statusKeyNotFound}
+		}
+		return &binaryResponse{}
+
+	case opIncrement, opDecrement:
+		if req.key == "" || len(req.extras) != 20 || len(req.value) != 0 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		delta := binary.BigEndian.Uint64(req.extras)
+		var initial *uint64
+		exptime := binary.BigEndian.Uint32(req.extras[16:])
+		if exptime != binaryNoCreate {
+			n := binary.BigEndian.Uint64(req.extras[8:])
+			initial = &n
+		}
+		n, err := s.incrItem(req.key, delta, opcode == opIncrement, initial, int64(int32(exptime)))
+		if err != nil {
+			return &binaryResponse{status: binaryWriteStatus(err)}
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		return &binaryResponse{value: value}
+
+	case opTouch:
+		if req.key == "" || len(req.extras) != 4 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		exptime := int64(int32(binary.BigEndian.Uint32(req.extras)))
+		view, err := s.touchItem(req.key, exptime)
+		if err != nil {
+			return &binaryResponse{status: binaryWriteStatus(err)}
+		}
+		return &binaryResponse{cas: casUnique(view)}
+
+	case opNoop, opQuit:
+		return &binaryResponse{}
+
+	case opVersion:
+		return &binaryResponse{value: []byte(memcacheVersion)}
+
+	case opStat:
+		for _, stat := range s.statList() {
+			if err := writeBinaryResponse(w, req, &binaryResponse{key: stat[0], value: []byte(stat[1])}); err != nil {
+				return nil
+			}
+		}
+		// an empty stat ends the list
+		return &binaryResponse{}
+
+	default:
+		return &binaryResponse{status: statusUnknownCommand}
+	}
+}
+
+// binaryGetStatus maps the error of a Group read, only a key reported
+// missing is a miss, so clients do not take a failing backend for one.
+func binaryGetStatus(err error) uint16 {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return statusKeyNotFound
+	case errors.Is(err, ErrOverloaded), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return statusTemporaryFailed
+	default:
+		return statusInternalError
+	}
+}
+
+// binaryWriteStatus maps the error of an item operation or a Group write.
+func binaryWriteStatus(err error) uint16 {
+	switch {
+	case err == errMemcacheNotFound:
+		return statusKeyNotFound
+	case err == errMemcacheExists:
+		return statusKeyExists
+	case err == errMemcacheNotStored:
+		return statusNotStored
+	case err == errMemcacheNonNumeric:
+		return statusNonNumeric
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return statusTemporaryFailed
+	default:
+		return statusInternalError
+	}
+}
+
+var (
+	errMemcacheBadMagic = errors.New("bad request magic")
+	errMemcacheTooLarge = errors.New("object too large for cache")
+)
+
+// readBinaryRequest reads the next request. The body of a request larger
+// than maxItemSize is discarded and errMemcacheTooLarge returned along
+// with the header, so the connection stays in sync.
+func readBinaryRequest(r *bufio.Reader, maxItemSize int) (*binaryRequest, error) {
+	var buf [binaryHeaderLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	req := &binaryRequest{binaryHeader: binaryHeader{
+		magic:    buf[0],
+		opcode:   buf[1],
+		keyLen:   binary.BigEndian.Uint16(buf[2:]),
+		extLen:   buf[4],
+		dataType: buf[5],
+		status:   binary.BigEndian.Uint16(buf[6:]),
+		bodyLen:  binary.BigEndian.Uint32(buf[8:]),
+		opaque:   binary.BigEndian.Uint32(buf[12:]),
+		cas:      binary.BigEndian.Uint64(buf[16:]),
+	}}
+	if req.magic != binaryReqMagic {
+		return nil, errMemcacheBadMagic
+	}
+	fixed := uint32(req.keyLen) + uint32(req.extLen)
+	if req.bodyLen < fixed {
+		return nil, errMemcacheBadFormat
+	}
+	if int64(req.bodyLen-fixed) > int64(maxItemSize) {
+		if _, err := io.CopyN(io.Discard, r, int64(req.bodyLen)); err != nil {
+			return nil, err
+		}
+		return req, errMemcacheTooLarge
+	}
+
+	body := make([]byte, req.bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	req.extras = body[:req.extLen]
+	req.key = string(body[req.extLen:fixed])
+	req.value = body[fixed:]
+	return req, nil
+}
+
+func writeBinaryResponse(w *bufio.Writer, req *binaryRequest, res *binaryResponse) error {
+	value := res.value
+	if res.status != statusOK && value == nil {
+		value = []byte(binaryStatusText[res.status])
+	}
+
+	var buf [binaryHeaderLen]byte
+	buf[0] = binaryResMagic
+	buf[1] = req.opcode
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(res.key)))
+	buf[4] = uint8(len(res.extras))
+	binary.BigEndian.PutUint16(buf[6:], res.status)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(res.extras)+len(res.key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:], req.opaque)
+	binary.BigEndian.PutUint64(buf[16:], res.cas)
+
+	w.Write(buf[:])
+	w.Write(res.extras)
+	w.WriteString(res.key)
+	_, err := w.Write(value)
+	return err
+}
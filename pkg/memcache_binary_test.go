@@ -0,0 +1,273 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type binaryClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	extras []byte // of the last response read
+}
+
+func startBinaryMemcache(t *testing.T, g *Group) (*MemcacheServer, *binaryClient) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewMemcacheServer(g)
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return server, &binaryClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func binaryPacket(opcode uint8, opaque uint32, cas uint64, extras []byte, key string, value []byte) []byte {
+	packet := make([]byte, binaryHeaderLen, binaryHeaderLen+len(extras)+len(key)+len(value))
+	packet[0] = binaryReqMagic
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(key)))
+	packet[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(packet[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(packet[12:], opaque)
+	binary.BigEndian.PutUint64(packet[16:], cas)
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+func setExtras(flags, exptime uint32) []byte {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, flags)
+	binary.BigEndian.PutUint32(extras[4:], exptime)
+	return extras
+}
+
+func (c *binaryClient) send(packets ...[]byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(bytes.Join(packets, nil)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *binaryClient) read() (binaryHeader, string, []byte) {
+	c.t.Helper()
+	var buf [binaryHeaderLen]byte
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	h := binaryHeader{
+		magic:   buf[0],
+		opcode:  buf[1],
+		keyLen:  binary.BigEndian.Uint16(buf[2:]),
+		extLen:  buf[4],
+		status:  binary.BigEndian.Uint16(buf[6:]),
+		bodyLen: binary.BigEndian.Uint32(buf[8:]),
+		opaque:  binary.BigEndian.Uint32(buf[12:]),
+		cas:     binary.BigEndian.Uint64(buf[16:]),
+	}
+	body := make([]byte, h.bodyLen)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatal(err)
+	}
+	if h.magic != binaryResMagic {
+		c.t.Fatalf("response magic %#x", h.magic)
+	}
+	fixed := int(h.extLen) + int(h.keyLen)
+	c.extras = body[:h.extLen]
+	return h, string(body[h.extLen:fixed]), body[fixed:]
+}
+
+// expect reads the next response and checks its opcode, opaque and status.
+func (c *binaryClient) expect(opcode uint8, opaque uint32, status uint16) (binaryHeader, string, []byte) {
+	c.t.Helper()
+	h, key, value := c.read()
+	if h.opcode != opcode || h.opaque != opaque || h.status != status {
+		c.t.Fatalf("response opcode=%#x opaque=%d status=%#x %q, want opcode=%#x opaque=%d status=%#x",
+			h.opcode, h.opaque, h.status, value, opcode, opaque, status)
+	}
+	return h, key, value
+}
+
+func TestMemcacheBinaryPipeline(t *testing.T) {
+	_, c := startBinaryMemcache(t, memcacheGroup("binary-pipeline"))
+
+	// quiet sets answer nothing, quiet gets answer hits only, noop ends the batch
+	c.send(
+		binaryPacket(opSetQ, 1, 0, setExtras(0, 0), "a", []byte("va")),
+		binaryPacket(opSetQ, 2, 0, setExtras(0xdeadbeef, 0), "b", []byte("vb")),
+		binaryPacket(opGetKQ, 3, 0, nil, "a", nil),
+		binaryPacket(opGetKQ, 4, 0, nil, "missing", nil),
+		binaryPacket(opGetQ, 5, 0, nil, "db-Tom", nil),
+		binaryPacket(opGetK, 6, 0, nil, "b", nil),
+		binaryPacket(opNoop, 7, 0, nil, "", nil),
+	)
+	if _, key, value := c.expect(opGetKQ, 3, statusOK); key != "a" || string(value) != "va" {
+		t.Fatalf("GetKQ a = %q %q", key, value)
+	}
+	if _, key, value := c.expect(opGetQ, 5, statusOK); key != "" || string(value) != "value-db-Tom" {
+		t.Fatalf("GetQ db-Tom = %q %q", key, value)
+	}
+	if h, key, value := c.expect(opGetK, 6, statusOK); key != "b" || string(value) != "vb" || h.extLen != 4 {
+		t.Fatalf("GetK b = %q %q extras %d", key, value, h.extLen)
+	}
+	if flags := binary.BigEndian.Uint32(c.extras); flags != 0xdeadbeef {
+		t.Fatalf("GetK b flags = %#x, want the flags of the set", flags)
+	}
+	c.expect(opNoop, 7, statusOK)
+
+	c.send(binaryPacket(opGetK, 8, 0, nil, "missing", nil))
+	if _, key, _ := c.expect(opGetK, 8, statusKeyNotFound); key != "missing" {
+		t.Fatalf("GetK miss returned key %q", key)
+	}
+}
+
+func TestMemcacheBinaryBatchesQuietGets(t *testing.T) {
+	peer := &batchPeer{owner: memcacheGroup("binary-batch-owner")}
+	g := memcacheGroup("binary-batch")
+	picker := batchPicker{peer}
+	g.RegisterPeerPicker(picker)
+	_, c := startBinaryMemcache(t, g)
+
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		key := fmt.Sprintf("db-%d", i)
+		if _, ok := picker.PickPeer(key); ok {
+			keys = append(keys, key)
+		}
+	}
+	var packets [][]byte
+	for i, key := range keys {
+		packets = append(packets, binaryPacket(opGetKQ, uint32(i), 0, nil, key, nil))
+	}
+	c.send(append(packets, binaryPacket(opNoop, 99, 0, nil, "", nil))...)
+	for i, key := range keys {
+		if _, got, value := c.expect(opGetKQ, uint32(i), statusOK); got != key || string(value) != "value-"+key {
+			t.Fatalf("GetKQ %d = %q %q, want %s", i, got, value, key)
+		}
+	}
+	c.expect(opNoop, 99, statusOK)
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.batches != 1 || len(peer.gets) != 0 {
+		t.Fatalf("peer got %d batches and %d gets, want the quiet gets in one batch", peer.batches, len(peer.gets))
+	}
+}
+
+func TestMemcacheBinaryGetErrors(t *testing.T) {
+	_, c := startBinaryMemcache(t, memcacheGroup("binary-get-errors"))
+
+	// a failing getter is not a miss, the quiet gets answer it too
+	c.send(binaryPacket(opGet, 1, 0, nil, "broken-k", nil))
+	c.expect(opGet, 1, statusInternalError)
+	c.send(binaryPacket(opGet, 2, 0, nil, "overloaded-k", nil))
+	c.expect(opGet, 2, statusTemporaryFailed)
+	c.send(
+		binaryPacket(opGetKQ, 3, 0, nil, "missing", nil),
+		binaryPacket(opGetKQ, 4, 0, nil, "broken-k", nil),
+		binaryPacket(opNoop, 5, 0, nil, "", nil),
+	)
+	if _, key, _ := c.expect(opGetKQ, 4, statusInternalError); key != "broken-k" {
+		t.Fatalf("GetKQ failure returned key %q", key)
+	}
+	c.expect(opNoop, 5, statusOK)
+}
+
+func TestMemcacheBinaryCAS(t *testing.T) {
+	_, c := startBinaryMemcache(t, memcacheGroup("binary-cas"))
+
+	c.send(binaryPacket(opSet, 1, 0, setExtras(0, 0), "k", []byte("v1")))
+	set, _, _ := c.expect(opSet, 1, statusOK)
+	c.send(binaryPacket(opGet, 2, 0, nil, "k", nil))
+	if get, _, _ := c.expect(opGet, 2, statusOK); get.cas == 0 || get.cas != set.cas {
+		t.Fatalf("cas of get %d, of set %d", get.cas, set.cas)
+	}
+
+	c.send(binaryPacket(opSet, 3, set.cas+1, setExtras(0, 0), "k", []byte("v2")))
+	c.expect(opSet, 3, statusKeyExists)
+	c.send(binaryPacket(opSet, 4, set.cas, setExtras(0, 0), "k", []byte("v2")))
+	c.expect(opSet, 4, statusOK)
+	c.send(binaryPacket(opSet, 5, set.cas, setExtras(0, 0), "k", []byte("v3")))
+	c.expect(opSet, 5, statusKeyExists)
+	c.send(binaryPacket(opSet, 6, 1, setExtras(0, 0), "missing", []byte("v")))
+	c.expect(opSet, 6, statusKeyNotFound)
+
+	c.send(binaryPacket(opAdd, 7, 0, setExtras(0, 0), "k", []byte("v")))
+	c.expect(opAdd, 7, statusKeyExists)
+	c.send(binaryPacket(opReplace, 8, 0, setExtras(0, 0), "missing", []byte("v")))
+	c.expect(opReplace, 8, statusKeyNotFound)
+}
+
+func TestMemcacheBinaryCommands(t *testing.T) {
+	server, c := startBinaryMemcache(t, memcacheGroup("binary-commands"))
+	server.maxItemSize = 8
+
+	c.send(binaryPacket(opDelete, 1, 0, nil, "missing", nil))
+	c.expect(opDelete, 1, statusKeyNotFound)
+	c.send(binaryPacket(opSetQ, 2, 0, setExtras(0, 0), "k", []byte("v")), binaryPacket(opDeleteQ, 3, 0, nil, "k", nil))
+	c.send(binaryPacket(opDelete, 4, 0, nil, "k", nil))
+	c.expect(opDelete, 4, statusKeyNotFound)
+
+	incr := make([]byte, 20)
+	binary.BigEndian.PutUint64(incr, 5)
+	binary.BigEndian.PutUint64(incr[8:], 10)
+	c.send(binaryPacket(opIncrement, 5, 0, incr, "n", nil))
+	if _, _, value := c.expect(opIncrement, 5, statusOK); binary.BigEndian.Uint64(value) != 10 {
+		t.Fatalf("incr created %d, want the initial 10", binary.BigEndian.Uint64(value))
+	}
+	c.send(binaryPacket(opDecrement, 6, 0, incr, "n", nil))
+	if _, _, value := c.expect(opDecrement, 6, statusOK); binary.BigEndian.Uint64(value) != 5 {
+		t.Fatalf("decr = %d, want 5", binary.BigEndian.Uint64(value))
+	}
+	binary.BigEndian.PutUint32(incr[16:], binaryNoCreate)
+	c.send(binaryPacket(opIncrement, 7, 0, incr, "other", nil))
+	c.expect(opIncrement, 7, statusKeyNotFound)
+	c.send(binaryPacket(opIncrement, 8, 0, incr, "db-Tom", nil))
+	c.expect(opIncrement, 8, statusNonNumeric)
+
+	c.send(binaryPacket(opSet, 9, 0, setExtras(0, 0), "big", []byte("123456789")))
+	c.expect(opSet, 9, statusValueTooLarge)
+	c.send(binaryPacket(opSet, 10, 0, nil, "k", []byte("v")))
+	c.expect(opSet, 10, statusInvalidArgs)
+	c.send(binaryPacket(0x30, 11, 0, nil, "", nil))
+	c.expect(0x30, 11, statusUnknownCommand)
+
+	c.send(binaryPacket(opVersion, 12, 0, nil, "", nil))
+	if _, _, value := c.expect(opVersion, 12, statusOK); string(value) != memcacheVersion {
+		t.Fatalf("version %q", value)
+	}
+
+	c.send(binaryPacket(opStat, 13, 0, nil, "", nil))
+	stats := make(map[string]string)
+	for {
+		_, key, value := c.expect(opStat, 13, statusOK)
+		if key == "" {
+			break
+		}
+		stats[key] = string(value)
+	}
+	if stats["version"] != memcacheVersion || stats["curr_items"] != "2" {
+		t.Fatalf("stats = %v", stats)
+	}
+
+	c.send(binaryPacket(opQuit, 14, 0, nil, "", nil))
+	c.expect(opQuit, 14, statusOK)
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatalf("connection still open after quit")
+	}
+}
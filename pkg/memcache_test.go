@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memcacheClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startMemcache(t *testing.T, g *Group) *memcacheClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewMemcacheServer(g)
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &memcacheClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends raw and checks the following lines of the reply.
+func (c *memcacheClient) do(raw string, expect ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(raw)); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, want := range expect {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: reading %q: %v", raw, want, err)
+		}
+		if got := strings.TrimSuffix(line, "\r\n"); got != want {
+			c.t.Fatalf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func memcacheGroup(name string, opts ...GroupOption) *Group {
+	return newGroup(name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(key, "db-"):
+			return []byte("value-" + key), nil
+		case strings.HasPrefix(key, "overloaded-"):
+			return nil, fmt.Errorf("%s: %w", key, ErrOverloaded)
+		case strings.HasPrefix(key, "broken-"):
+			return nil, fmt.Errorf("%s: backing store failed", key)
+		}
+		return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+	}), opts...)
+}
+
+func TestMemcacheStorage(t *testing.T) {
+	c := startMemcache(t, memcacheGroup("memcache-storage"))
+
+	c.do("get db-Tom missing\r\n", "VALUE db-Tom 0 12", "value-db-Tom", "END")
+	c.do("set k 5 0 5\r\nhello\r\n", "STORED")
+	c.do("get k\r\n", "VALUE k 5 5", "hello", "END")
+	c.do("gets k\r\n", fmt.Sprintf("VALUE k 5 5 %d", casUnique(ByteView{b: []byte("hello")})), "hello", "END")
+
+	c.do("add k 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("add db-Tom 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("add new 0 0 3\r\nnew\r\n", "STORED")
+	c.do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("replace k 0 0 5\r\nworld\r\n", "STORED")
+	c.do("get k new\r\n", "VALUE k 0 5", "world", "VALUE new 0 3", "new", "END")
+
+	c.do("delete k\r\n", "DELETED")
+	c.do("delete k\r\n", "NOT_FOUND")
+	c.do("get k\r\n", "END")
+
+	c.do("set k 0 0 3\r\nabcde\r\n", "CLIENT_ERROR bad data chunk")
+}
+
+func TestMemcacheFlags(t *testing.T) {
+	c := startMemcache(t, memcacheGroup("memcache-flags"))
+
+	c.do("set k 4294967295 0 1\r\nv\r\n", "STORED")
+	c.do("get k db-Tom\r\n", "VALUE k 4294967295 1", "v", "VALUE db-Tom 0 12", "value-db-Tom", "END")
+	c.do("gets k\r\n", fmt.Sprintf("VALUE k 4294967295 1 %d", casUnique(ByteView{b: []byte("v")})), "v", "END")
+	c.do("touch k 100\r\n", "TOUCHED")
+	c.do("set n 42 0 1\r\n1\r\n", "STORED")
+	c.do("incr n 1\r\n", "2")
+	c.do("get k n\r\n", "VALUE k 4294967295 1", "v", "VALUE n 42 1", "2", "END")
+	c.do("set k 4294967296 0 1\r\nv\r\n", "CLIENT_ERROR bad command line format")
+}
+
+// TestMemcacheFlagsOnPeers checks the flags travel with the values stored on
+// and read from other nodes.
+func TestMemcacheFlagsOnPeers(t *testing.T) {
+	for name, start := range map[string]func(t *testing.T, groupName string, count int, opts ...GroupOption) []*testNode{
+		"http": startHTTPNodes,
+		"grpc": startGRPCNodes,
+	} {
+		t.Run(name, func(t *testing.T) {
+			nodes := start(t, "memcache-flags-"+name, 2)
+			var key string
+			for i := 0; key == ""; i++ {
+				if owner, _ := ownerOf(nodes, fmt.Sprintf("key-%d", i)); owner == nodes[1] {
+					key = fmt.Sprintf("key-%d", i)
+				}
+			}
+			c := startMemcache(t, nodes[0].group)
+			c.do("set "+key+" 7 0 1\r\nv\r\n", "STORED")
+			c.do("get "+key+"\r\n", "VALUE "+key+" 7 1", "v", "END")
+			if view, ok := nodes[1].group.lookupCache(key); !ok || view.Flags() != 7 {
+				t.Fatalf("owner cached %q with flags %d, %v", key, view.Flags(), ok)
+			}
+		})
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	c := startMemcache(t, memcacheGroup("memcache-expire"))
+
+	c.do("set k 0 1 1\r\nv\r\n", "STORED")
+	c.do("touch k 100\r\n", "TOUCHED")
+	c.do("touch missing 1\r\n", "NOT_FOUND")
+	c.do("set gone 0 1 1\r\nv\r\n", "STORED")
+
+	time.Sleep(1100 * time.Millisecond)
+	c.do("get k gone\r\n", "VALUE k 0 1", "v", "END")
+
+	c.do("set k 0 -1 1\r\nv\r\n", "STORED")
+	c.do("get k\r\n", "END")
+	c.do(fmt.Sprintf("set k 0 %d 1\r\nv\r\n", time.Now().Add(-time.Hour).Unix()), "STORED")
+	c.do("get k\r\n", "END")
+}
+
+func TestMemcacheIncrDecr(t *testing.T) {
+	c := startMemcache(t, memcacheGroup("memcache-incr"))
+
+	c.do("set n 0 0 2\r\n10\r\n", "STORED")
+	c.do("incr n 5\r\n", "15")
+	c.do("decr n 20\r\n", "0")
+	c.do("incr n 18446744073709551615\r\n", "18446744073709551615")
+	c.do("incr n 2\r\n", "1")
+	c.do("incr missing 1\r\n", "NOT_FOUND")
+	c.do("incr db-Tom 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	c.do("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+}
+
+func TestMemcacheLocksPerKey(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := NewMemcacheServer(newGroup("memcache-locks", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if key == "slow" {
+			<-release
+		}
+		return nil, ErrNotFound
+	})))
+	defer server.Close()
+
+	// the add of a slow key holds its lock while loading it
+	go server.storeItem("add", "slow", []byte("v"), 0, 0, 0)
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error)
+	go func() { done <- server.storeItem("add", "other", []byte("v"), 0, 0, 0) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("add other: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the add of a key waits for the add of another key")
+	}
+}
+
+func TestMemcacheMisc(t *testing.T) {
+	c := startMemcache(t, memcacheGroup("memcache-misc"))
+
+	// noreply commands are pipelined with the next one
+	c.do("set a 0 0 1 noreply\r\na\r\nset b 0 0 1 noreply\r\nb\r\nget a b\r\n",
+		"VALUE a 0 1", "a", "VALUE b 0 1", "b", "END")
+	c.do("version\r\n", "VERSION "+memcacheVersion)
+	c.do("bogus\r\n", "ERROR")
+	c.do("get\r\n", "CLIENT_ERROR bad command line format")
+	c.do("get "+strings.Repeat("k", maxMemcacheKeyLen+1)+"\r\n", "CLIENT_ERROR bad command line format")
+
+	if _, err := c.conn.Write([]byte("stats\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[string]string)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "END" {
+			break
+		}
+		stats[fields[1]] = fields[2]
+	}
+	if stats["cmd_get"] != "2" || stats["get_hits"] != "2" || stats["cmd_set"] != "2" || stats["curr_items"] != "2" || stats["curr_connections"] != "1" {
+		t.Fatalf("stats = %v", stats)
+	}
+
+	c.do("quit\r\n")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatalf("connection still open after quit")
+	}
+}
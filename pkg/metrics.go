@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type groupMetric struct {
+	name, help string
+	value      func(g *Group) int64
+}
+
+var groupMetrics = []groupMetric{
+	{"alo_cache_gets_total", "Get requests, including from peers.", func(g *Group) int64 { return g.Stats.Gets.Get() }},
+	{"alo_cache_hits_total", "Gets served by the main or hot cache.", func(g *Group) int64 { return g.Stats.CacheHits.Get() }},
+	{"alo_cache_hot_cache_hits_total", "Gets served by the hot cache.", func(g *Group) int64 { return g.Stats.HotCacheHits.Get() }},
+	{"alo_cache_loads_total", "Cache misses that had to be loaded.", func(g *Group) int64 { return g.Stats.Loads.Get() }},
+	{"alo_cache_loads_deduped_total", "Loads left after singleflight deduplication.", func(g *Group) int64 { return g.Stats.LoadsDeduped.Get() }},
+	{"alo_cache_singleflight_dedups_total", "Loads which waited on an identical load in flight.", func(g *Group) int64 {
+		return g.Stats.Loads.Get() - g.Stats.LoadsDeduped.Get()
+	}},
+	{"alo_cache_peer_loads_total", "Values fetched from other peers.", func(g *Group) int64 { return g.Stats.PeerLoads.Get() }},
+	{"alo_cache_peer_errors_total", "Failed fetches from other peers.", func(g *Group) int64 { return g.Stats.PeerErrors.Get() }},
+	{"alo_cache_local_loads_total", "Values loaded by the getter of this node.", func(g *Group) int64 { return g.Stats.LocalLoads.Get() }},
+	{"alo_cache_local_load_errors_total", "Failed loads by the getter of this node.", func(g *Group) int64 { return g.Stats.LocalLoadErrs.Get() }},
+	{"alo_cache_negative_hits_total", "Gets answered not found by the negative cache.", func(g *Group) int64 { return g.Stats.NegativeHits.Get() }},
+	{"alo_cache_stale_hits_total", "Hits served past expiration while refreshed.", func(g *Group) int64 { return g.Stats.StaleHits.Get() }},
+	{"alo_cache_refreshes_total", "Background refreshes started by hits.", func(g *Group) int64 { return g.Stats.Refreshes.Get() }},
+	{"alo_cache_peer_retries_total", "Peer gets retried after failing to reach the peer.", func(g *Group) int64 { return g.Stats.PeerRetries.Get() }},
+	{"alo_cache_hedges_fired_total", "Second requests sent for slow peer gets.", func(g *Group) int64 { return g.Stats.HedgesFired.Get() }},
+	{"alo_cache_hedges_won_total", "Hedged requests which answered first.", func(g *Group) int64 { return g.Stats.HedgesWon.Get() }},
+	{"alo_cache_handed_off_total", "Entries sent to the peers now owning their keys.", func(g *Group) int64 { return g.Stats.HandedOff.Get() }},
+}
+
+type cacheMetric struct {
+	name, help, kind string
+	value            func(s CacheStats) int64
+}
+
+var cacheMetrics = []cacheMetric{
+	{"alo_cache_bytes", "Bytes used by the cache, keys included.", "gauge", func(s CacheStats) int64 { return s.Bytes }},
+	{"alo_cache_items", "Entries in the cache.", "gauge", func(s CacheStats) int64 { return s.Items }},
+	{"alo_cache_evictions_total", "Entries evicted to make room.", "counter", func(s CacheStats) int64 { return s.Evictions }},
+	{"alo_cache_expirations_total", "Entries removed because they expired.", "counter", func(s CacheStats) int64 { return s.Expirations }},
+}
+
+var cacheTypes = []struct {
+	label string
+	which CacheType
+}{
+	{"main", MainCache},
+	{"hot", HotCache},
+	{"negative", NegativeCache},
+}
+
+// MetricsHandler serves the statistics of every registered group
+// in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		writeMetrics(w, registeredGroups())
+	})
+}
+
+// registeredGroups returns the groups of globeGroups sorted by name.
+func registeredGroups() []*Group {
+	mu.RLock()
+	groups := make([]*Group, 0, len(globeGroups))
+	for _, g := range globeGroups {
+		groups = append(groups, g)
+	}
+	mu.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	return groups
+}
+
+func writeMetrics(w http.ResponseWriter, groups []*Group) {
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	for _, m := range groupMetrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, g := range groups {
+			fmt.Fprintf(buf, "%s{group=%q} %d\n", m.name, g.name, m.value(g))
+		}
+	}
+
+	stats := make([][]CacheStats, len(groups))
+	for i, g := range groups {
+		for _, c := range cacheTypes {
+			stats[i] = append(stats[i], g.CacheStats(c.which))
+		}
+	}
+	for _, m := range cacheMetrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for i, g := range groups {
+			for j, c := range cacheTypes {
+				fmt.Fprintf(buf, "%s{group=%q,cache=%q} %d\n", m.name, g.name, c.label, m.value(stats[i][j]))
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupStats(t *testing.T) {
+	release := make(chan struct{})
+	g := newGroup("stats", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if key == "missing" {
+			return nil, errors.New("not found")
+		}
+		<-release
+		return []byte(key), nil
+	}))
+
+	// concurrent misses on the same key share one load
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Get("Tom")
+		}()
+	}
+	for g.Stats.Loads.Get() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	g.Get("Tom")
+	g.Get("missing")
+
+	for _, c := range []struct {
+		name        string
+		got, expect int64
+	}{
+		{"Gets", g.Stats.Gets.Get(), 7},
+		{"CacheHits", g.Stats.CacheHits.Get(), 1},
+		{"Loads", g.Stats.Loads.Get(), 6},
+		{"LoadsDeduped", g.Stats.LoadsDeduped.Get(), 2},
+		{"LocalLoads", g.Stats.LocalLoads.Get(), 1},
+		{"LocalLoadErrs", g.Stats.LocalLoadErrs.Get(), 1},
+	} {
+		if c.got != c.expect {
+			t.Errorf("%s = %d, want %d", c.name, c.got, c.expect)
+		}
+	}
+
+	stats := g.CacheStats(MainCache)
+	if stats.Items != 1 || stats.Bytes != int64(len("Tom")*2) || stats.Hits != 1 {
+		t.Fatalf("main cache stats = %+v", stats)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	g := NewGroup("metrics", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	g.Get("Tom")
+	g.Get("Tom")
+
+	server := httptest.NewServer(MetricsHandler())
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", res.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE alo_cache_gets_total counter",
+		`alo_cache_gets_total{group="metrics"} 2`,
+		`alo_cache_hits_total{group="metrics"} 1`,
+		`alo_cache_local_loads_total{group="metrics"} 1`,
+		"# TYPE alo_cache_bytes gauge",
+		`alo_cache_bytes{group="metrics",cache="main"} 6`,
+		`alo_cache_items{group="metrics",cache="hot"} 0`,
+		`alo_cache_evictions_total{group="metrics",cache="main"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+}
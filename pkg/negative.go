@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned by a Getter, possibly wrapped, for keys missing
+// from the backing store. Unlike other errors it is cached, see WithNegativeCache,
+// and the owner reports it to the other nodes as not found.
+var ErrNotFound = errors.New("not found")
+
+// notFoundError is returned by the group for keys known to be missing,
+// errors.Is(err, ErrNotFound) holds.
+type notFoundError struct {
+	err    error     // from the getter, or ErrNotFound
+	expire time.Time // end of the negative entry, zero if it was not cached
+}
+
+func (e *notFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.err
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// WithNegativeCache remembers for ttl the keys the getter reported missing
+// with ErrNotFound, in a cache of maxBytes apart from the group's cacheBytes.
+// Requests for them fail with ErrNotFound without reaching the getter or the
+// owner. Writing the key drops its negative entry on the writing node, other
+// nodes forget it within ttl.
+func WithNegativeCache(ttl time.Duration, maxBytes int64) GroupOption {
+	return func(g *Group) {
+		g.negativeTTL = ttl
+		g.negCache.cacheSize = maxBytes
+	}
+}
+
+// lookupNegative returns the error of a key cached as not found, nil otherwise.
+func (g *Group) lookupNegative(key string) error {
+	if g.negativeTTL <= 0 {
+		return nil
+	}
+	v, ok := g.negCache.Get(key)
+	if !ok {
+		return nil
+	}
+	g.Stats.NegativeHits.Add(1)
+	return &notFoundError{err: fmt.Errorf("%s: %w", key, ErrNotFound), expire: v.Expire()}
+}
+
+// populateNegative remembers the key as not found until the earliest of the
+// group's negative TTL and expire, a zero expire sets no bound.
+func (g *Group) populateNegative(key string, err error, expire time.Time) error {
+	if g.negativeTTL <= 0 {
+		return &notFoundError{err: err}
+	}
+	limit := time.Now().Add(g.negativeTTL)
+	if expire.IsZero() || expire.After(limit) {
+		expire = limit
+	}
+	g.sweepOnce.Do(g.startSweeper)
+	g.negCache.Add(key, ByteView{e: expire})
+	return &notFoundError{err: err, expire: expire}
+}
+
+// notFoundFromPeer caches the NOT_FOUND answer of the owner.
+func (g *Group) notFoundFromPeer(key string, err error) error {
+	var expire time.Time
+	var pe *PeerError
+	if errors.As(err, &pe) && pe.TTL > 0 {
+		expire = time.Now().Add(pe.TTL)
+	}
+	return g.populateNegative(key, err, expire)
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	loads := 0
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	})
+	g := newGroup("negative", 2<<10, getter, WithNegativeCache(50*time.Millisecond, 1<<10))
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("Tom"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get = %v, want ErrNotFound", err)
+		}
+	}
+	if loads != 1 || g.Stats.NegativeHits.Get() != 2 {
+		t.Fatalf("loads=%d negative hits=%d, want 1 and 2", loads, g.Stats.NegativeHits.Get())
+	}
+	if g.Stats.Loads.Get() != g.Stats.Gets.Get()-g.Stats.CacheHits.Get()-g.Stats.NegativeHits.Get() {
+		t.Fatalf("Loads = %d, want the gets missing both caches", g.Stats.Loads.Get())
+	}
+	if stats := g.CacheStats(NegativeCache); stats.Items != 1 {
+		t.Fatalf("negative cache holds %d entries", stats.Items)
+	}
+
+	// a write replaces the negative entry
+	if err := g.Set("Tom", []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get("Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("Get after Set = %q, %v", view.String(), err)
+	}
+
+	// the negative entry expires on its own TTL
+	g.Get("Jack")
+	time.Sleep(60 * time.Millisecond)
+	g.Get("Jack")
+	if loads != 3 {
+		t.Fatalf("loaded %d times, want Jack reloaded after the negative TTL", loads)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	loads := 0
+	g := newGroup("negative-off", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, ErrNotFound
+	}))
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("Tom"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get = %v, want ErrNotFound", err)
+		}
+	}
+	if loads != 3 {
+		t.Fatalf("loaded %d times, misses must not be cached by default", loads)
+	}
+}
+
+// testNegativeCachePeers checks a missing key is loaded once by its owner
+// and remembered as not found by the other nodes.
+func testNegativeCachePeers(t *testing.T, nodes []*testNode) {
+	key := "missing-key"
+	owner, other := ownerOf(nodes, key)
+
+	for i := 0; i < 3; i++ {
+		for _, n := range nodes {
+			if _, err := n.group.Get(key); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get = %v, want ErrNotFound", err)
+			}
+		}
+	}
+	if loads := owner.loadCount(key); loads != 1 {
+		t.Fatalf("owner loaded %s %d times, want 1", key, loads)
+	}
+	if other.loadCount(key) != 0 {
+		t.Fatalf("a node which is not the owner loaded %s", key)
+	}
+	if other.group.Stats.NegativeHits.Get() != 2 {
+		t.Fatalf("negative hits = %d, want the peer answer remembered", other.group.Stats.NegativeHits.Get())
+	}
+
+	keys := []string{"key-1", "missing-1", "missing-2", "missing-3"}
+	views, err := other.group.GetMulti(keys)
+	var errs KeyErrors
+	if !errors.As(err, &errs) || len(errs) != 3 || len(views) != 1 {
+		t.Fatalf("GetMulti = %d values, %v", len(views), err)
+	}
+	for key, err := range errs {
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: %v, want ErrNotFound", key, err)
+		}
+	}
+	hits := other.group.Stats.NegativeHits.Get()
+	other.group.GetMulti(keys)
+	for _, key := range keys[1:] {
+		loads := 0
+		for _, n := range nodes {
+			loads += n.loadCount(key)
+		}
+		if loads != 1 {
+			t.Fatalf("%s loaded %d times, want 1", key, loads)
+		}
+	}
+	if other.group.Stats.NegativeHits.Get() != hits+3 {
+		t.Fatalf("second GetMulti was not answered by the negative cache")
+	}
+}
+
+func TestHTTPNegativeCache(t *testing.T) {
+	nodes := startHTTPNodes(t, "http-negative", 3, WithNegativeCache(time.Minute, 1<<10))
+	testNegativeCachePeers(t, nodes)
+
+	owner, _ := ownerOf(nodes, "missing-http")
+	res, err := http.Get("http://" + owner.addr + defaultBasePath + "http-negative/missing-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("owner answered %s for a missing key, want 404", res.Status)
+	}
+}
+
+func TestGRPCNegativeCache(t *testing.T) {
+	testNegativeCachePeers(t, startGRPCNodes(t, "grpc-negative", 3, WithNegativeCache(time.Minute, 1<<10)))
+}
+
+func TestNegativeCacheOwnerTTL(t *testing.T) {
+	// the other node keeps the negative entry no longer than the owner
+	nodes := startHTTPNodes(t, "negative-ttl", 2, WithNegativeCache(time.Minute, 1<<10))
+	owner, other := ownerOf(nodes, "missing-ttl")
+	owner.group.negativeTTL = 50 * time.Millisecond
+
+	other.group.Get("missing-ttl")
+	time.Sleep(60 * time.Millisecond)
+	other.group.Get("missing-ttl")
+	if loads := owner.loadCount("missing-ttl"); loads != 2 {
+		t.Fatalf("owner loaded %d times, want the key reloaded after its TTL", loads)
+	}
+}
@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// waitLoadsInterval is how often Drain checks the loads in flight.
+const waitLoadsInterval = 10 * time.Millisecond
+
+// Leaver is implemented by membership.Memberlist.
+type Leaver interface {
+	// Leave announces the departure of the node to the cluster.
+	Leave()
+}
+
+// DrainablePool is implemented by the pools a Node runs, HTTPPool and GRPCPool.
+type DrainablePool interface {
+	PeerManager
+	// Self returns the address of the current node in the ring.
+	Self() string
+	// Drain answers the requests of other nodes OVERLOADED from now on.
+	Drain()
+}
+
+/*
+Node runs the server of a pool and stops it without dropping requests.
+
+Drain prepares the node to exit:
+ 1. requests of other nodes are answered OVERLOADED, the callers load the keys themselves,
+ 2. the membership announces the departure, so the peers remove the node from their ring,
+ 3. the loads in flight finish, the ones the local frontends start meanwhile are not waited for,
+ 4. the hottest entries are handed to the nodes owning them once the node is off the ring.
+
+Shutdown drains the node and stops the server once its requests are answered.
+*/
+type Node struct {
+	pool       DrainablePool
+	addr       string
+	serve      func(lis net.Listener) error
+	shutdown   func(ctx context.Context) error
+	groups     []*Group
+	membership Leaver
+	handoff    int // entries handed to their new owners per group
+
+	drainOnce sync.Once
+	drainErr  error
+}
+
+// NewNode returns the node serving pool with server, whose Handler must
+// route the requests of the peers to pool. groups are drained with it.
+func NewNode(pool *HTTPPool, server *http.Server, groups ...*Group) *Node {
+	serve := func(lis net.Listener) error {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(lis, "", "")
+		} else {
+			err = server.Serve(lis)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+	return &Node{pool: pool, addr: server.Addr, serve: serve, shutdown: server.Shutdown, groups: groups}
+}
+
+// NewGRPCNode returns the node serving pool on addr. groups are drained with
+// it.
+func NewGRPCNode(pool *GRPCPool, addr string, groups ...*Group) *Node {
+	serve := func(lis net.Listener) error {
+		if err := pool.Serve(lis); !errors.Is(err, grpc.ErrServerStopped) {
+			return err
+		}
+		return nil
+	}
+	return &Node{pool: pool, addr: addr, serve: serve, shutdown: pool.Shutdown, groups: groups}
+}
+
+// SetMembership sets the membership told the node leaves when it drains.
+func (n *Node) SetMembership(membership Leaver) {
+	n.membership = membership
+}
+
+// SetHandoff hands up to entries of the hottest values of every group to
+// their new owners when the node drains, 0 drops them.
+func (n *Node) SetHandoff(entries int) {
+	n.handoff = entries
+}
+
+// Start listens on the address of the node and serves in background, with
+// TLS when the HTTP server has a TLSConfig.
+func (n *Node) Start() error {
+	lis, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	n.start(lis)
+	return nil
+}
+
+func (n *Node) start(lis net.Listener) {
+	go func() {
+		if err := n.serve(lis); err != nil {
+			log.Printf("[Node %s] serve: %v", n.pool.Self(), err)
+		}
+	}()
+}
+
+// Drain stops serving other nodes and leaves the cluster, see Node. The
+// server keeps running, e.g. to answer the requests in flight. Only the first
+// call drains, the next ones return its error.
+func (n *Node) Drain(ctx context.Context) error {
+	n.drainOnce.Do(func() {
+		n.drainErr = n.drain(ctx)
+	})
+	return n.drainErr
+}
+
+func (n *Node) drain(ctx context.Context) error {
+	n.pool.Drain()
+	if n.membership != nil {
+		n.membership.Leave()
+	}
+	for _, g := range n.groups {
+		if err := g.waitLoads(ctx); err != nil {
+			return err
+		}
+	}
+	if n.handoff <= 0 {
+		return nil
+	}
+
+	// the keys of the node go to the next peers of the ring
+	n.pool.RemovePeer(n.pool.Self())
+	for _, g := range n.groups {
+		if err := g.handOff(ctx, n.handoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown drains the node, then stops the server once the requests in
+// flight are answered or ctx is done.
+func (n *Node) Shutdown(ctx context.Context) error {
+	return errors.Join(n.Drain(ctx), n.shutdown(ctx))
+}
+
+// waitLoads returns once the loads and refreshes in flight when it was
+// called are done, or ctx is done. The loads started afterwards, e.g. by the
+// local frontends, are not waited for.
+func (g *Group) waitLoads(ctx context.Context) error {
+	ticker := time.NewTicker(waitLoadsInterval)
+	defer ticker.Stop()
+	started := g.inflight.mark()
+	for g.inflight.runningBefore(started) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// loadTracker numbers the loads in flight, so that Drain waits only for
+// the ones started before it.
+type loadTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	running map[uint64]struct{}
+}
+
+// start records a load and returns its id, pass it to done.
+func (t *loadTracker) start() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running == nil {
+		t.running = make(map[uint64]struct{})
+	}
+	id := t.next
+	t.next++
+	t.running[id] = struct{}{}
+	return id
+}
+
+func (t *loadTracker) done(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.running, id)
+}
+
+// mark returns the id of the next load.
+func (t *loadTracker) mark() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.next
+}
+
+// runningBefore reports whether a load started before the mark is running.
+func (t *loadTracker) runningBefore(mark uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.running {
+		if id < mark {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of loads in flight.
+func (t *loadTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.running)
+}
+
+// handOff sends up to n of the hottest values of the main cache to the peers
+// owning them, with their remaining time to live, paced as set by
+// WithRebalance. A value a peer failed to take is dropped, its owner loads it
+// again on the next miss.
+func (g *Group) handOff(ctx context.Context, n int) error {
+	limiter := &byteLimiter{rate: g.rebalanceRate}
+	handed := 0
+	for peer, entries := range g.movedEntries(g.mainCache.hottest(n)) {
+		sent, err := g.sendEntries(ctx, peer, entries, limiter)
+		handed += sent
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("[Group %s] hand off: %v", g.name, err)
+		}
+	}
+	log.Printf("[Group %s] handed %d entries off", g.name, handed)
+	return nil
+}
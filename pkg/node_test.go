@@ -0,0 +1,220 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// leaverFunc is a Leaver calling the function.
+type leaverFunc func()
+
+func (f leaverFunc) Leave() { f() }
+
+// startNodes serves count test nodes with a Node each.
+type startNodes func(t *testing.T, groupName string, count int, opts ...GroupOption) ([]*testNode, []*Node, []DrainablePool)
+
+func startHTTPLifecycles(t *testing.T, groupName string, count int, opts ...GroupOption) ([]*testNode, []*Node, []DrainablePool) {
+	t.Helper()
+	nodes := make([]*testNode, count)
+	lises := make([]net.Listener, count)
+	addrs := make([]string, count)
+	for i := range nodes {
+		nodes[i], lises[i] = newTestNode(t, groupName, opts...)
+		addrs[i] = "http://" + nodes[i].addr
+	}
+	lifecycles := make([]*Node, count)
+	pools := make([]DrainablePool, count)
+	for i, n := range nodes {
+		pool := NewHTTPPool(addrs[i])
+		pool.getGroup = n.lookup
+		pool.SetPeers(addrs...)
+		n.group.RegisterPeerPicker(pool)
+		server := &http.Server{Handler: pool}
+		lifecycles[i] = NewNode(pool, server, n.group)
+		lifecycles[i].start(lises[i])
+		n.stop = func() { server.Close() }
+		t.Cleanup(n.stop)
+		pools[i] = pool
+	}
+	return nodes, lifecycles, pools
+}
+
+func startGRPCLifecycles(t *testing.T, groupName string, count int, opts ...GroupOption) ([]*testNode, []*Node, []DrainablePool) {
+	t.Helper()
+	nodes := make([]*testNode, count)
+	lises := make([]net.Listener, count)
+	addrs := make([]string, count)
+	for i := range nodes {
+		nodes[i], lises[i] = newTestNode(t, groupName, opts...)
+		addrs[i] = nodes[i].addr
+	}
+	lifecycles := make([]*Node, count)
+	pools := make([]DrainablePool, count)
+	for i, n := range nodes {
+		pool := NewGRPCPool(n.addr)
+		pool.getGroup = n.lookup
+		pool.SetPeers(addrs...)
+		n.group.RegisterPeerPicker(pool)
+		lifecycles[i] = NewGRPCNode(pool, n.addr, n.group)
+		lifecycles[i].start(lises[i])
+		n.stop = pool.Stop
+		t.Cleanup(pool.Stop)
+		pools[i] = pool
+	}
+	return nodes, lifecycles, pools
+}
+
+// testTransports runs test over HTTP and gRPC nodes.
+func testTransports(t *testing.T, test func(t *testing.T, start startNodes)) {
+	t.Run("http", func(t *testing.T) { test(t, startHTTPLifecycles) })
+	t.Run("grpc", func(t *testing.T) { test(t, startGRPCLifecycles) })
+}
+
+func TestNodeDrainTurnsPeersAway(t *testing.T) {
+	testTransports(t, testNodeDrainTurnsPeersAway)
+}
+
+func testNodeDrainTurnsPeersAway(t *testing.T, start startNodes) {
+	nodes, lifecycles, _ := start(t, "drain-away", 2)
+	owner, other := ownerOf(nodes, "key-1")
+	var drained *Node
+	for i, n := range nodes {
+		if n == owner {
+			drained = lifecycles[i]
+		}
+	}
+	if err := drained.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	// the owner answers OVERLOADED and the caller loads the key itself
+	view, err := other.group.Get("key-1")
+	if err != nil || view.String() != "value-key-1" {
+		t.Fatalf("Get = %q, %v", view.String(), err)
+	}
+	if owner.loadCount("key-1") != 0 || other.loadCount("key-1") != 1 {
+		t.Fatalf("loads on owner = %d, on caller = %d, want 0 and 1",
+			owner.loadCount("key-1"), other.loadCount("key-1"))
+	}
+}
+
+func TestNodeDrainHandsOffHotEntries(t *testing.T) {
+	testTransports(t, testNodeDrainHandsOffHotEntries)
+}
+
+func testNodeDrainHandsOffHotEntries(t *testing.T, start startNodes) {
+	nodes, lifecycles, pools := start(t, "drain-handoff", 3, WithTTL(time.Minute))
+	leaving := nodes[0]
+	// the peers drop the node from their ring as the membership would
+	lifecycles[0].SetMembership(leaverFunc(func() {
+		for _, pool := range pools[1:] {
+			pool.RemovePeer(pools[0].Self())
+		}
+	}))
+	lifecycles[0].SetHandoff(100)
+
+	var owned []string
+	for i := 0; len(owned) < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner, _ := ownerOf(nodes, key); owner == leaving {
+			owned = append(owned, key)
+			if _, err := nodes[1].group.Get(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := lifecycles[0].Drain(context.Background()); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	// the new owners start with the values, nothing is loaded again
+	for _, key := range owned {
+		for _, n := range nodes[1:] {
+			view, err := n.group.Get(key)
+			if err != nil || view.String() != "value-"+key {
+				t.Fatalf("Get(%q) = %q, %v", key, view.String(), err)
+			}
+			if view.Expire().IsZero() || time.Until(view.Expire()) > time.Minute {
+				t.Fatalf("Get(%q) expires %v, want the remaining TTL", key, view.Expire())
+			}
+			if loads := n.loadCount(key); loads != 0 {
+				t.Fatalf("%q loaded %d times after the handoff", key, loads)
+			}
+		}
+	}
+}
+
+func TestNodeDrainWaitsForLoads(t *testing.T) {
+	release, late := make(chan struct{}), make(chan struct{})
+	defer close(late)
+	g := newGroup("drain-wait", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if key == "slow" {
+			<-release
+		} else {
+			<-late
+		}
+		return []byte(key), nil
+	}))
+	node := NewNode(NewHTTPPool("http://127.0.0.1:0"), &http.Server{}, g)
+
+	go g.Get("slow")
+	for g.inflight.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := g.waitLoads(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("waitLoads = %v with a load in flight, want the deadline", err)
+	}
+
+	var drained atomic.Bool
+	done := make(chan error)
+	go func() {
+		err := node.Drain(context.Background())
+		drained.Store(true)
+		done <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if drained.Load() {
+		t.Fatal("Drain returned before the load finished")
+	}
+	// a load started during the drain, e.g. by a local frontend, does not hold it
+	go g.Get("late")
+	for g.inflight.len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Drain: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Drain waits for a load started after it")
+	}
+}
+
+func TestNodeShutdown(t *testing.T) {
+	testTransports(t, testNodeShutdown)
+}
+
+func testNodeShutdown(t *testing.T, start startNodes) {
+	nodes, lifecycles, pools := start(t, "shutdown", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lifecycles[0].Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if conn, err := net.Dial("tcp", nodes[0].addr); err == nil {
+		conn.Close()
+		t.Fatal("the server still accepts connections after Shutdown")
+	}
+	// e.g. a late membership event
+	pools[0].AddPeer("127.0.0.1:1")
+	pools[0].RemovePeer(nodes[1].addr)
+}
@@ -1,18 +1,27 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/alo-distributed-memcached/pb"
 	"google.golang.org/protobuf/proto"
 )
 
+// timeoutHeader carries the time left before the caller's deadline, in
+// milliseconds, so the deadline follows the request across hops.
+const timeoutHeader = "X-Alo-Timeout-Ms"
 
 type PeerGetter interface {
-	GetDataFromPeer(in *pb.Request, out *pb.Response) error
+	GetDataFromPeer(ctx context.Context, in *pb.Request, out *pb.Response) error
+	SetDataToPeer(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error
+	DeleteDataFromPeer(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error
 }
 
 /*
@@ -21,37 +30,194 @@ Implement HTTP Client function for Node
 */
 type HTTPGetter struct {
 	baseURL string
+	client  *http.Client    // http.DefaultClient when nil
+	breaker *circuitBreaker // nil when the pool has no breakers
 }
 
-func (h *HTTPGetter) GetDataFromPeer(in *pb.Request, out *pb.Response) error {
-	// /<basepath>/<groupname>/<key>
-	url := fmt.Sprintf(
+func (h *HTTPGetter) GetDataFromPeer(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url(in.GetGroup(), in.GetKey()), nil)
+	if err != nil {
+		return err
+	}
+	return h.do(request, out)
+}
+
+// SetDataToPeer sends PUT /<basepath>/<groupname>/<key>?ttl_ms=<ttl>&flags=<flags>&replica=true with the raw value as body.
+func (h *HTTPGetter) SetDataToPeer(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	query := url.Values{}
+	if in.GetTtlMs() != 0 {
+		query.Set("ttl_ms", strconv.FormatInt(in.GetTtlMs(), 10))
+	}
+	if in.GetFlags() != 0 {
+		query.Set("flags", strconv.FormatUint(uint64(in.GetFlags()), 10))
+	}
+	if in.GetReplica() {
+		query.Set("replica", "true")
+	}
+	u := h.url(in.GetGroup(), in.GetKey())
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(in.GetValue()))
+	if err != nil {
+		return err
+	}
+	return h.do(request, out)
+}
+
+// DeleteDataFromPeer sends DELETE /<basepath>/<groupname>/<key>.
+func (h *HTTPGetter) DeleteDataFromPeer(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	u := h.url(in.GetGroup(), in.GetKey())
+	if in.GetReplica() {
+		u += "?replica=true"
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	return h.do(request, out)
+}
+
+// GetMultiFromPeer sends POST /<basepath>/<groupname>/ with the BatchRequest as body.
+func (h *HTTPGetter) GetMultiFromPeer(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url(in.GetGroup(), ""), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	return h.do(request, out)
+}
+
+// HandOffToPeer sends PUT /<basepath>/<groupname>/ with the HandoffRequest as body.
+func (h *HTTPGetter) HandOffToPeer(ctx context.Context, in *pb.HandoffRequest, out *pb.HandoffResponse) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, h.url(in.GetGroup(), ""), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	return h.do(request, out)
+}
+
+// url returns /<basepath>/<groupname>/<key> of the peer.
+func (h *HTTPGetter) url(group, key string) string {
+	return fmt.Sprintf(
 		"%v%v/%v",
 		h.baseURL,
-		url.QueryEscape(in.GetGroup()),
-		url.QueryEscape(in.GetKey()),
+		url.QueryEscape(group),
+		url.QueryEscape(key),
 	)
+}
 
-	response, err := http.Get(url)
+// do sends the request through the breaker of the peer.
+func (h *HTTPGetter) do(request *http.Request, out proto.Message) error {
+	return h.breaker.call(request.Context(), func() error {
+		return h.roundTrip(request, out)
+	})
+}
+
+func (h *HTTPGetter) roundTrip(request *http.Request, out proto.Message) error {
+	if deadline, ok := request.Context().Deadline(); ok {
+		// rounded up, so the owner does not give up before the caller
+		ms := (time.Until(deadline) + time.Millisecond - 1) / time.Millisecond
+		request.Header.Set(timeoutHeader, strconv.FormatInt(int64(ms), 10))
+	}
+	client := h.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%s %s%s: %w: %v", request.Method, request.URL.Host, request.URL.Path, errPeerRejected, response.Status)
+	}
 	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("GetDataFromPeer():server returner %v", response.Status)
+		if err := readErrorResponse(response); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s %s: server returned %v", request.Method, request.URL.Path, response.Status)
 	}
 
-	bytes, err := io.ReadAll(response.Body)
+	body, err := io.ReadAll(response.Body)
 	if err != nil {
-		return fmt.Errorf("GetDataFromPeer():reading response body: %v", err)
+		return fmt.Errorf("%s %s: reading response body: %v", request.Method, request.URL.Path, err)
 	}
 
-	if err := proto.Unmarshal(bytes, out); err != nil{
+	if err := proto.Unmarshal(body, out); err != nil {
 		return fmt.Errorf("decoding response body: %v", err)
 	}
-
 	return nil
 }
 
+// readErrorResponse returns the PeerError of a failed response carrying a
+// pb.Response, nil for other failures, e.g. of a proxy.
+func readErrorResponse(response *http.Response) error {
+	if response.Header.Get("Content-Type") != "application/octet-stream" {
+		return nil
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil
+	}
+	res := &pb.Response{}
+	if err := proto.Unmarshal(body, res); err != nil {
+		return nil
+	}
+	return responseError(res)
+}
+
 var _ PeerGetter = (*HTTPGetter)(nil)
+var _ BatchPeerGetter = (*HTTPGetter)(nil)
+var _ HandoffPeerGetter = (*HTTPGetter)(nil)
+
+// requestContext derives the context of a request from another node,
+// bounded by the caller's deadline carried in timeoutHeader.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if ms, err := strconv.ParseInt(r.Header.Get(timeoutHeader), 10, 64); err == nil {
+		return context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// viewToResponse builds the response served to other nodes,
+// carrying the remaining time to live of the view.
+func viewToResponse(view ByteView) *pb.Response {
+	res := &pb.Response{Value: view.ByteSlice(), Flags: view.f}
+	if view.Stale() {
+		res.Stale = true
+		return res
+	}
+	if !view.Expire().IsZero() {
+		ttl := time.Until(view.Expire()).Milliseconds()
+		if ttl < 1 {
+			ttl = 1
+		}
+		res.TtlMs = ttl
+	}
+	return res
+}
+
+// viewFromResponse converts the response of other node into a view
+// which expires no later than the owner's copy.
+func viewFromResponse(res *pb.Response) ByteView {
+	view := ByteView{b: res.GetValue(), f: res.GetFlags()}
+	if res.GetStale() {
+		view.e = time.Now()
+		return view
+	}
+	if ttl := res.GetTtlMs(); ttl > 0 {
+		view.e = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return view
+}
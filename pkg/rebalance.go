@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alo-distributed-memcached/pb"
+)
+
+// handoffBatchBytes bounds the values sent in one handoff request.
+const handoffBatchBytes = 256 << 10
+
+// HandoffPeerGetter is implemented by peers which take the cached values of
+// the keys they now own.
+type HandoffPeerGetter interface {
+	HandOffToPeer(ctx context.Context, in *pb.HandoffRequest, out *pb.HandoffResponse) error
+}
+
+// RingWatcher is implemented by pools which tell when peers join their ring.
+type RingWatcher interface {
+	// WatchRing calls fn every time peers are added, fn must not block.
+	WatchRing(fn func())
+}
+
+// notifyRing calls the watchers of a ring to which peers were added.
+func notifyRing(watchers []func()) {
+	for _, fn := range watchers {
+		fn()
+	}
+}
+
+// WithRebalance warms up the nodes joining the ring, instead of leaving their
+// misses to the Getter: the current node sends them the values of its main
+// cache whose keys they now own, at most bytesPerSecond, 0 means no limit.
+// The values are dropped here once sent, unless the current node is still a
+// replica of their keys. Node.Drain hands entries off at the same rate.
+// It requires a PeerPicker implementing RingWatcher.
+func WithRebalance(bytesPerSecond int64) GroupOption {
+	return func(g *Group) {
+		g.rebalanceRate = bytesPerSecond
+		g.rebalanceQueue = make(chan struct{}, 1)
+	}
+}
+
+// scheduleRebalance starts a rebalance, or queues one if it is running, so a
+// burst of joins is handled by one or two walks of the cache.
+func (g *Group) scheduleRebalance() {
+	g.rebalanceOnce.Do(func() {
+		go func() {
+			for range g.rebalanceQueue {
+				g.rebalance(context.Background())
+			}
+		}()
+	})
+	select {
+	case g.rebalanceQueue <- struct{}{}:
+	default:
+	}
+}
+
+// rebalance sends the values of the keys other peers own to them, the
+// hottest first.
+func (g *Group) rebalance(ctx context.Context) {
+	limiter := &byteLimiter{rate: g.rebalanceRate}
+	for peer, entries := range g.movedEntries(g.mainCache.hottest(0)) {
+		sent, err := g.sendEntries(ctx, peer, entries, limiter)
+		for _, e := range entries[:sent] {
+			if !g.holds(e.key) {
+				g.mainCache.Remove(e.key)
+			}
+		}
+		if err != nil {
+			log.Printf("[Group %s] rebalance: %v", g.name, err)
+		}
+	}
+}
+
+// movedEntries groups the entries by the peer owning their key, the entries
+// of the current node are left out.
+func (g *Group) movedEntries(entries []cachedEntry) map[PeerGetter][]cachedEntry {
+	moved := make(map[PeerGetter][]cachedEntry)
+	for _, e := range entries {
+		if peer, ok := g.pickPeer(e.key); ok {
+			moved[peer] = append(moved[peer], e)
+		}
+	}
+	return moved
+}
+
+// holds reports whether the current node is a replica of the key.
+func (g *Group) holds(key string) bool {
+	for _, peer := range g.pickReplicas(key) {
+		if peer == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sendEntries hands the entries to the peer in batches paced by limiter. It
+// returns how many entries, from the first, were sent before an error.
+func (g *Group) sendEntries(ctx context.Context, peer PeerGetter, entries []cachedEntry, limiter *byteLimiter) (int, error) {
+	maxBytes := int64(handoffBatchBytes)
+	if limiter.rate > 0 && limiter.rate < maxBytes {
+		maxBytes = limiter.rate
+	}
+
+	sent := 0
+	for sent < len(entries) {
+		req := &pb.HandoffRequest{Group: g.name}
+		var size int64
+		end := sent
+		for end < len(entries) {
+			e := entries[end]
+			n := int64(len(e.key) + e.view.Len())
+			if len(req.Entries) > 0 && size+n > maxBytes {
+				break
+			}
+			end++
+			entry := &pb.Entry{Key: e.key, Value: e.view.b, Flags: e.view.f}
+			if !e.view.Expire().IsZero() {
+				entry.TtlMs = time.Until(e.view.Expire()).Milliseconds()
+				if entry.TtlMs <= 0 {
+					// expired while the others were sent
+					continue
+				}
+			}
+			req.Entries = append(req.Entries, entry)
+			size += n
+		}
+		if len(req.Entries) == 0 {
+			sent = end
+			continue
+		}
+
+		if !limiter.wait(ctx, size) {
+			return sent, ctx.Err()
+		}
+		if err := g.handOffToPeer(ctx, peer, req); err != nil {
+			return sent, err
+		}
+		g.Stats.HandedOff.Add(int64(len(req.Entries)))
+		sent = end
+	}
+	return sent, nil
+}
+
+// handOffToPeer sends the request, or a replica Set per entry to peers
+// without handoff.
+func (g *Group) handOffToPeer(ctx context.Context, peer PeerGetter, req *pb.HandoffRequest) error {
+	if handoff, ok := peer.(HandoffPeerGetter); ok {
+		return handoff.HandOffToPeer(ctx, req, &pb.HandoffResponse{})
+	}
+	for _, e := range req.GetEntries() {
+		ttl := NoExpiration
+		if e.GetTtlMs() > 0 {
+			ttl = time.Duration(e.GetTtlMs()) * time.Millisecond
+		}
+		if err := g.setToPeer(ctx, peer, e.GetKey(), e.GetValue(), e.GetFlags(), ttl, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeHandoff caches the entries a node sent as the key moved to the current
+// node. Values cached already are more recent and kept, it returns how many
+// entries were stored.
+func (g *Group) storeHandoff(entries []*pb.Entry) int64 {
+	var stored int64
+	for _, e := range entries {
+		if e.GetKey() == "" {
+			continue
+		}
+		view := ByteView{b: e.GetValue(), f: e.GetFlags()}
+		if ttl := e.GetTtlMs(); ttl > 0 {
+			view.e = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+			g.sweepOnce.Do(g.startSweeper)
+		}
+		if g.mainCache.addIfAbsent(e.GetKey(), view) {
+			if g.negativeTTL > 0 {
+				g.negCache.Remove(e.GetKey())
+			}
+			stored++
+		}
+	}
+	return stored
+}
+
+// byteLimiter paces the bytes sent to rate per second, 0 means no limit.
+type byteLimiter struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+// wait returns once the bytes sent so far fit the rate, then counts n more.
+// It returns false if ctx is done first.
+func (l *byteLimiter) wait(ctx context.Context, n int64) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	due := l.start.Add(time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second)))
+	l.sent += n
+	return sleepContext(ctx, time.Until(due))
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// peerName returns the name of the node in the ring of its pool.
+func peerName(n *testNode) string {
+	switch pool := n.group.peerPicker.(type) {
+	case *HTTPPool:
+		return pool.self
+	case *GRPCPool:
+		return pool.self
+	}
+	panic("unknown pool")
+}
+
+// testJoinHitRate loads keys on a ring of the first nodes, joins the last one,
+// and returns the hit rate of the joining node on the keys it now owns. warm
+// waits for the handoff of its entries.
+func testJoinHitRate(t *testing.T, nodes []*testNode, warm bool) float64 {
+	t.Helper()
+	joining, others := nodes[len(nodes)-1], nodes[:len(nodes)-1]
+	for _, n := range others {
+		n.group.peerPicker.(PeerManager).RemovePeer(peerName(joining))
+	}
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		if _, err := others[i%len(others)].group.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, n := range others {
+		n.group.peerPicker.(PeerManager).AddPeer(peerName(joining))
+	}
+	var owned []string
+	for _, key := range keys {
+		if owner, _ := ownerOf(nodes, key); owner == joining {
+			owned = append(owned, key)
+		}
+	}
+	if len(owned) == 0 {
+		t.Fatal("the joining node owns none of the keys")
+	}
+	if warm {
+		// the handoff runs in background
+		eventually(t, time.Second, func() bool {
+			return joining.group.CacheStats(MainCache).Items == int64(len(owned))
+		}, "the joining node did not receive its %d entries", len(owned))
+	}
+
+	gets, hits := joining.group.Stats.Gets.Get(), joining.group.Stats.CacheHits.Get()
+	for _, key := range owned {
+		view, err := joining.group.Get(key)
+		if err != nil || view.String() != "value-"+key {
+			t.Fatalf("Get(%q) = %q, %v", key, view.String(), err)
+		}
+	}
+	gets, hits = joining.group.Stats.Gets.Get()-gets, joining.group.Stats.CacheHits.Get()-hits
+	return float64(hits) / float64(gets)
+}
+
+func testRebalanceOnJoin(t *testing.T, start func(t *testing.T, groupName string, count int, opts ...GroupOption) []*testNode) {
+	t.Run("cold", func(t *testing.T) {
+		nodes := start(t, "join-cold", 3)
+		if rate := testJoinHitRate(t, nodes, false); rate != 0 {
+			t.Fatalf("hit rate after join = %.2f without rebalance, want 0", rate)
+		}
+	})
+	t.Run("warm", func(t *testing.T) {
+		nodes := start(t, "join-warm", 3, WithRebalance(0))
+		if rate := testJoinHitRate(t, nodes, true); rate != 1 {
+			t.Fatalf("hit rate after join = %.2f with rebalance, want 1", rate)
+		}
+		for _, n := range nodes {
+			for i := 0; i < 100; i++ {
+				if loads := n.loadCount(fmt.Sprintf("key-%d", i)); loads > 1 {
+					t.Fatalf("key-%d loaded %d times", i, loads)
+				}
+			}
+		}
+		// the previous owners drop the entries once handed off
+		eventually(t, time.Second, func() bool {
+			var items int64
+			for _, n := range nodes {
+				items += n.group.CacheStats(MainCache).Items
+			}
+			return items == 100
+		}, "the previous owners kept the entries handed off")
+	})
+}
+
+func TestHTTPRebalanceOnJoin(t *testing.T) {
+	testRebalanceOnJoin(t, startHTTPNodes)
+}
+
+func TestGRPCRebalanceOnJoin(t *testing.T) {
+	testRebalanceOnJoin(t, startGRPCNodes)
+}
+
+func TestByteLimiter(t *testing.T) {
+	limiter := &byteLimiter{rate: 10 << 10}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !limiter.wait(context.Background(), 1<<10) {
+			t.Fatal("wait returned false")
+		}
+	}
+	// the third kilobyte waits for the first two to fit the rate
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("3 KiB sent in %v at 10 KiB/s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if limiter.wait(ctx, 1<<10) {
+		t.Fatal("wait returned true after ctx was done")
+	}
+}
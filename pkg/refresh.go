@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultRefreshTimeout bounds a background refresh, see WithRefreshTimeout.
+const defaultRefreshTimeout = 30 * time.Second
+
+// WithRefreshAhead reloads in background the values hit less than window
+// before their expiration, so popular keys are replaced before they expire
+// and their callers never wait on a load.
+func WithRefreshAhead(window time.Duration) GroupOption {
+	return func(g *Group) {
+		g.refreshAhead = window
+	}
+}
+
+// WithStaleWhileRevalidate keeps the values for grace past their expiration.
+// A hit on an expired value returns it at once, ByteView.Stale reports it, and
+// reloads it in background. A value the getter reports missing is dropped,
+// on other errors the stale value is served until the end of grace.
+func WithStaleWhileRevalidate(grace time.Duration) GroupOption {
+	return func(g *Group) {
+		g.mainCache.grace = grace
+		g.hotCache.grace = grace
+	}
+}
+
+// WithRefreshTimeout bounds the background refreshes, 30 seconds by default.
+// A refresh which times out leaves the cached value as it is, the next hit
+// after it starts another one.
+func WithRefreshTimeout(timeout time.Duration) GroupOption {
+	return func(g *Group) {
+		g.refreshTimeout = timeout
+	}
+}
+
+// maybeRefresh starts a background refresh of the cached value if it is
+// stale or about to expire. hot tells the value is held by the hot cache.
+func (g *Group) maybeRefresh(key string, v ByteView, hot bool) {
+	if v.Expire().IsZero() {
+		return
+	}
+	switch left := time.Until(v.Expire()); {
+	case left <= 0:
+		g.Stats.StaleHits.Add(1)
+	case left < g.refreshAhead:
+	default:
+		return
+	}
+	if _, running := g.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	g.Stats.Refreshes.Add(1)
+	go g.refresh(key, hot)
+}
+
+// refresh reloads the key, it shares the singleflight call of the loads of
+// the key in flight. It waits for the load no longer than the refresh
+// timeout, so a hung getter does not keep the key marked as refreshing.
+func (g *Group) refresh(key string, hot bool) {
+	defer g.refreshing.Delete(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.refreshTimeout)
+	defer cancel()
+	view, err := g.loader.DoContext(ctx, key, func() (interface{}, error) {
+		defer g.inflight.done(g.inflight.start())
+		return g.fetch(ctx, key)
+	})
+	switch {
+	case err == nil && hot:
+		// fetch only keeps some values of the peers in the hot cache
+		g.hotCache.Add(key, view.(ByteView))
+	case errors.Is(err, ErrNotFound):
+		g.mainCache.Remove(key)
+		g.hotCache.Remove(key)
+	case err != nil:
+		log.Printf("[Group %s] refresh %s: %v", g.name, key, err)
+	}
+}
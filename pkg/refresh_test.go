@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf(format, args...)
+}
+
+// versionGetter returns "v<n>" on the nth load, every load after the first
+// takes delay.
+type versionGetter struct {
+	loads   int32
+	ttl     time.Duration
+	delay   time.Duration
+	missing atomic.Bool // report the key missing
+}
+
+func (v *versionGetter) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	n := atomic.AddInt32(&v.loads, 1)
+	if n > 1 {
+		time.Sleep(v.delay)
+	}
+	if v.missing.Load() {
+		return nil, 0, ErrNotFound
+	}
+	return []byte(fmt.Sprintf("v%d", n)), v.ttl, nil
+}
+
+func (v *versionGetter) Get(key string) ([]byte, error) {
+	b, _, err := v.GetWithTTL(key)
+	return b, err
+}
+
+func (v *versionGetter) count() int32 {
+	return atomic.LoadInt32(&v.loads)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	getter := &versionGetter{ttl: 30 * time.Millisecond, delay: 100 * time.Millisecond}
+	g := newGroup("stale", 2<<10, getter, WithStaleWhileRevalidate(time.Second))
+
+	if view, _ := g.Get("Tom"); view.String() != "v1" || view.Stale() {
+		t.Fatalf("first Get = %q, stale %v", view.String(), view.Stale())
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	// the expired value is served at once while the slow refresh runs
+	start := time.Now()
+	view, err := g.Get("Tom")
+	if err != nil || view.String() != "v1" || !view.Stale() {
+		t.Fatalf("Get past expiration = %q, stale %v, %v", view.String(), view.Stale(), err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("stale Get waited %v on the refresh", elapsed)
+	}
+	g.Get("Tom")
+	if g.Stats.StaleHits.Get() != 2 || g.Stats.Refreshes.Get() != 1 {
+		t.Fatalf("stale hits=%d refreshes=%d, want 2 and 1", g.Stats.StaleHits.Get(), g.Stats.Refreshes.Get())
+	}
+
+	eventually(t, time.Second, func() bool {
+		view, _ := g.Get("Tom")
+		return view.String() == "v2" && !view.Stale()
+	}, "refreshed value never served")
+	if getter.count() != 2 {
+		t.Fatalf("loaded %d times, want 2", getter.count())
+	}
+}
+
+func TestStaleDroppedAfterGrace(t *testing.T) {
+	getter := &versionGetter{ttl: 20 * time.Millisecond}
+	g := newGroup("stale-grace", 2<<10, getter, WithStaleWhileRevalidate(20*time.Millisecond))
+
+	g.Get("Tom")
+	time.Sleep(50 * time.Millisecond)
+	if view, _ := g.Get("Tom"); view.String() != "v2" || view.Stale() {
+		t.Fatalf("Get past grace = %q, stale %v, want a new load", view.String(), view.Stale())
+	}
+	if g.Stats.StaleHits.Get() != 0 {
+		t.Fatalf("value served stale past its grace")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	getter := &versionGetter{ttl: 100 * time.Millisecond}
+	g := newGroup("refresh-ahead", 2<<10, getter, WithRefreshAhead(60*time.Millisecond))
+
+	g.Get("Tom")
+	g.Get("Tom")
+	if getter.count() != 1 {
+		t.Fatalf("refreshed a value far from its expiration")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if view, _ := g.Get("Tom"); view.String() != "v1" || view.Stale() {
+		t.Fatalf("Get near expiration = %q, stale %v", view.String(), view.Stale())
+	}
+	eventually(t, time.Second, func() bool {
+		view, _ := g.Get("Tom")
+		return view.String() == "v2"
+	}, "value was not refreshed ahead of its expiration")
+}
+
+func TestRefreshDedup(t *testing.T) {
+	getter := &versionGetter{ttl: 20 * time.Millisecond, delay: 50 * time.Millisecond}
+	g := newGroup("refresh-dedup", 2<<10, getter, WithStaleWhileRevalidate(time.Second))
+	g.Get("Tom")
+	time.Sleep(30 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if view, err := g.Get("Tom"); err != nil || view.String() != "v1" {
+				t.Errorf("Get = %q, %v", view.String(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, time.Second, func() bool {
+		view, _ := g.Get("Tom")
+		return view.String() == "v2"
+	}, "value was not refreshed")
+	if getter.count() != 2 || g.Stats.Refreshes.Get() != 1 {
+		t.Fatalf("loads=%d refreshes=%d, want one refresh", getter.count(), g.Stats.Refreshes.Get())
+	}
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	getter := &versionGetter{ttl: 30 * time.Millisecond, delay: 300 * time.Millisecond}
+	g := newGroup("refresh-timeout", 2<<10, getter, WithStaleWhileRevalidate(time.Second), WithRefreshTimeout(20*time.Millisecond))
+
+	g.Get("Tom")
+	time.Sleep(40 * time.Millisecond)
+	if view, _ := g.Get("Tom"); !view.Stale() {
+		t.Fatalf("Get = %q, want the stale value", view.String())
+	}
+	// the getter hangs past the timeout, the key is no longer refreshing
+	eventually(t, 150*time.Millisecond, func() bool {
+		_, running := g.refreshing.Load("Tom")
+		return !running
+	}, "the key is still refreshing after the timeout")
+	if view, _ := g.Get("Tom"); view.String() != "v1" {
+		t.Fatalf("Get after the timeout = %q, want the stale v1", view.String())
+	}
+}
+
+func TestRefreshDropsMissing(t *testing.T) {
+	getter := &versionGetter{ttl: 20 * time.Millisecond}
+	g := newGroup("refresh-missing", 2<<10, getter, WithStaleWhileRevalidate(time.Second))
+	g.Get("Tom")
+	time.Sleep(30 * time.Millisecond)
+
+	getter.missing.Store(true)
+	g.Get("Tom")
+	eventually(t, time.Second, func() bool {
+		_, err := g.Get("Tom")
+		return errors.Is(err, ErrNotFound)
+	}, "value removed from the backing store is still served")
+}
+
+func TestPeerPropagatesStaleness(t *testing.T) {
+	stale := ByteView{b: []byte("v"), e: time.Now().Add(-time.Second)}
+	res := viewToResponse(stale)
+	if !res.GetStale() {
+		t.Fatalf("stale view sent as fresh, ttl_ms %d", res.GetTtlMs())
+	}
+	if !viewFromResponse(res).Stale() {
+		t.Fatalf("stale response read as fresh")
+	}
+	if viewFromResponse(viewToResponse(ByteView{b: []byte("v")})).Stale() {
+		t.Fatalf("value without expiration read as stale")
+	}
+}
+
+func TestStaleFromOwner(t *testing.T) {
+	nodes := startHTTPNodes(t, "stale-peers", 2, WithTTL(30*time.Millisecond), WithStaleWhileRevalidate(time.Second))
+	key := "key-stale"
+	owner, other := ownerOf(nodes, key)
+
+	other.group.Get(key)
+	time.Sleep(40 * time.Millisecond)
+	// the other node has no copy, the owner answers with its stale value
+	view, err := other.group.Get(key)
+	if err != nil || !view.Stale() {
+		t.Fatalf("Get = %q, stale %v, %v", view.String(), view.Stale(), err)
+	}
+	eventually(t, time.Second, func() bool {
+		return owner.loadCount(key) == 2
+	}, "owner did not refresh the stale value")
+}
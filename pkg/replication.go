@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReplicaPicker is implemented by pools which can return every replica of a key.
+type ReplicaPicker interface {
+	// PickReplicas returns the n nodes holding the key in ring order, the
+	// primary first. The current node is returned as a nil PeerGetter.
+	PickReplicas(key string, n int) []PeerGetter
+}
+
+// WithReplicas keeps every key on n nodes of the ring. Reads go to the primary
+// and fail over to the other replicas, and the node loading a value through
+// the Getter pushes it to the other replicas, so losing one node does not send
+// all of its keys to the backing store at once.
+// It requires a PeerPicker implementing ReplicaPicker.
+func WithReplicas(n int) GroupOption {
+	return func(g *Group) {
+		g.replicas = n
+	}
+}
+
+func (g *Group) pickReplicas(key string) []PeerGetter {
+	if g.replicas <= 1 {
+		return nil
+	}
+	picker, ok := g.peerPicker.(ReplicaPicker)
+	if !ok {
+		return nil
+	}
+	return picker.PickReplicas(key, g.replicas)
+}
+
+func (g *Group) loadFromReplicas(ctx context.Context, key string, replicas []PeerGetter) (ByteView, error) {
+	isReplica := false
+	for _, peer := range replicas {
+		if peer == nil {
+			isReplica = true
+		}
+	}
+
+	var lastErr error
+	for i := 0; i < len(replicas); i++ {
+		peer := replicas[i]
+		if peer == nil {
+			// every replica before us failed, we are the owner now
+			view, err := g.getLocally(ctx, key)
+			if err == nil {
+				// the push outlives the caller, keep its values but not its cancellation
+				go g.pushToReplicas(context.WithoutCancel(ctx), key, view, replicas)
+			}
+			return view, err
+		}
+		fromPeer := func(ctx context.Context) (ByteView, error) {
+			return g.getFromPeerWithRetries(ctx, peer, key)
+		}
+		// a slow replica is hedged on the next one
+		var fromNext func(context.Context) (ByteView, error)
+		if i+1 < len(replicas) && replicas[i+1] != nil {
+			next := replicas[i+1]
+			fromNext = func(ctx context.Context) (ByteView, error) {
+				return g.getFromPeer(ctx, next, key)
+			}
+		}
+		view, hedged, err := g.hedgedGet(ctx, fromPeer, fromNext)
+		if err == nil {
+			if isReplica {
+				g.populateCache(key, view)
+			} else {
+				g.maybePopulateHotCache(key, view)
+			}
+			return view, nil
+		}
+		if ctx.Err() != nil {
+			return ByteView{}, ctx.Err()
+		}
+		if errors.Is(err, ErrNotFound) {
+			return ByteView{}, err
+		}
+		// the next replica may still hold a copy
+		lastErr = err
+		if hedged {
+			// and failed as the hedge already
+			i++
+		}
+	}
+
+	if !fallbackOnPeerError(lastErr) {
+		return ByteView{}, lastErr
+	}
+	return g.getLocally(ctx, key)
+}
+
+// pushToReplicas stores the view on every other replica with its remaining TTL.
+func (g *Group) pushToReplicas(ctx context.Context, key string, view ByteView, replicas []PeerGetter) {
+	ttl := NoExpiration
+	if !view.Expire().IsZero() {
+		if ttl = time.Until(view.Expire()); ttl <= 0 {
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, peer := range replicas {
+		if peer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(peer PeerGetter) {
+			defer wg.Done()
+			if err := g.setToPeer(ctx, peer, key, view.b, view.f, ttl, true); err != nil {
+				log.Printf("[Group %s] push %s to replica: %v", g.name, key, err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// setToReplicas writes on every replica. A replica coordinates the write
+// itself, other nodes forward it to the first reachable replica.
+func (g *Group) setToReplicas(ctx context.Context, key string, value []byte, flags uint32, ttl time.Duration, replicas []PeerGetter) error {
+	g.removeLocally(key)
+
+	var err error
+	for _, peer := range replicas {
+		if peer == nil {
+			g.pushToReplicas(ctx, key, g.setLocally(key, value, flags, ttl), replicas)
+			return nil
+		}
+		if err = g.setToPeer(ctx, peer, key, value, flags, ttl, false); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// deleteFromReplicas removes the key from every replica, in the same way as setToReplicas.
+func (g *Group) deleteFromReplicas(ctx context.Context, key string, replicas []PeerGetter) (bool, error) {
+	deleted := g.removeLocally(key)
+
+	var err error
+	for _, peer := range replicas {
+		if peer == nil {
+			for _, other := range replicas {
+				if other == nil {
+					continue
+				}
+				if ok, err := g.deleteFromPeer(ctx, other, key, true); err != nil {
+					log.Printf("[Group %s] delete %s from replica: %v", g.name, key, err)
+				} else {
+					deleted = deleted || ok
+				}
+			}
+			return deleted, nil
+		}
+		var ok bool
+		if ok, err = g.deleteFromPeer(ctx, peer, key, false); err == nil {
+			return ok, nil
+		}
+	}
+	return false, err
+}
+
+// handleSet applies a Set received from another node, a replica update is
+// stored as is instead of being routed to the owner again.
+func (g *Group) handleSet(ctx context.Context, key string, value []byte, flags uint32, ttl time.Duration, replica bool) error {
+	if replica {
+		if key == "" {
+			return fmt.Errorf("key is required")
+		}
+		g.setLocally(key, value, flags, ttl)
+		return nil
+	}
+	return g.setWithFlags(ctx, key, value, flags, ttl)
+}
+
+// handleDelete applies a Delete received from another node, in the same way as handleSet.
+func (g *Group) handleDelete(ctx context.Context, key string, replica bool) (bool, error) {
+	if replica {
+		return g.removeLocally(key), nil
+	}
+	return g.deleteWithContext(ctx, key)
+}
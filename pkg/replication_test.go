@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func (n *testNode) cached(key string) bool {
+	_, ok := n.group.mainCache.Get(key)
+	return ok
+}
+
+func TestReplicationFailover(t *testing.T) {
+	nodes := startHTTPNodes(t, "replicated", 3, WithReplicas(2))
+	pool := nodes[0].group.peerPicker.(*HTTPPool)
+	byAddr := make(map[string]*testNode)
+	for _, n := range nodes {
+		byAddr["http://"+n.addr] = n
+	}
+
+	// find a key whose replicas do not include nodes[0], so it reads remotely
+	var key string
+	var primary, secondary *testNode
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		owners := pool.peers.GetNodes(candidate, 2)
+		if owners[0] != pool.self && owners[1] != pool.self {
+			key, primary, secondary = candidate, byAddr[owners[0]], byAddr[owners[1]]
+		}
+	}
+
+	if view, err := nodes[0].group.Get(key); err != nil || view.String() != "value-"+key {
+		t.Fatalf("Get(%q) = %q, %v", key, view.String(), err)
+	}
+	if primary.loadCount(key) != 1 {
+		t.Fatalf("primary loaded %q %d times, want 1", key, primary.loadCount(key))
+	}
+	deadline := time.Now().Add(time.Second)
+	for !secondary.cached(key) {
+		if time.Now().After(deadline) {
+			t.Fatalf("primary did not push %q to the secondary", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the primary dies, reads fail over to the secondary without reloading
+	primary.stop()
+	if view, err := nodes[0].group.Get(key); err != nil || view.String() != "value-"+key {
+		t.Fatalf("Get(%q) after primary died = %q, %v", key, view.String(), err)
+	}
+	for _, n := range nodes {
+		if n != primary && n.loadCount(key) != 0 {
+			t.Fatalf("%s reloaded %q from the getter", n.addr, key)
+		}
+	}
+}
+
+func TestReplicationWrites(t *testing.T) {
+	nodes := startGRPCNodes(t, "replicated-write", 3, WithReplicas(3))
+
+	if err := nodes[0].group.Set("Tom", []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if view, ok := n.group.mainCache.Get("Tom"); !ok || view.String() != "630" {
+			t.Fatalf("%s holds %q, %v after Set", n.addr, view.String(), ok)
+		}
+	}
+
+	deleted, err := nodes[1].group.Delete("Tom")
+	if err != nil || !deleted {
+		t.Fatalf("Delete = %v, %v", deleted, err)
+	}
+	for _, n := range nodes {
+		if n.cached("Tom") {
+			t.Fatalf("%s still holds Tom after Delete", n.addr)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	respVersion = "7.0.0-alo"
+
+	maxRESPArgs    = 1 << 20
+	maxRESPBulkLen = 16 << 20
+	// arguments allocated ahead, a client must send the others to grow args
+	respArgsPrealloc = 64
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+/*
+RESPServer implements the Redis protocol (RESP2, and RESP3 after HELLO 3)
+on top of groups, so redis clients can use the cluster as a read-through
+cache.
+
+	GET, SET [EX|PX] [NX|XX] [KEEPTTL], DEL, MGET, EXISTS
+	TTL, PTTL, EXPIRE, PEXPIRE
+	PING, ECHO, INFO, SELECT, HELLO, QUIT
+
+Like in Redis, a SET without EX, PX or KEEPTTL stores a value which never
+expires, the default TTL of the group only applies to the values its getter
+loads. A key the getter reports missing is a nil reply, the other failures of
+the group are errors.
+
+A key is read from the group selected by SELECT <group> (SELECT 0 selects
+the default group), or from the group named by its prefix when it has the
+form <group>:<key> and that group exists.
+*/
+type RESPServer struct {
+	defaultGroup *Group
+	started      time.Time
+
+	// rmw serializes the read-modify-write commands of a key
+	rmw keyLocks
+
+	tcpServer
+	commands AtomicInt
+
+	// getGroup resolves group names, GetGroup unless overridden by tests
+	getGroup func(name string) *Group
+}
+
+// respConn is the state of a client connection.
+type respConn struct {
+	w     *bufio.Writer
+	group *Group
+	proto int
+}
+
+// NewRESPServer returns a Redis protocol front-end, commands use group
+// until another one is selected.
+func NewRESPServer(group *Group) *RESPServer {
+	s := &RESPServer{
+		defaultGroup: group,
+		started:      time.Now(),
+		getGroup:     GetGroup,
+	}
+	s.init()
+	return s
+}
+
+// Serve accepts redis connections on lis until Close is called.
+func (s *RESPServer) Serve(lis net.Listener) error {
+	return s.serve(lis, s.serveConn)
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	c := &respConn{w: bufio.NewWriter(conn), group: s.defaultGroup, proto: 2}
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.error("ERR " + err.Error())
+				c.w.Flush()
+			} else {
+				logConnError(conn, err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		s.commands.Add(1)
+		quit := s.dispatch(c, args)
+		if quit || r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// dispatch serves one command and reports whether the connection
+// should be closed.
+func (s *RESPServer) dispatch(c *respConn, args []string) bool {
+	name := strings.ToLower(args[0])
+	arity, ok := respArity[name]
+	if !ok {
+		c.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		c.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+
+	switch name {
+	case "get":
+		s.get(c, args[1])
+	case "mget":
+		s.mget(c, args[1:])
+	case "set":
+		s.set(c, args[1:])
+	case "del":
+		s.del(c, args[1:])
+	case "exists":
+		s.exists(c, args[1:])
+	case "ttl", "pttl":
+		s.ttl(c, args[1], name == "pttl")
+	case "expire", "pexpire":
+		s.expire(c, args[1], args[2], name == "pexpire")
+	case "ping":
+		if len(args) > 1 {
+			c.bulk([]byte(args[1]))
+		} else {
+			c.simple("PONG")
+		}
+	case "echo":
+		c.bulk([]byte(args[1]))
+	case "select":
+		s.selectGroup(c, args[1])
+	case "info":
+		section := ""
+		if len(args) > 1 {
+			section = args[1]
+		}
+		c.bulk([]byte(s.info(c, section)))
+	case "hello":
+		s.hello(c, args[1:])
+	case "command":
+		// redis-cli asks for the command docs on startup
+		c.array(0)
+	case "quit":
+		c.simple("OK")
+		return true
+	}
+	return false
+}
+
+// respArity is the number of arguments of each command including its
+// name, a negative arity is a minimum.
+var respArity = map[string]int{
+	"get":     2,
+	"mget":    -2,
+	"set":     -3,
+	"del":     -2,
+	"exists":  -2,
+	"ttl":     2,
+	"pttl":    2,
+	"expire":  3,
+	"pexpire": 3,
+	"ping":    -1,
+	"echo":    2,
+	"select":  2,
+	"info":    -1,
+	"hello":   -1,
+	"command": -1,
+	"quit":    -1,
+}
+
+// resolve returns the group of a key and the key within that group.
+func (s *RESPServer) resolve(c *respConn, key string) (*Group, string) {
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		if g := s.getGroup(key[:i]); g != nil {
+			return g, key[i+1:]
+		}
+	}
+	return c.group, key
+}
+
+func (s *RESPServer) get(c *respConn, key string) {
+	g, key := s.resolve(c, key)
+	view, err := g.GetContext(s.ctx, key)
+	switch {
+	case err == nil:
+		c.bulk(view.ByteSlice())
+	case errors.Is(err, ErrNotFound):
+		c.null()
+	default:
+		c.error("ERR " + err.Error())
+	}
+}
+
+// respGetError returns the first error of a GetMulti which is not a key
+// reported missing.
+func respGetError(err error) error {
+	errs, ok := err.(KeyErrors)
+	if !ok {
+		return err
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// exists counts the keys found, a key is looked up once per time it is given.
+func (s *RESPServer) exists(c *respConn, keys []string) {
+	n := 0
+	for _, key := range keys {
+		g, key := s.resolve(c, key)
+		_, err := g.GetContext(s.ctx, key)
+		switch {
+		case err == nil:
+			n++
+		case !errors.Is(err, ErrNotFound):
+			c.error("ERR " + err.Error())
+			return
+		}
+	}
+	c.integer(int64(n))
+}
+
+// mget fetches the keys of each group with one GetMulti.
+func (s *RESPServer) mget(c *respConn, keys []string) {
+	type ref struct {
+		g   *Group
+		key string
+	}
+	refs := make([]ref, len(keys))
+	batches := make(map[*Group][]string)
+	for i, key := range keys {
+		g, key := s.resolve(c, key)
+		refs[i] = ref{g, key}
+		batches[g] = append(batches[g], key)
+	}
+	views := make(map[*Group]map[string]ByteView, len(batches))
+	for g, keys := range batches {
+		var err error
+		views[g], err = g.GetMultiContext(s.ctx, keys)
+		if err := respGetError(err); err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+	}
+
+	c.array(len(refs))
+	for _, ref := range refs {
+		if view, ok := views[ref.g][ref.key]; ok {
+			c.bulk(view.ByteSlice())
+		} else {
+			c.null()
+		}
+	}
+}
+
+// set serves SET key value [EX seconds|PX milliseconds|KEEPTTL] [NX|XX].
+func (s *RESPServer) set(c *respConn, args []string) {
+	g, key := s.resolve(c, args[0])
+	value := []byte(args[1])
+
+	ttl := NoExpiration
+	var nx, xx, keepTTL, expires bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "KEEPTTL" && !expires:
+			keepTTL = true
+		case (opt == "EX" || opt == "PX") && !expires && !keepTTL && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				c.error("ERR value is not an integer or out of range")
+				return
+			}
+			if ttl, err = respTTL(n, opt == "PX"); err != nil || ttl <= 0 {
+				c.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			expires = true
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+
+	if nx || xx || keepTTL {
+		defer s.rmw.lock(g.name, key).Unlock()
+		view, err := g.GetContext(s.ctx, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			c.error("ERR " + err.Error())
+			return
+		}
+		if exists := err == nil; (nx && exists) || (xx && !exists) {
+			c.null()
+			return
+		}
+		if keepTTL && err == nil && !view.Expire().IsZero() {
+			if ttl = time.Until(view.Expire()); ttl <= 0 {
+				ttl = time.Millisecond
+			}
+		}
+	}
+	if err := g.setWithContext(s.ctx, key, value, ttl); err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	c.simple("OK")
+}
+
+func (s *RESPServer) del(c *respConn, keys []string) {
+	n := 0
+	for _, key := range keys {
+		g, key := s.resolve(c, key)
+		deleted, err := g.deleteWithContext(s.ctx, key)
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+		if deleted {
+			n++
+		}
+	}
+	c.integer(int64(n))
+}
+
+// ttl replies -2 for a missing key, -1 for a key without expiration,
+// 0 for a stale key being refreshed.
+func (s *RESPServer) ttl(c *respConn, key string, ms bool) {
+	g, key := s.resolve(c, key)
+	view, err := g.GetContext(s.ctx, key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.integer(-2)
+	case err != nil:
+		c.error("ERR " + err.Error())
+	case view.Expire().IsZero():
+		c.integer(-1)
+	case view.Stale():
+		c.integer(0)
+	case ms:
+		c.integer(time.Until(view.Expire()).Milliseconds())
+	default:
+		c.integer((time.Until(view.Expire()).Milliseconds() + 500) / 1000)
+	}
+}
+
+// expire replies 1 when the key exists, a timeout not in the future
+// deletes it.
+func (s *RESPServer) expire(c *respConn, key, timeout string, ms bool) {
+	n, err := strconv.ParseInt(timeout, 10, 64)
+	if err != nil {
+		c.error("ERR value is not an integer or out of range")
+		return
+	}
+	ttl, err := respTTL(n, ms)
+	if err != nil {
+		name := "expire"
+		if ms {
+			name = "pexpire"
+		}
+		c.error(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+		return
+	}
+
+	g, key := s.resolve(c, key)
+	defer s.rmw.lock(g.name, key).Unlock()
+	view, err := g.GetContext(s.ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		c.integer(0)
+		return
+	}
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	if ttl <= 0 {
+		_, err = g.deleteWithContext(s.ctx, key)
+	} else {
+		err = g.setWithFlags(s.ctx, key, view.ByteSlice(), view.Flags(), ttl)
+	}
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	c.integer(1)
+}
+
+var errRESPExpireRange = errors.New("expire time out of range")
+
+// respTTL converts a number of seconds, or of milliseconds, to a duration.
+func respTTL(n int64, ms bool) (time.Duration, error) {
+	unit := time.Second
+	if ms {
+		unit = time.Millisecond
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, errRESPExpireRange
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func (s *RESPServer) selectGroup(c *respConn, name string) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if name != "0" {
+			c.error("ERR DB index is out of range")
+			return
+		}
+		c.group = s.defaultGroup
+		c.simple("OK")
+		return
+	}
+	g := s.getGroup(name)
+	if g == nil {
+		c.error(fmt.Sprintf("ERR unknown group '%s'", name))
+		return
+	}
+	c.group = g
+	c.simple("OK")
+}
+
+// hello serves HELLO [protover [AUTH username password] [SETNAME name]],
+// AUTH and SETNAME are accepted and ignored.
+func (s *RESPServer) hello(c *respConn, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil {
+			c.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			c.error("NOPROTO unsupported protocol version")
+			return
+		}
+		c.proto = proto
+	}
+
+	c.mapHeader(6)
+	c.bulk([]byte("server"))
+	c.bulk([]byte("redis"))
+	c.bulk([]byte("version"))
+	c.bulk([]byte(respVersion))
+	c.bulk([]byte("proto"))
+	c.integer(int64(c.proto))
+	c.bulk([]byte("mode"))
+	c.bulk([]byte("standalone"))
+	c.bulk([]byte("role"))
+	c.bulk([]byte("master"))
+	c.bulk([]byte("modules"))
+	c.array(0)
+}
+
+// info returns the sections of INFO, the stats are the ones of the
+// selected group.
+func (s *RESPServer) info(c *respConn, section string) string {
+	g := c.group
+	main := g.CacheStats(MainCache)
+	hot := g.CacheStats(HotCache)
+	sections := []struct {
+		name   string
+		fields [][2]interface{}
+	}{
+		{"Server", [][2]interface{}{
+			{"redis_version", respVersion},
+			{"redis_mode", "standalone"},
+			{"process_id", os.Getpid()},
+			{"uptime_in_seconds", int64(time.Since(s.started).Seconds())},
+		}},
+		{"Clients", [][2]interface{}{
+			{"connected_clients", s.currConns.Get()},
+		}},
+		{"Stats", [][2]interface{}{
+			{"total_connections_received", s.totalConns.Get()},
+			{"total_commands_processed", s.commands.Get()},
+			{"keyspace_hits", g.Stats.CacheHits.Get()},
+			{"keyspace_misses", g.Stats.Gets.Get() - g.Stats.CacheHits.Get()},
+			{"evicted_keys", main.Evictions + hot.Evictions},
+			{"expired_keys", main.Expirations + hot.Expirations},
+		}},
+		{"Group", [][2]interface{}{
+			{"group", g.name},
+			{"gets", g.Stats.Gets.Get()},
+			{"peer_loads", g.Stats.PeerLoads.Get()},
+			{"peer_errors", g.Stats.PeerErrors.Get()},
+			{"local_loads", g.Stats.LocalLoads.Get()},
+			{"local_load_errors", g.Stats.LocalLoadErrs.Get()},
+			{"used_memory", main.Bytes + hot.Bytes},
+			{"keys", main.Items + hot.Items},
+		}},
+	}
+
+	all := section == "" || strings.EqualFold(section, "all") || strings.EqualFold(section, "default") || strings.EqualFold(section, "everything")
+	var b strings.Builder
+	for _, sec := range sections {
+		if !all && !strings.EqualFold(section, sec.name) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", sec.name)
+		for _, field := range sec.fields {
+			fmt.Fprintf(&b, "%v:%v\r\n", field[0], field[1])
+		}
+	}
+	return b.String()
+}
+
+func (c *respConn) simple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) error(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) integer(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) bulk(b []byte) {
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) null() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+		return
+	}
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) array(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader starts a map of n pairs, a flat array in RESP2.
+func (c *respConn) mapHeader(n int) {
+	if c.proto == 3 {
+		c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	c.array(2 * n)
+}
+
+// readRESPCommand reads an array of bulk strings, or an inline command
+// as sent by telnet.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readMemcacheLine(r)
+	if err == errMemcacheLineTooLong {
+		return nil, fmt.Errorf("%w: too big inline request", errRESPProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([]string, 0, min(max(n, 0), respArgsPrealloc))
+	for i := 0; i < n; i++ {
+		line, err := readMemcacheLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: expected '\\r\\n' after the bulk string", errRESPProtocol)
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startRESP(t *testing.T, groups ...*Group) *memcacheClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewRESPServer(groups[0])
+	server.getGroup = func(name string) *Group {
+		for _, g := range groups {
+			if g.name == name {
+				return g
+			}
+		}
+		return nil
+	}
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &memcacheClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// respCommand encodes args as an array of bulk strings.
+func respCommand(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+func TestRESPCommands(t *testing.T) {
+	c := startRESP(t, memcacheGroup("resp"))
+
+	c.do("PING\r\n", "+PONG")
+	c.do(respCommand("GET", "db-Tom"), "$12", "value-db-Tom")
+	c.do(respCommand("GET", "missing"), "$-1")
+	c.do(respCommand("SET", "k", "v"), "+OK")
+	c.do(respCommand("SET", "k", "v2", "NX"), "$-1")
+	c.do(respCommand("SET", "other", "v", "XX"), "$-1")
+	c.do(respCommand("SET", "k", "v2", "XX"), "+OK")
+	c.do(respCommand("MGET", "k", "missing", "db-Tom"), "*3", "$2", "v2", "$-1", "$12", "value-db-Tom")
+	c.do(respCommand("EXISTS", "k", "missing", "db-Tom"), ":2")
+	c.do(respCommand("DEL", "k", "missing"), ":1")
+	c.do(respCommand("GET", "k"), "$-1")
+
+	c.do(respCommand("SET", "k", "v", "EX", "0"), "-ERR invalid expire time in 'set' command")
+	c.do(respCommand("SET", "k", "v", "EX", "9223372036854775807"), "-ERR invalid expire time in 'set' command")
+	c.do(respCommand("SET", "k", "v", "NX", "XX"), "-ERR syntax error")
+	c.do(respCommand("GET"), "-ERR wrong number of arguments for 'get' command")
+	c.do(respCommand("FLUSHALL"), "-ERR unknown command 'FLUSHALL'")
+}
+
+func TestRESPGetErrors(t *testing.T) {
+	c := startRESP(t, memcacheGroup("resp-errors"))
+
+	// only a key the getter reports missing is nil, a failing getter is an error
+	c.do(respCommand("GET", "missing"), "$-1")
+	c.do(respCommand("GET", "broken-k"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("MGET", "missing", "broken-k"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("EXISTS", "missing", "broken-k"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("TTL", "broken-k"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("EXPIRE", "broken-k", "10"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("SET", "broken-k", "v", "NX"), "-ERR broken-k: backing store failed")
+	c.do(respCommand("MGET", "missing", "db-Tom"), "*2", "$-1", "$12", "value-db-Tom")
+}
+
+func TestRESPProtocolErrors(t *testing.T) {
+	c := startRESP(t, memcacheGroup("resp-protocol"))
+	c.do("*2\r\n$3\r\nGET\r\n$1\r\nkXY", "-ERR Protocol error: expected '\\r\\n' after the bulk string")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after a protocol error: %v", err)
+	}
+
+	// a huge argument count allocates only for the arguments sent
+	r := bufio.NewReader(strings.NewReader("*1048576\r\n" + respCommand("GET", "k")[4:]))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readRESPCommand(r)
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Fatalf("readRESPCommand = %v on a truncated command", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<10 {
+		t.Fatalf("%d bytes allocated for 2 arguments", allocated)
+	}
+}
+
+func TestRESPExpiration(t *testing.T) {
+	c := startRESP(t, memcacheGroup("resp-expire"))
+
+	c.do(respCommand("SET", "k", "v"), "+OK")
+	c.do(respCommand("TTL", "k"), ":-1")
+	c.do(respCommand("TTL", "missing"), ":-2")
+	c.do(respCommand("EXPIRE", "k", "100"), ":1")
+	c.do(respCommand("TTL", "k"), ":100")
+	c.do(respCommand("EXPIRE", "missing", "100"), ":0")
+
+	c.do(respCommand("SET", "k", "v2", "KEEPTTL"), "+OK")
+	c.do(respCommand("TTL", "k"), ":100")
+	c.do(respCommand("SET", "short", "v", "PX", "50"), "+OK")
+	time.Sleep(60 * time.Millisecond)
+	c.do(respCommand("GET", "short"), "$-1")
+
+	c.do(respCommand("EXPIRE", "k", "-1"), ":1")
+	c.do(respCommand("GET", "k"), "$-1")
+	c.do(respCommand("EXPIRE", "k", "9223372036854775807"), "-ERR invalid expire time in 'expire' command")
+
+	// a SET without expiration persists, whatever the TTL of the group
+	c = startRESP(t, memcacheGroup("resp-persist", WithTTL(time.Hour)))
+	c.do(respCommand("GET", "db-Tom"), "$12", "value-db-Tom")
+	c.do(respCommand("TTL", "db-Tom"), ":3600")
+	c.do(respCommand("SET", "k", "v"), "+OK")
+	c.do(respCommand("TTL", "k"), ":-1")
+}
+
+func TestRESPGroups(t *testing.T) {
+	scores := newGroup("scores", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("score-" + key), nil
+	}))
+	c := startRESP(t, memcacheGroup("resp-default"), scores)
+
+	// group:key reads the named group, unknown prefixes are part of the key
+	c.do(respCommand("GET", "scores:Tom"), "$9", "score-Tom")
+	c.do(respCommand("GET", "db-user:1"), "$15", "value-db-user:1")
+	c.do(respCommand("SET", "scores:Jack", "10"), "+OK")
+	if v, _ := scores.Get("Jack"); v.String() != "10" {
+		t.Fatalf("SET scores:Jack stored %q in scores", v.String())
+	}
+
+	c.do(respCommand("SELECT", "scores"), "+OK")
+	c.do(respCommand("GET", "Tom"), "$9", "score-Tom")
+	c.do(respCommand("SELECT", "0"), "+OK")
+	c.do(respCommand("GET", "Tom"), "$-1")
+	c.do(respCommand("SELECT", "1"), "-ERR DB index is out of range")
+	c.do(respCommand("SELECT", "nope"), "-ERR unknown group 'nope'")
+
+	c.do(respCommand("INFO", "group"))
+	line, _ := c.r.ReadString('\n')
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		t.Fatalf("INFO reply %q", line)
+	}
+	info := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, info); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(info), "# Group\r\ngroup:resp-default\r\ngets:2\r\n") || strings.Contains(string(info), "# Server") {
+		t.Fatalf("INFO group = %q", info)
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	c := startRESP(t, memcacheGroup("resp3"))
+
+	c.do(respCommand("HELLO", "3"), "%6", "$6", "server", "$5", "redis", "$7", "version", "$"+strconv.Itoa(len(respVersion)), respVersion,
+		"$5", "proto", ":3", "$4", "mode", "$10", "standalone", "$4", "role", "$6", "master", "$7", "modules", "*0")
+	c.do(respCommand("GET", "missing"), "_")
+	c.do(respCommand("HELLO", "4"), "-NOPROTO unsupported protocol version")
+
+	// pipelined commands are answered in order
+	c.do(respCommand("SET", "a", "1")+respCommand("GET", "a")+respCommand("QUIT"), "+OK", "$1", "1", "+OK")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatalf("connection still open after QUIT")
+	}
+}
@@ -1,12 +1,15 @@
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 /*
 	A call stand for an executing request
 */
 type call struct {
-	wg sync.WaitGroup
+	done chan struct{} // closed when the call is finished
 	val interface{}
 	err error
 }
@@ -23,21 +26,49 @@ func (g *CallsGroup) Do(key string, fn func() (interface{}, error)) (interface{}
 	}
 	if c, ok := g.mapping[key]; ok{
 		g.mu.Unlock()
-		c.wg.Wait()
+		<-c.done
 		return c.val, c.err
 	}
 
-	c := &call{}
-	c.wg.Add(1)
+	c := &call{done: make(chan struct{})}
 	g.mapping[key] = c
 	g.mu.Unlock()
 
+	g.run(key, c, fn)
+
+	return c.val, c.err
+}
+
+// DoContext is Do, but every caller stops waiting once its ctx is done.
+// The call itself keeps running for the other callers, fn should watch the
+// context of the first caller if it wants to give up early.
+func (g *CallsGroup) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.mapping == nil {
+		g.mapping = make(map[string]*call, 0)
+	}
+	c, ok := g.mapping[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		g.mapping[key] = c
+		go g.run(key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *CallsGroup) run(key string, c *call, fn func() (interface{}, error)) {
 	c.val, c.err = fn()
-	c.wg.Done()
 
 	g.mu.Lock()
 	delete(g.mapping, key)
 	g.mu.Unlock()
 
-	return c.val, c.err
-}
\ No newline at end of file
+	close(c.done)
+}
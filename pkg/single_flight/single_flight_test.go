@@ -0,0 +1,53 @@
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g CallsGroup
+	v, err := g.Do("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if v != "bar" || err != nil {
+		t.Errorf("Do = %v, %v", v, err)
+	}
+}
+
+func TestDoContextWaiterGivesUp(t *testing.T) {
+	var g CallsGroup
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+
+	result := make(chan interface{})
+	go func() {
+		v, _ := g.DoContext(context.Background(), "key", fn)
+		result <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// a second caller with a short deadline does not wait for the slow call
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.DoContext(ctx, "key", fn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("DoContext err = %v, want deadline exceeded", err)
+	}
+
+	// the call goes on for the first caller
+	close(release)
+	if v := <-result; v != "bar" {
+		t.Fatalf("first caller got %v", v)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("fn called %d times, want 1", n)
+	}
+}
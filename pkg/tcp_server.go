@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// tcpServer tracks the listeners and connections of a protocol front-end,
+// so that Close stops all of them.
+type tcpServer struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+
+	// ctx is cancelled by Close, it bounds the group operations of the connections
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	currConns  AtomicInt
+	totalConns AtomicInt
+}
+
+func (s *tcpServer) init() {
+	s.listeners = make(map[net.Listener]struct{})
+	s.conns = make(map[net.Conn]struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+// serve accepts connections on lis and serves each one with handle
+// in its own goroutine, until Close is called.
+func (s *tcpServer) serve(lis net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		lis.Close()
+		return nil
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, lis)
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// Close stops the listeners and closes every open connection.
+func (s *tcpServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *tcpServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.currConns.Add(1)
+	s.totalConns.Add(1)
+	return true
+}
+
+func (s *tcpServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.currConns.Add(-1)
+	conn.Close()
+}
+
+// logConnError logs why a connection is dropped, unless the client
+// or Close closed it.
+func logConnError(conn net.Conn, err error) {
+	if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed) {
+		log.Printf("%v: %v", conn.RemoteAddr(), err)
+	}
+}